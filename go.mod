@@ -3,6 +3,9 @@ module github.com/ainmosni/mediasync-server
 go 1.14
 
 require (
+	github.com/graph-gophers/graphql-go v1.1.0
 	github.com/spf13/viper v1.7.0
 	go.uber.org/zap v1.15.0
+	golang.org/x/net v0.0.0-20200707034311-ab3426394381
+	golang.org/x/sys v0.0.0-20200323222414-85ca7c5b95cd
 )
@@ -17,29 +17,226 @@ limitations under the License.
 package main
 
 import (
+	"context"
 	"fmt"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"os/signal"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
+	"github.com/ainmosni/mediasync-server/pkg/cli"
 	"github.com/ainmosni/mediasync-server/pkg/fs"
+	"github.com/ainmosni/mediasync-server/pkg/httputil"
+	"github.com/ainmosni/mediasync-server/pkg/logging"
 	"github.com/ainmosni/mediasync-server/pkg/server"
+	"github.com/ainmosni/mediasync-server/pkg/tags"
 
 	"github.com/ainmosni/mediasync-server/pkg/config"
 	"go.uber.org/zap"
 )
 
+// leaderInterval is how often a follower tries to become the leader.
+const leaderInterval = 10 * time.Second
+
+// indexRetryInterval is how often roots failing their first scan are retried.
+const indexRetryInterval = 30 * time.Second
+
 func main() {
 	logger, err := zap.NewProduction()
 	if err != nil {
 		panic(fmt.Errorf("can't initialise logger: %w", err))
 	}
 
+	if len(os.Args) > 1 {
+		cmd, ok := cli.Commands[os.Args[1]]
+		if !ok {
+			cli.Usage(os.Stderr)
+			os.Exit(2) //nolint:gomnd
+		}
+		os.Exit(cmd(os.Args[2:], logger))
+	}
+
 	c, err := config.GetConfig()
 	if err != nil {
 		logger.Fatal("can't get configuration", zap.Error(err))
 	}
-	s := server.New("0.0.0.0", 4242, logger)
+	logger = newLogger(c.Logging, logger)
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+		sig := <-sigs
+		logger.Info("received signal, stopping", zap.String("signal", sig.String()))
+		cancel()
+	}()
+	serve(ctx, c, logger)
+}
+
+// serve sets up the server and serves until ctx is done, background work stops
+// with it.
+func serve(ctx context.Context, c *config.Configuration, logger *zap.Logger) {
+	var err error
+	s := server.New(c.Host, c.Port, logger)
+	s.SetShutdownTimeout(c.ShutdownTimeout)
+	for _, l := range c.Listeners {
+		s.Listen(l.Network, l.Host, l.Port)
+	}
+	if c.H2C {
+		s.EnableH2C()
+	}
+	if c.TLSCert != "" || c.TLSKey != "" {
+		if c.TLSCert == "" || c.TLSKey == "" {
+			logger.Fatal("tls_cert and tls_key have to be set together")
+		}
+		s.EnableTLS(c.TLSCert, c.TLSKey)
+	}
+	if c.TLSClientCA != "" {
+		if c.TLSCert == "" {
+			logger.Fatal("tls_client_ca needs tls_cert and tls_key")
+		}
+		if err := s.RequireClientCerts(c.TLSClientCA); err != nil {
+			logger.Fatal("can't load client CAs", zap.Error(err))
+		}
+	}
+	s.SetLimits(c.MaxHeaderBytes, c.MaxBodyBytes)
+	s.SetKeepAlive(c.KeepAlive)
+	s.SetStallDetection(c.StalledTransfers.After, c.StalledTransfers.AbortAfter)
+	var faults *server.FaultInjector
+	if fc := c.FaultInjection; fc.Enabled {
+		faults = server.NewFaultInjector(server.FaultConfig{
+			Latency:      fc.Latency,
+			LatencyRate:  fc.LatencyRate,
+			ErrorRate:    fc.ErrorRate,
+			TruncateRate: fc.TruncateRate,
+			DropRate:     fc.DropRate,
+		}, logger)
+	}
+
+	// In replay mode we only serve recordings, the library isn't touched.
+	if c.ReplayDir != "" {
+		s.Use(faults.Wrap)
+		s.Handle("/", server.NewReplayHandler(c.ReplayDir, logger))
+		run(ctx, s, logger)
+		return
+	}
+
+	var recorder *server.Recorder
+	if c.RecordDir != "" {
+		recorder, err = server.NewRecorder(c.RecordDir, logger)
+		if err != nil {
+			logger.Fatal("can't start recorder", zap.Error(err))
+		}
+	}
+	var limiter *server.RateLimiter
+	if rl := c.RateLimit; rl.Enabled {
+		limiter = server.NewRateLimiter(rl.Requests, rl.Window, logger)
+	}
+	auth := newAuth(c, logger)
+	s.Use(limiter.Wrap, auth.Wrap, faults.Wrap, recorder.Wrap)
+
+	var tagStore *tags.Store
+	if c.TagsFile != "" {
+		tagStore, err = tags.NewStore(c.TagsFile, logger)
+		if err != nil {
+			logger.Fatal("can't load tags", zap.Error(err))
+		}
+		s.Handle("/tags", server.NewTagsHandler(tagStore, logger), "GET", "PUT")
+	}
+
 	r := fs.NewRegistry(logger)
-	s.Handle("/fileinfo", server.NewFileInfoHandler(r, logger))
+	rules := cli.NewRules(c.Exclude, logger)
+	checksums, err := cli.NewChecksums(c, rules, logger)
+	if err != nil {
+		logger.Fatal("can't set up checksums", zap.Error(err))
+	}
+	if q := c.Quarantine; q.Enabled {
+		quarantine := fs.NewQuarantine(q.Threshold, q.Backoff, q.MaxBackoff, logger)
+		r.SetQuarantine(quarantine)
+		checksums.SetQuarantine(quarantine)
+	}
+	if m := c.Metadata; m.Enabled {
+		r.SetMetadata(&fs.MetadataOptions{Xattrs: m.Xattrs})
+	}
+	r.SetRules(rules)
+	if t := c.FSTimeouts; t.Enabled {
+		r.SetTimeouts(fs.Timeouts{Stat: t.Stat, Scan: t.Scan, Threshold: t.Threshold, Cooldown: t.Cooldown})
+	}
+	if (c.LeaderLock != "" || c.CleanLock != "") && !fs.LocksSupported {
+		logger.Fatal("leader_lock and clean_lock need file locks, which aren't supported on this platform")
+	}
+	var cleanLock *fs.FileLock
+	if c.CleanLock != "" {
+		cleanLock = fs.NewFileLock(c.CleanLock, logger)
+		r.SetCleanLock(cleanLock)
+	}
+	if c.LeaderLock != "" {
+		leadership := fs.NewLeadership(c.LeaderLock, logger)
+		r.SetLeadership(leadership)
+		go leadership.Run(ctx, leaderInterval)
+	}
+	for _, a := range c.ChecksumAlgorithms {
+		if _, err := httputil.NewChecksum(a); err != nil {
+			logger.Fatal("invalid checksum algorithm", zap.Error(err))
+		}
+	}
+	fileInfo := server.NewFileInfoHandler(r, tagStore, logger)
+	fileInfo.SetChecksumAlgorithms(c.ChecksumAlgorithms)
+	fileInfo.SetChecksums(checksums)
+	go checksums.Run(ctx)
+	// Files gone from the roots would otherwise stay cached forever.
+	r.OnChange(func() { go checksums.Prune(r.DiskPaths()) })
+	if sc := c.Standby; sc.Primary != "" {
+		r.SetReadOnly()
+		standby := server.NewStandby(sc.Primary, sc.Token, sc.Timeout, logger)
+		fileInfo.SetStandby(standby)
+		go standby.Run(ctx, sc.Interval)
+	}
+	s.Handle("/fileinfo", fileInfo, "GET")
+	graphQL := server.NewGraphQLHandler(r, logger)
+	graphQL.SetChecksums(checksums)
+	s.Handle("/graphql", graphQL, "POST")
+	if c.Features.UI {
+		s.Handle("/browse", server.NewBrowseHandler(r, logger), "GET")
+	}
+	s.Handle("/links", server.NewLinksHandler(r, logger), "GET")
+	var textIndex *fs.TextIndex
+	if ti := c.TextIndex; ti.Enabled {
+		textIndex = fs.NewTextIndex(ti.Extensions, ti.MaxSize, logger)
+	}
+	reports := server.NewReportsHandler(r, c.AllowDedup, logger)
+	reports.SetChecksums(checksums)
+	reports.SetCleanLock(cleanLock)
+	s.Handle("/reports/{name}", reports, "GET", "POST")
+	s.Handle("/search", server.NewSearchHandler(r, textIndex, logger), "GET")
+	var uploads *server.UploadHandler
+	if u := c.Uploads; c.Features.Uploads && u.Dir != "" && c.Standby.Primary == "" {
+		uploads, err = server.NewUploadHandler(u.Dir, u.TTL, u.MaxSize, logger)
+		if err != nil {
+			logger.Fatal("can't start uploads", zap.Error(err))
+		}
+		uploads.SetRules(rules)
+		s.Handle("/uploads", http.HandlerFunc(uploads.Create), "POST")
+		s.Handle("/uploads/{id}", http.HandlerFunc(uploads.Status), "GET", "HEAD")
+		s.Handle("/uploads/{id}", http.HandlerFunc(uploads.Append), "PATCH")
+		s.SetBodyLimit("PATCH", "/uploads/{id}", u.MaxChunkBytes)
+		s.Handle("/uploads/{id}", http.HandlerFunc(uploads.Cancel), "DELETE")
+	}
+	journal := server.NewJournal()
+	if sr := c.ScheduledReports; sr.Interval > 0 {
+		history, err := server.NewReportHistory(reports, journal, checksums, sr.File, sr.Keep, logger)
+		if err != nil {
+			logger.Fatal("can't load report history", zap.Error(err))
+		}
+		reports.SetHistory(history)
+		go history.Run(ctx, sr.Interval)
+	}
+	metrics := server.NewMetrics(s.Transfers(), r, checksums)
+	maintain := false
 	for _, p := range c.FilePaths {
 		servePath := p.ServePath
 		if !strings.HasSuffix(p.ServePath, "/") {
@@ -54,8 +251,150 @@ func main() {
 				zap.Error(err),
 			)
 		}
-		s.Handle(servePath, server.NewDownloadHandler(p.DiskPath, servePath, logger))
+		if p.Symlinks {
+			r.SetSymlinks(servePath)
+		}
+		if p.CaseInsensitive {
+			r.SetCaseInsensitive(servePath)
+		}
+		if sc := p.Sidecars; sc.CleanOrphans {
+			maintain = true
+			r.SetSidecarPolicy(servePath, fs.NewSidecarPolicy(sc.Extensions, sc.MediaExtensions, sc.DryRun))
+		}
+		if pp := cli.PriorityPolicy(p); pp != nil {
+			r.SetPriorityPolicy(servePath, pp)
+		}
+		if p.Expiry.Days > 0 {
+			maintain = true
+			r.SetExpiryPolicy(servePath, &fs.ExpiryPolicy{
+				MaxAge:   time.Duration(p.Expiry.Days) * 24 * time.Hour,
+				TrashDir: p.Expiry.TrashDir,
+			})
+		}
+		dh := server.NewDownloadHandler(p.DiskPath, servePath, rules, logger)
+		if c.RequireIfMatch {
+			dh.RequireIfMatch()
+		}
+		if len(p.Headers) > 0 {
+			dh.SetHeaders(p.Headers)
+		}
+		dh.SetChecksumAlgorithms(c.ChecksumAlgorithms)
+		dh.SetBreaker(r.Breaker(servePath), c.FSTimeouts.Stat)
+		dh.SetDeleteLock(cleanLock)
+		dh.SetChecksums(checksums)
+		dh.SetJournal(journal)
+		dh.SetMetrics(metrics)
+		if c.VerifyDownloads {
+			dh.VerifyDownloads()
+		}
+		t := p.IOTuning
+		dh.SetIOTuning(fs.IOTuning{Sequential: t.Sequential, ReadAhead: t.ReadAhead, Direct: t.Direct})
+		if p.CaseInsensitive {
+			dh.SetCaseInsensitive()
+		}
+		methods := []string{"GET", "HEAD"}
+		if c.Features.Deletes {
+			methods = append(methods, "DELETE")
+		}
+		s.Handle(servePath, dh, methods...)
+		if uploads != nil {
+			uploads.AddRoot(servePath, p.DiskPath)
+		}
+	}
+	if maintain {
+		go r.RunMaintenance(ctx, c.ExpiryInterval)
+	}
+	monitoring := c.Features.Metrics && c.MonitoringPort != 0
+	listeners, err := server.ExpandListeners(s.Listeners())
+	if err != nil {
+		logger.Warn("couldn't list interface addresses, leaving wildcard listeners out of the capabilities", zap.Error(err))
 	}
+	s.Handle("/v1/capabilities", server.CapabilitiesHandler(server.Capabilities{
+		Features: map[string]bool{
+			"uploads": uploads != nil,
+			"deletes": c.Features.Deletes,
+			"metrics": monitoring,
+			"ui":      c.Features.UI,
+		},
+		ChecksumAlgorithms: c.ChecksumAlgorithms,
+		ManifestFormats:    []string{httputil.JSONContentType, httputil.CBORContentType, httputil.ProtobufContentType},
+		Listeners:          listeners,
+	}), "GET")
+	if c.MonitoringPort != 0 {
+		go serveMonitoring(c, s, r, journal, checksums, metrics, logger)
+	}
+	// Readiness waits for the first scan of every root.
+	go r.Index(ctx, indexRetryInterval)
+	run(ctx, s, logger)
+}
+
+// run serves until ctx is done, or exits when serving fails.
+func run(ctx context.Context, s *server.Server, logger *zap.Logger) {
 	logger.Info("starting server")
-	logger.Fatal("stopping server", zap.Error(s.Serve()))
+	if err := s.Serve(ctx); err != nil {
+		logger.Fatal("stopping server", zap.Error(err))
+	}
+	logger.Info("server stopped")
+	_ = logger.Sync()
+}
+
+// serveMonitoring serves the health checks on the monitoring port, and the
+// metrics unless they're disabled.
+func serveMonitoring(c *config.Configuration, s *server.Server, r *fs.Registry, journal *server.Journal,
+	checksums *fs.Checksums, metrics *server.Metrics, logger *zap.Logger) {
+	mux := http.NewServeMux()
+	mux.Handle("/healthz", server.HealthHandler())
+	mux.Handle("/readyz", server.ReadinessHandler(r))
+	if c.Features.Metrics {
+		mux.Handle("/transfers", s.Transfers())
+		mux.Handle("/transfers/stalled", s.StalledHandler())
+		mux.Handle("/stats/transfers", journal)
+		mux.Handle("/stats/checksums", server.ChecksumStatsHandler(checksums))
+		mux.Handle("/metrics", metrics)
+	}
+	if c.PProf {
+		mux.HandleFunc("/debug/pprof/", pprof.Index)
+		mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	}
+	addr := net.JoinHostPort(c.MonitoringHost, strconv.Itoa(c.MonitoringPort))
+	logger.Info("starting monitoring server", zap.String("address", addr))
+	logger.Error("monitoring server stopped", zap.Error(http.ListenAndServe(addr, mux)))
+}
+
+// newAuth builds the token authentication the configuration asks for, nil when
+// no tokens are configured. An empty token file still requires tokens.
+func newAuth(c *config.Configuration, logger *zap.Logger) *server.TokenAuth {
+	if c.TokenSecret == "" && len(c.Tokens) == 0 && c.TokenFile == "" {
+		return nil
+	}
+	static := c.Tokens
+	if c.TokenFile != "" {
+		tokens, err := server.ReadTokenFile(c.TokenFile)
+		if err != nil {
+			logger.Fatal("can't read token file", zap.Error(err))
+		}
+		static = append(static, tokens...)
+	}
+	auth := server.NewTokenAuth([]byte(c.TokenSecret), logger)
+	auth.AddTokens(static...)
+	return auth
+}
+
+// newLogger builds the logger the configuration asks for, logger is used for
+// errors opening the log file.
+func newLogger(lc config.Logging, logger *zap.Logger) *zap.Logger {
+	if lc.File == "" {
+		return logging.New(true)
+	}
+	f, err := logging.OpenFile(lc.File, lc.MaxSize, lc.MaxAge, lc.MaxBackups)
+	if err != nil {
+		logger.Fatal("can't open log file", zap.Error(err))
+	}
+	logger = logging.New(lc.Stderr, f)
+	f.ReopenOn(logger, syscall.SIGHUP)
+	return logger
 }
+
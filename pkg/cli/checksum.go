@@ -0,0 +1,192 @@
+/*
+Copyright 2020 Daniël Franke
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cli
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ainmosni/mediasync-server/pkg/config"
+	"github.com/ainmosni/mediasync-server/pkg/fs"
+	"go.uber.org/zap"
+)
+
+// warmupStats counts what a checksum warm-up did with each file, the counters
+// are atomic.
+type warmupStats struct {
+	files, bytes            int64
+	hashed, hashedBytes     int64
+	stored, skipped, failed int64
+}
+
+func (s *warmupStats) progress(w io.Writer) {
+	fmt.Fprintf(w, "hashed %d of %d files, %.1f of %.1f GiB\n",
+		atomic.LoadInt64(&s.hashed), s.files,
+		float64(atomic.LoadInt64(&s.hashedBytes))/(1<<30), float64(s.bytes)/(1<<30))
+}
+
+func (s *warmupStats) report(w io.Writer, elapsed time.Duration) {
+	fmt.Fprintf(w, "%d hashed, %d already stored, %d skipped by the policy, %d failed, in %s\n",
+		s.hashed, s.stored, s.skipped, s.failed, elapsed.Round(time.Second))
+}
+
+// Checksum computes the checksums of the files in the configured roots, or
+// only root, and stores them with the checksum providers. A server started
+// afterwards loads them instead of hashing the files again, after migrating a
+// library for instance. Unlike the server it also hashes the files the policy
+// leaves for downloads, only skipped extensions aren't hashed.
+func Checksum(args []string, logger *zap.Logger) int {
+	fl := flag.NewFlagSet("checksum", flag.ExitOnError)
+	root := fl.String("root", "", "directory to hash, all configured roots when empty")
+	servePath := fl.String("serve-path", "/", "serve path of root, when it isn't configured")
+	workers := fl.Int("workers", 2, "number of files hashed at the same time")
+	progress := fl.Duration("progress", 10*time.Second, "how often to print progress, 0 disables it")
+	_ = fl.Parse(args)
+	if *workers < 1 {
+		fl.Usage()
+		return 2
+	}
+
+	c, err := config.GetConfig()
+	if err != nil {
+		logger.Error("couldn't read configuration", zap.Error(err))
+		return 1
+	}
+	// Without providers the checksums would be gone when we exit.
+	if len(c.ChecksumProviders) == 0 {
+		logger.Error("no checksum_providers configured to store checksums with")
+		return 1
+	}
+	roots := c.FilePaths
+	if *root != "" {
+		roots = []config.FilePath{scanRoot(c.FilePaths, *root, *servePath)}
+	}
+	if len(roots) == 0 {
+		fl.Usage()
+		return 2
+	}
+
+	rules := NewRules(c.Exclude, logger)
+	checksums, err := NewChecksums(c, rules, logger)
+	if err != nil {
+		logger.Error("couldn't set up checksums", zap.Error(err))
+		return 1
+	}
+	r, err := NewRegistry(c, roots, rules, logger)
+	if err != nil {
+		logger.Error("couldn't register roots", zap.Error(err))
+		return 1
+	}
+
+	ctx := context.Background()
+	files, err := r.ScanAllFiles(ctx)
+	if err != nil {
+		logger.Error("couldn't scan root", zap.Error(err))
+		return 1
+	}
+	for p := range r.Degraded() {
+		logger.Error("couldn't scan root", zap.String("servePath", p))
+		return 1
+	}
+	fsos := make([]*fs.FilesystemObject, 0, len(files))
+	for _, f := range files {
+		if !f.IsDir {
+			fsos = append(fsos, f.FilesystemObject)
+		}
+	}
+
+	start := time.Now()
+	stats := warmChecksums(ctx, checksums, fsos, *workers, *progress, os.Stdout, logger)
+	stats.report(os.Stdout, time.Since(start))
+	if stats.failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// warmChecksums hashes the files without a stored checksum with workers at a
+// time, and prints the progress to w every interval.
+func warmChecksums(ctx context.Context, checksums *fs.Checksums, files []*fs.FilesystemObject,
+	workers int, interval time.Duration, w io.Writer, logger *zap.Logger) *warmupStats {
+	stats := &warmupStats{}
+	todo := make([]*fs.FilesystemObject, 0, len(files))
+	for _, f := range files {
+		if _, ok := checksums.Load(f); ok {
+			stats.stored++
+			continue
+		}
+		todo = append(todo, f)
+		stats.files++
+		stats.bytes += f.Size
+	}
+
+	queue := make(chan *fs.FilesystemObject)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for f := range queue {
+				_, err := checksums.Sum(ctx, f)
+				switch {
+				case errors.Is(err, fs.ErrChecksumSkipped):
+					atomic.AddInt64(&stats.skipped, 1)
+				case err != nil:
+					logger.Warn("couldn't compute checksum", zap.String("path", f.Path), zap.Error(err))
+					atomic.AddInt64(&stats.failed, 1)
+				default:
+					atomic.AddInt64(&stats.hashed, 1)
+					atomic.AddInt64(&stats.hashedBytes, f.Size)
+				}
+			}
+		}()
+	}
+
+	done := make(chan struct{})
+	var printer sync.WaitGroup
+	if interval > 0 {
+		printer.Add(1)
+		go func() {
+			defer printer.Done()
+			t := time.NewTicker(interval)
+			defer t.Stop()
+			for {
+				select {
+				case <-done:
+					return
+				case <-t.C:
+					stats.progress(w)
+				}
+			}
+		}()
+	}
+	for _, f := range todo {
+		queue <- f
+	}
+	close(queue)
+	wg.Wait()
+	close(done)
+	printer.Wait()
+	return stats
+}
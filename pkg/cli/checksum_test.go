@@ -0,0 +1,74 @@
+/*
+Copyright 2020 Daniël Franke
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cli
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ainmosni/mediasync-server/pkg/fs"
+	"go.uber.org/zap"
+)
+
+func TestWarmChecksums(t *testing.T) {
+	dir, err := ioutil.TempDir("", "warmup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var files []*fs.FilesystemObject
+	for _, name := range []string{"a.mkv", "b.mkv", "c.iso"} {
+		p := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(p, []byte(name), 0o640); err != nil {
+			t.Fatal(err)
+		}
+		fso, err := fs.ObjFromPath(p, false, zap.NewNop())
+		if err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, fso)
+	}
+	newChecksums := func() *fs.Checksums {
+		c := fs.NewChecksums(zap.NewNop(), fs.SidecarChecksums())
+		// Files the policy leaves for downloads are warmed up too.
+		c.SetPolicy(fs.ChecksumPolicy{EagerMaxSize: 1, SkipExtensions: []string{".iso"}})
+		return c
+	}
+
+	tests := []struct {
+		name                    string
+		hashed, stored, skipped int64
+	}{
+		{"cold", 2, 0, 1},
+		{"warm", 0, 2, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// A new cache, like a server started afterwards, only has the providers.
+			stats := warmChecksums(context.Background(), newChecksums(), files, 2, 0, ioutil.Discard, zap.NewNop())
+			if stats.hashed != tt.hashed || stats.stored != tt.stored || stats.skipped != tt.skipped || stats.failed != 0 {
+				t.Errorf("warmChecksums() = %+v, want %d hashed, %d stored and %d skipped", *stats, tt.hashed, tt.stored, tt.skipped)
+			}
+		})
+	}
+	if _, err := os.Stat(filepath.Join(dir, "a.mkv"+fs.SidecarChecksumSuffix)); err != nil {
+		t.Errorf("checksum wasn't stored: %v", err)
+	}
+}
@@ -0,0 +1,53 @@
+/*
+Copyright 2020 Daniël Franke
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package cli contains the subcommands of mediasync-server, next to serving.
+package cli
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	"go.uber.org/zap"
+)
+
+// Command is a subcommand, it returns the exit status of the process.
+type Command func(args []string, logger *zap.Logger) int
+
+// Commands maps subcommand names to their implementation.
+var Commands = map[string]Command{
+	"checksum": Checksum,
+	"compare":  Compare,
+	"doctor":   Doctor,
+	"loadgen":  Loadgen,
+	"scan":     Scan,
+	"token":    Token,
+}
+
+// Usage prints the available subcommands.
+func Usage(w io.Writer) {
+	names := make([]string, 0, len(Commands))
+	for n := range Commands {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	fmt.Fprintf(w, "usage: %s [command] [flags]\n\nWithout a command the server is started. Commands:\n", os.Args[0])
+	for _, n := range names {
+		fmt.Fprintf(w, "  %s\n", n)
+	}
+}
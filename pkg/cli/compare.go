@@ -0,0 +1,176 @@
+/*
+Copyright 2020 Daniël Franke
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cli
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ainmosni/mediasync-server/pkg/fs"
+	"github.com/ainmosni/mediasync-server/pkg/httputil"
+	"go.uber.org/zap"
+)
+
+const fetchTimeout = 5 * time.Minute
+
+// Compare fetches two manifests, from servers or local directories, and prints
+// the files that are missing, extra or different in the second one. Files
+// differ in size, or in checksum or ETag when both manifests have them.
+func Compare(args []string, logger *zap.Logger) int {
+	fl := flag.NewFlagSet("compare", flag.ExitOnError)
+	servePath := fl.String("serve-path", "/", "serve path to generate web paths for local directories")
+	token := fl.String("token", "", "token to send to servers")
+	fl.Usage = func() {
+		fmt.Fprintf(fl.Output(), "usage: compare [flags] <server URL or directory> <server URL or directory>\n")
+		fl.PrintDefaults()
+	}
+	_ = fl.Parse(args)
+	if fl.NArg() != 2 {
+		fl.Usage()
+		return 2
+	}
+
+	a, err := loadManifest(fl.Arg(0), *servePath, *token, logger)
+	if err != nil {
+		logger.Error("couldn't load manifest", zap.String("source", fl.Arg(0)), zap.Error(err))
+		return 1
+	}
+	b, err := loadManifest(fl.Arg(1), *servePath, *token, logger)
+	if err != nil {
+		logger.Error("couldn't load manifest", zap.String("source", fl.Arg(1)), zap.Error(err))
+		return 1
+	}
+
+	paths := make([]string, 0, len(a)+len(b))
+	for p := range a {
+		paths = append(paths, p)
+	}
+	for p := range b {
+		if _, ok := a[p]; !ok {
+			paths = append(paths, p)
+		}
+	}
+	sort.Strings(paths)
+
+	differences := 0
+	for _, p := range paths {
+		fa, inA := a[p]
+		fb, inB := b[p]
+		switch {
+		case !inB:
+			fmt.Printf("missing   %s\n", p)
+		case !inA:
+			fmt.Printf("extra     %s\n", p)
+		default:
+			diff := difference(fa, fb)
+			if diff == "" {
+				continue
+			}
+			fmt.Printf("mismatch  %s (%s)\n", p, diff)
+		}
+		differences++
+	}
+
+	if differences > 0 {
+		fmt.Printf("%d differences\n", differences)
+		return 1
+	}
+	return 0
+}
+
+// difference describes how b differs from a, it's empty when they're the same
+// as far as the manifests tell. Checksums are compared when both have one,
+// ETags otherwise.
+func difference(a, b *fs.WebObject) string {
+	switch {
+	case a.Size != b.Size:
+		return fmt.Sprintf("%d != %d bytes", a.Size, b.Size)
+	case a.Checksum != "" && b.Checksum != "":
+		if a.Checksum != b.Checksum {
+			return fmt.Sprintf("checksum %s != %s", a.Checksum, b.Checksum)
+		}
+	case a.ETag != "" && b.ETag != "" && a.ETag != b.ETag:
+		return fmt.Sprintf("etag %s != %s", a.ETag, b.ETag)
+	}
+	return ""
+}
+
+// loadManifest returns the files of a source, keyed by web path.
+func loadManifest(source, servePath, token string, logger *zap.Logger) (map[string]*fs.WebObject, error) {
+	var files []*fs.WebObject
+	var err error
+	if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
+		ctx, cancel := context.WithTimeout(context.Background(), fetchTimeout)
+		defer cancel()
+		files, err = fetchManifest(ctx, source, token)
+	} else {
+		r := fs.NewRegistry(logger)
+		err = r.Register(servePath, source)
+		if err == nil {
+			files, err = r.ScanAllFiles(context.Background())
+		}
+		if err == nil && len(r.Degraded()) > 0 {
+			err = fmt.Errorf("couldn't scan %s", source)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	m := make(map[string]*fs.WebObject, len(files))
+	for _, f := range files {
+		m[f.WebPath] = f
+	}
+	return m, nil
+}
+
+// fetchManifest fetches the manifest of server, sending token when it's set.
+func fetchManifest(ctx context.Context, server, token string) ([]*fs.WebObject, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", strings.TrimRight(server, "/")+"/fileinfo", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", httputil.JSONContentType)
+	// File checksums are only in manifests of their algorithm.
+	req.Header.Set(httputil.ChecksumAlgoHeader, fs.ChecksumAlgo)
+	authorize(req, token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status from %s: %s", server, resp.Status)
+	}
+
+	var files []*fs.WebObject
+	err = json.NewDecoder(resp.Body).Decode(&files)
+	return files, err
+}
+
+// authorize adds token to req, when it's set.
+func authorize(req *http.Request, token string) {
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+}
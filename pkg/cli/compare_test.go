@@ -0,0 +1,48 @@
+/*
+Copyright 2020 Daniël Franke
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cli
+
+import (
+	"testing"
+
+	"github.com/ainmosni/mediasync-server/pkg/fs"
+)
+
+func TestDifference(t *testing.T) {
+	file := func(size int64, checksum, etag string) *fs.WebObject {
+		return &fs.WebObject{FilesystemObject: &fs.FilesystemObject{Size: size, ETag: etag}, Checksum: checksum}
+	}
+	tests := []struct {
+		name string
+		a, b *fs.WebObject
+		want string
+	}{
+		{"same", file(1, "aa", `"1"`), file(1, "aa", `"1"`), ""},
+		{"size", file(1, "aa", `"1"`), file(2, "aa", `"1"`), "1 != 2 bytes"},
+		{"checksum", file(1, "aa", `"1"`), file(1, "bb", `"1"`), "checksum aa != bb"},
+		{"checksum wins over etag", file(1, "aa", `"1"`), file(1, "aa", `"2"`), ""},
+		{"etag", file(1, "", `"1"`), file(1, "bb", `"2"`), `etag "1" != "2"`},
+		{"one unknown", file(1, "aa", ""), file(1, "", `"2"`), ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := difference(tt.a, tt.b); got != tt.want {
+				t.Errorf("difference() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
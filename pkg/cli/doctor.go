@@ -0,0 +1,261 @@
+/*
+Copyright 2020 Daniël Franke
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cli
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/ainmosni/mediasync-server/pkg/config"
+	"github.com/ainmosni/mediasync-server/pkg/fs"
+	"go.uber.org/zap"
+)
+
+const (
+	// minFreeDiskPercentage is the amount of free space below which a root fails.
+	minFreeDiskPercentage = 5
+	// certRenewalWarning is how long before it expires a certificate fails.
+	certRenewalWarning = 14 * 24 * time.Hour
+)
+
+// errUnsupported is returned by checks that can't run on this platform.
+var errUnsupported = errors.New("not supported on this platform")
+
+// doctor collects the results of the deployment checks.
+type doctor struct {
+	failed bool
+}
+
+func (d *doctor) pass(format string, args ...interface{}) {
+	fmt.Printf("[PASS] "+format+"\n", args...)
+}
+
+func (d *doctor) fail(hint, format string, args ...interface{}) {
+	d.failed = true
+	fmt.Printf("[FAIL] "+format+"\n", args...)
+	fmt.Printf("       hint: %s\n", hint)
+}
+
+// Doctor checks the configuration, roots and ports, and reports what is wrong.
+func Doctor(args []string, _ *zap.Logger) int {
+	fl := flag.NewFlagSet("doctor", flag.ExitOnError)
+	_ = fl.Parse(args)
+
+	d := &doctor{}
+	c, err := config.GetConfig()
+	if err != nil {
+		d.fail("create config.yaml in one of "+fmt.Sprint(config.ConfigPaths), "reading configuration: %v", err)
+		return 1
+	}
+	d.pass("configuration read")
+
+	d.checkRoots(c)
+	d.checkPorts(c)
+	d.checkTLS(c)
+	d.checkLocks(c)
+
+	if d.failed {
+		return 1
+	}
+	return 0
+}
+
+func (d *doctor) checkRoots(c *config.Configuration) {
+	if len(c.FilePaths) == 0 {
+		d.fail("add at least one entry to file_paths", "no roots configured")
+		return
+	}
+
+	servePaths := make(map[string]bool)
+	for _, p := range c.FilePaths {
+		if servePaths[p.ServePath] {
+			d.fail("give every root its own serve_path", "serve path %s is used more than once", p.ServePath)
+		}
+		servePaths[p.ServePath] = true
+
+		info, err := os.Stat(p.DiskPath)
+		if err != nil {
+			d.fail("check that the disk is mounted and the path is spelled correctly", "root %s: %v", p.DiskPath, err)
+			continue
+		}
+		if !info.IsDir() {
+			d.fail("disk_path must point to a directory", "root %s is not a directory", p.DiskPath)
+			continue
+		}
+		// Deletes and cleaning need write access, scanning needs read and execute.
+		if err := checkAccess(p.DiskPath); err != nil {
+			d.fail("make the directory readable and writable for the user running the server",
+				"root %s is not accessible: %v", p.DiskPath, err)
+			continue
+		}
+		d.pass("root %s is accessible", p.DiskPath)
+
+		free, total, err := diskSpace(p.DiskPath)
+		if errors.Is(err, errUnsupported) {
+			d.pass("root %s free space not checked: %v", p.DiskPath, err)
+			continue
+		}
+		if err != nil {
+			d.fail("check the filesystem of the root", "can't determine free space of %s: %v", p.DiskPath, err)
+			continue
+		}
+		if total > 0 && free*100/total < minFreeDiskPercentage {
+			d.fail("free up disk space, clients can't sync to a full disk",
+				"root %s has only %d of %d bytes free", p.DiskPath, free, total)
+			continue
+		}
+		d.pass("root %s has %d bytes free", p.DiskPath, free)
+	}
+}
+
+// address is an address the server binds to, and the setting it comes from.
+type address struct {
+	setting string
+	network string
+	host    string
+	port    int
+}
+
+func (a address) String() string {
+	return net.JoinHostPort(a.host, strconv.Itoa(a.port))
+}
+
+// clashes reports whether a and b can't both be bound, as a wildcard host
+// covers every address of its family.
+func (a address) clashes(b address) bool {
+	if a.port != b.port || a.network == "tcp4" && b.network == "tcp6" || a.network == "tcp6" && b.network == "tcp4" {
+		return false
+	}
+	return a.host == b.host || isWildcard(a.host) || isWildcard(b.host)
+}
+
+func isWildcard(host string) bool {
+	ip := net.ParseIP(host)
+	return host == "" || ip != nil && ip.IsUnspecified()
+}
+
+func (d *doctor) checkPorts(c *config.Configuration) {
+	addrs := []address{{setting: "host and port", network: "tcp", host: c.Host, port: c.Port}}
+	for i, l := range c.Listeners {
+		network := l.Network
+		if network == "" {
+			network = "tcp"
+		}
+		addrs = append(addrs, address{setting: fmt.Sprintf("listeners[%d]", i), network: network, host: l.Host, port: l.Port})
+	}
+	if c.MonitoringPort != 0 {
+		addrs = append(addrs, address{setting: "monitoring_port", network: "tcp", host: c.MonitoringHost,
+			port: c.MonitoringPort})
+	}
+	for i, a := range addrs {
+		if d.checkClashes(a, addrs[:i]) {
+			continue
+		}
+		addr := a.String()
+		l, err := net.Listen(a.network, addr)
+		if err != nil {
+			d.fail("stop whatever is using the port, or pick another one", "can't listen on %s: %v", addr, err)
+			continue
+		}
+		l.Close()
+		d.pass("%s is available", addr)
+	}
+}
+
+// checkClashes fails when a clashes with one of the addresses before it, the
+// server wouldn't start.
+func (d *doctor) checkClashes(a address, before []address) bool {
+	for _, b := range before {
+		if a.clashes(b) {
+			d.fail("give every address its own port", "%s %s clashes with %s %s", a.setting, a, b.setting, b)
+			return true
+		}
+	}
+	return false
+}
+
+// checkTLS checks that the certificate and key load and that the certificate
+// isn't about to expire, and that the client CA bundle has certificates.
+func (d *doctor) checkTLS(c *config.Configuration) {
+	if c.TLSClientCA != "" {
+		d.checkClientCA(c)
+	}
+	if c.TLSCert == "" && c.TLSKey == "" {
+		return
+	}
+	if c.TLSCert == "" || c.TLSKey == "" {
+		d.fail("set both tls_cert and tls_key, or neither", "only one of tls_cert and tls_key is set")
+		return
+	}
+	pair, err := tls.LoadX509KeyPair(c.TLSCert, c.TLSKey)
+	if err != nil {
+		d.fail("tls_cert and tls_key have to be a matching PEM certificate and key", "can't load certificate: %v", err)
+		return
+	}
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		d.fail("tls_cert has to be a PEM certificate", "can't parse certificate %s: %v", c.TLSCert, err)
+		return
+	}
+	now := time.Now()
+	switch {
+	case now.Before(cert.NotBefore):
+		d.fail("check the clock of the server", "certificate %s isn't valid before %s", c.TLSCert,
+			cert.NotBefore.Format(time.RFC3339))
+	case now.After(cert.NotAfter):
+		d.fail("renew the certificate", "certificate %s expired on %s", c.TLSCert, cert.NotAfter.Format(time.RFC3339))
+	case cert.NotAfter.Sub(now) < certRenewalWarning:
+		d.fail("renew the certificate", "certificate %s expires on %s", c.TLSCert, cert.NotAfter.Format(time.RFC3339))
+	default:
+		d.pass("certificate %s is valid until %s", c.TLSCert, cert.NotAfter.Format(time.RFC3339))
+	}
+}
+
+func (d *doctor) checkLocks(c *config.Configuration) {
+	if c.LeaderLock == "" && c.CleanLock == "" {
+		return
+	}
+	if !fs.LocksSupported {
+		d.fail("unset leader_lock and clean_lock, and run a single instance", "lock files aren't supported on this platform")
+		return
+	}
+	d.pass("lock files are supported")
+}
+
+func (d *doctor) checkClientCA(c *config.Configuration) {
+	if c.TLSCert == "" {
+		d.fail("set tls_cert and tls_key, client certificates need TLS", "tls_client_ca is set without tls_cert")
+	}
+	b, err := ioutil.ReadFile(c.TLSClientCA)
+	if err != nil {
+		d.fail("check the path of tls_client_ca", "can't read client CA %s: %v", c.TLSClientCA, err)
+		return
+	}
+	if !x509.NewCertPool().AppendCertsFromPEM(b) {
+		d.fail("tls_client_ca has to be a PEM bundle of CA certificates", "no certificates in %s", c.TLSClientCA)
+		return
+	}
+	d.pass("client CA %s has certificates", c.TLSClientCA)
+}
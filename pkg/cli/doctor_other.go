@@ -0,0 +1,41 @@
+//go:build !linux && !darwin && !freebsd
+// +build !linux,!darwin,!freebsd
+
+/*
+Copyright 2020 Daniël Franke
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cli
+
+import (
+	"io/ioutil"
+	"os"
+)
+
+// checkAccess reports whether the user may write to dir, by creating a file
+// in it, as access(2) isn't available everywhere.
+func checkAccess(dir string) error {
+	f, err := ioutil.TempFile(dir, ".mediasync-doctor-")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// diskSpace can't tell the free space on this platform.
+func diskSpace(_ string) (free, total uint64, err error) {
+	return 0, 0, errUnsupported
+}
@@ -0,0 +1,50 @@
+/*
+Copyright 2020 Daniël Franke
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cli
+
+import "testing"
+
+func TestAddressClashes(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b address
+		want bool
+	}{
+		{"default and ipv6 loopback", address{network: "tcp", host: "0.0.0.0", port: 4242},
+			address{network: "tcp6", host: "::1", port: 4242}, true},
+		{"other port", address{network: "tcp", host: "0.0.0.0", port: 4242},
+			address{network: "tcp6", host: "::1", port: 4243}, false},
+		{"empty host", address{network: "tcp", host: "", port: 9090},
+			address{network: "tcp", host: "127.0.0.1", port: 9090}, true},
+		{"same host", address{network: "tcp", host: "127.0.0.1", port: 4242},
+			address{network: "tcp", host: "127.0.0.1", port: 4242}, true},
+		{"distinct hosts", address{network: "tcp", host: "127.0.0.1", port: 4242},
+			address{network: "tcp", host: "192.168.1.2", port: 4242}, false},
+		{"separate families", address{network: "tcp4", host: "0.0.0.0", port: 4242},
+			address{network: "tcp6", host: "::", port: 4242}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.a.clashes(tt.b); got != tt.want {
+				t.Errorf("%v clashes(%v) = %v, want %v", tt.a, tt.b, got, tt.want)
+			}
+			if got := tt.b.clashes(tt.a); got != tt.want {
+				t.Errorf("%v clashes(%v) = %v, want %v", tt.b, tt.a, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,41 @@
+//go:build linux || darwin || freebsd
+// +build linux darwin freebsd
+
+/*
+Copyright 2020 Daniël Franke
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cli
+
+import "syscall"
+
+// accessRWX is R_OK|W_OK|X_OK for access(2).
+const accessRWX = 0x7
+
+// checkAccess reports whether the user may read, write and enter dir.
+func checkAccess(dir string) error {
+	return syscall.Access(dir, accessRWX)
+}
+
+// diskSpace returns the bytes available to the user and the size of the
+// filesystem of dir.
+func diskSpace(dir string) (free, total uint64, err error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return 0, 0, err
+	}
+	// The field types differ per platform.
+	return uint64(st.Bavail) * uint64(st.Bsize), uint64(st.Blocks) * uint64(st.Bsize), nil //nolint:unconvert
+}
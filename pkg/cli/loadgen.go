@@ -0,0 +1,143 @@
+/*
+Copyright 2020 Daniël Franke
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cli
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ainmosni/mediasync-server/pkg/fs"
+	"go.uber.org/zap"
+)
+
+// loadStats collects the latencies and transferred bytes of one request type.
+type loadStats struct {
+	sync.Mutex
+	latencies []time.Duration
+	bytes     int64
+	errors    int
+}
+
+func (s *loadStats) record(d time.Duration, n int64, err error) {
+	s.Lock()
+	defer s.Unlock()
+	if err != nil {
+		s.errors++
+		return
+	}
+	s.latencies = append(s.latencies, d)
+	s.bytes += n
+}
+
+func (s *loadStats) report(name string, elapsed time.Duration) {
+	sort.Slice(s.latencies, func(i, j int) bool { return s.latencies[i] < s.latencies[j] })
+	fmt.Printf("%s: %d requests, %d errors, %.1f MiB/s\n",
+		name, len(s.latencies), s.errors, float64(s.bytes)/elapsed.Seconds()/(1<<20))
+	if len(s.latencies) == 0 {
+		return
+	}
+	for _, p := range []int{50, 90, 99} {
+		fmt.Printf("  p%d: %s\n", p, s.latencies[(len(s.latencies)-1)*p/100])
+	}
+	fmt.Printf("  max: %s\n", s.latencies[len(s.latencies)-1])
+}
+
+// Loadgen simulates clients polling manifests and downloading ranges, and
+// reports latency percentiles and throughput.
+func Loadgen(args []string, logger *zap.Logger) int {
+	fl := flag.NewFlagSet("loadgen", flag.ExitOnError)
+	target := fl.String("target", "", "URL of the server to load")
+	clients := fl.Int("clients", 10, "number of concurrent clients")
+	duration := fl.Duration("duration", 30*time.Second, "how long to generate load")
+	rangeSize := fl.Int64("range-size", 4<<20, "bytes to request per download")
+	token := fl.String("token", "", "token to send to the server")
+	_ = fl.Parse(args)
+	if *target == "" {
+		fl.Usage()
+		return 2
+	}
+	server := strings.TrimRight(*target, "/")
+
+	ctx, cancel := context.WithTimeout(context.Background(), *duration)
+	defer cancel()
+
+	var manifests, downloads loadStats
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i := 0; i < *clients; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ctx.Err() == nil {
+				t := time.Now()
+				files, err := fetchManifest(ctx, server, *token)
+				if ctx.Err() != nil {
+					return
+				}
+				manifests.record(time.Since(t), 0, err)
+				if err != nil || len(files) == 0 {
+					logger.Debug("no manifest to download from", zap.Error(err))
+					continue
+				}
+
+				f := files[rand.Intn(len(files))] //nolint:gosec
+				t = time.Now()
+				n, err := downloadRange(ctx, server+f.WebPath, *token, f, *rangeSize)
+				if ctx.Err() != nil {
+					return
+				}
+				downloads.record(time.Since(t), n, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	elapsed := time.Since(start)
+	manifests.report("manifest", elapsed)
+	downloads.report("download", elapsed)
+	return 0
+}
+
+func downloadRange(ctx context.Context, url, token string, f *fs.WebObject, size int64) (int64, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return 0, err
+	}
+	authorize(req, token)
+	if f.Size > size {
+		offset := rand.Int63n(f.Size - size) //nolint:gosec
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+size-1))
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+		return 0, fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+	return io.Copy(ioutil.Discard, resp.Body)
+}
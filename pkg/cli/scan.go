@@ -0,0 +1,126 @@
+/*
+Copyright 2020 Daniël Franke
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cli
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/ainmosni/mediasync-server/pkg/config"
+	"go.uber.org/zap"
+)
+
+// Scan walks the configured roots, or only root, and writes the manifest
+// /fileinfo would serve for them. It applies the same rules, priorities and
+// metadata options as serving, and computes the checksums the server hashes in
+// the background. Unlike the server it never cleans up empty directories.
+func Scan(args []string, logger *zap.Logger) int {
+	fl := flag.NewFlagSet("scan", flag.ExitOnError)
+	root := fl.String("root", "", "directory to scan, all configured roots when empty")
+	servePath := fl.String("serve-path", "/", "serve path to generate web paths for, when root isn't configured")
+	out := fl.String("out", "-", "file to write the manifest to, - for stdout")
+	_ = fl.Parse(args)
+
+	c, err := config.GetConfig()
+	if err != nil {
+		logger.Error("couldn't read configuration", zap.Error(err))
+		return 1
+	}
+	roots := c.FilePaths
+	if *root != "" {
+		roots = []config.FilePath{scanRoot(c.FilePaths, *root, *servePath)}
+	}
+	if len(roots) == 0 {
+		fl.Usage()
+		return 2
+	}
+
+	rules := NewRules(c.Exclude, logger)
+	checksums, err := NewChecksums(c, rules, logger)
+	if err != nil {
+		logger.Error("couldn't set up checksums", zap.Error(err))
+		return 1
+	}
+	r, err := NewRegistry(c, roots, rules, logger)
+	if err != nil {
+		logger.Error("couldn't register roots", zap.Error(err))
+		return 1
+	}
+
+	ctx := context.Background()
+	files, err := r.ScanAllFiles(ctx)
+	if err != nil {
+		logger.Error("couldn't scan root", zap.Error(err))
+		return 1
+	}
+	// The server keeps serving the rest, but a partial manifest is no use here.
+	for p := range r.Degraded() {
+		logger.Error("couldn't scan root", zap.String("servePath", p))
+		return 1
+	}
+	for _, f := range files {
+		if f.IsDir {
+			continue
+		}
+		sum, ok := checksums.Known(f.FilesystemObject)
+		if !ok && checksums.Eager(f.FilesystemObject) {
+			sum, err = checksums.Sum(ctx, f.FilesystemObject)
+			if err != nil {
+				logger.Warn("couldn't compute checksum", zap.String("path", f.Path), zap.Error(err))
+			}
+		}
+		f.Checksum = sum
+	}
+	sort.SliceStable(files, func(i, j int) bool { return files[i].Priority > files[j].Priority })
+
+	var w io.Writer = os.Stdout
+	if *out != "-" {
+		f, err := os.Create(*out)
+		if err != nil {
+			logger.Error("couldn't create manifest", zap.Error(err))
+			return 1
+		}
+		defer f.Close()
+		w = f
+	}
+	err = json.NewEncoder(w).Encode(files)
+	if err != nil {
+		logger.Error("couldn't write manifest", zap.Error(err))
+		return 1
+	}
+	return 0
+}
+
+// scanRoot returns the configured root with disk path root, so it's scanned
+// with its own options, or a root served at servePath without any.
+func scanRoot(roots []config.FilePath, root, servePath string) config.FilePath {
+	abs, err := filepath.Abs(root)
+	if err != nil {
+		abs = filepath.Clean(root)
+	}
+	for _, p := range roots {
+		if filepath.Clean(p.DiskPath) == abs {
+			return p
+		}
+	}
+	return config.FilePath{ServePath: servePath, DiskPath: root}
+}
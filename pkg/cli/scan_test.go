@@ -0,0 +1,55 @@
+/*
+Copyright 2020 Daniël Franke
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cli
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ainmosni/mediasync-server/pkg/config"
+)
+
+func TestScanRoot(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := []config.FilePath{
+		{ServePath: "/files", DiskPath: filepath.Join(wd, "media"), Priority: 3},
+		{ServePath: "/other", DiskPath: "/srv/other/"},
+	}
+	tests := []struct {
+		name      string
+		root      string
+		wantServe string
+		wantPrio  int
+	}{
+		{"absolute", filepath.Join(wd, "media"), "/files", 3},
+		{"relative", "media", "/files", 3},
+		{"trailing slash configured", "/srv/other", "/other", 0},
+		{"unconfigured", "/srv/else", "/flag", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := scanRoot(roots, tt.root, "/flag")
+			if got.ServePath != tt.wantServe || got.Priority != tt.wantPrio {
+				t.Errorf("scanRoot() = %q with priority %d, want %q with %d", got.ServePath, got.Priority, tt.wantServe, tt.wantPrio)
+			}
+		})
+	}
+}
@@ -0,0 +1,116 @@
+/*
+Copyright 2020 Daniël Franke
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cli
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/ainmosni/mediasync-server/pkg/config"
+	"github.com/ainmosni/mediasync-server/pkg/fs"
+	"go.uber.org/zap"
+)
+
+// openFilesTTL is how long the set of files open for writing is cached.
+const openFilesTTL = 5 * time.Second
+
+// NewRules builds the rules deciding which files are hidden from clients.
+func NewRules(e config.Exclude, logger *zap.Logger) *fs.Rules {
+	rules := fs.NewRules()
+	if e.Dotfiles {
+		rules.Add(fs.DotfileRule())
+	}
+	if len(e.Suffixes) > 0 {
+		rules.Add(fs.SuffixRule(e.Suffixes...))
+	}
+	if len(e.Globs) > 0 {
+		rules.Add(fs.GlobRule(e.Globs...))
+	}
+	if e.MinAge > 0 {
+		rules.Add(fs.MinAgeRule(e.MinAge))
+	}
+	if e.OpenFiles {
+		rules.Add(fs.OpenFileRule(fs.NewOpenFileChecker(openFilesTTL, logger)))
+	}
+	return rules
+}
+
+// NewChecksums builds the checksum cache with its providers and policy, hiding
+// checksum sidecars when they're used.
+func NewChecksums(c *config.Configuration, rules *fs.Rules, logger *zap.Logger) (*fs.Checksums, error) {
+	cps := make([]fs.ChecksumProvider, 0, len(c.ChecksumProviders))
+	for _, p := range c.ChecksumProviders {
+		switch p {
+		case "xattr":
+			cps = append(cps, fs.XattrChecksums())
+		case "sidecar":
+			cps = append(cps, fs.SidecarChecksums())
+			rules.Add(fs.SuffixRule(fs.SidecarChecksumSuffix))
+		default:
+			return nil, fmt.Errorf("unknown checksum provider %q", p)
+		}
+	}
+	checksums := fs.NewChecksums(logger, cps...)
+	checksums.SetPolicy(fs.ChecksumPolicy{
+		EagerMaxSize:   c.ChecksumPolicy.EagerMaxSize,
+		SkipExtensions: c.ChecksumPolicy.SkipExtensions,
+	})
+	return checksums, nil
+}
+
+// NewRegistry registers roots with their options, for commands reading them
+// like the server does. It doesn't maintain them.
+func NewRegistry(c *config.Configuration, roots []config.FilePath, rules *fs.Rules, logger *zap.Logger) (*fs.Registry, error) {
+	r := fs.NewRegistry(logger)
+	if m := c.Metadata; m.Enabled {
+		r.SetMetadata(&fs.MetadataOptions{Xattrs: m.Xattrs})
+	}
+	r.SetRules(rules)
+	for _, p := range roots {
+		sp := p.ServePath
+		if !strings.HasSuffix(sp, "/") {
+			sp += "/"
+		}
+		if err := r.Register(sp, p.DiskPath); err != nil {
+			return nil, fmt.Errorf("couldn't register %s: %w", p.DiskPath, err)
+		}
+		if p.Symlinks {
+			r.SetSymlinks(sp)
+		}
+		if p.CaseInsensitive {
+			r.SetCaseInsensitive(sp)
+		}
+		if pp := PriorityPolicy(p); pp != nil {
+			r.SetPriorityPolicy(sp, pp)
+		}
+	}
+	return r, nil
+}
+
+// PriorityPolicy returns the priority policy of the root p, nil when it has
+// none.
+func PriorityPolicy(p config.FilePath) *fs.PriorityPolicy {
+	if p.Priority == 0 && len(p.Priorities) == 0 {
+		return nil
+	}
+	pp := &fs.PriorityPolicy{Default: p.Priority}
+	for _, rule := range p.Priorities {
+		pp.Rules = append(pp.Rules, fs.PriorityRule{Pattern: rule.Pattern, Priority: rule.Priority})
+	}
+	return pp
+}
@@ -0,0 +1,73 @@
+/*
+Copyright 2020 Daniël Franke
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cli
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/ainmosni/mediasync-server/pkg/config"
+	"github.com/ainmosni/mediasync-server/pkg/tokens"
+	"go.uber.org/zap"
+)
+
+// Token issues a scoped token, signed with the token_secret of the config.
+func Token(args []string, logger *zap.Logger) int {
+	fl := flag.NewFlagSet("token", flag.ExitOnError)
+	paths := fl.String("paths", "", "comma separated path prefixes the token is valid for, empty for all")
+	methods := fl.String("methods", "GET,HEAD", "comma separated methods the token is valid for, empty for all")
+	ttl := fl.Duration("ttl", 24*time.Hour, "how long the token is valid, 0 for forever")
+	_ = fl.Parse(args)
+
+	c, err := config.GetConfig()
+	if err != nil {
+		logger.Error("couldn't read configuration", zap.Error(err))
+		return 1
+	}
+	if c.TokenSecret == "" {
+		logger.Error("token_secret isn't configured")
+		return 1
+	}
+
+	claims := tokens.Claims{
+		Paths:   splitList(*paths),
+		Methods: splitList(*methods),
+	}
+	if *ttl > 0 {
+		claims.Expires = time.Now().Add(*ttl).Unix()
+	}
+	token, err := tokens.Sign([]byte(c.TokenSecret), claims)
+	if err != nil {
+		logger.Error("couldn't sign token", zap.Error(err))
+		return 1
+	}
+	fmt.Println(token)
+	return 0
+}
+
+// splitList splits a comma separated list, an empty string gives no items.
+func splitList(s string) []string {
+	var items []string
+	for _, i := range strings.Split(s, ",") {
+		if i = strings.TrimSpace(i); i != "" {
+			items = append(items, i)
+		}
+	}
+	return items
+}
@@ -0,0 +1,137 @@
+/*
+Copyright 2020 Daniël Franke
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// EnvPrefix prefixes the environment variables overriding configuration, e.g.
+// MEDIASYNC_EXCLUDE_MIN_AGE sets exclude.min_age.
+const EnvPrefix = "MEDIASYNC"
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// bindEnv makes every setting of the configuration overridable from the
+// environment. Lists of tables, like file_paths, can be given as JSON in e.g.
+// MEDIASYNC_FILE_PATHS, or one field at a time in MEDIASYNC_FILE_PATHS_0_DISK_PATH.
+func bindEnv() error {
+	viper.SetEnvPrefix(EnvPrefix)
+	viper.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
+	for _, key := range leafKeys(reflect.TypeOf(Configuration{}), "") {
+		if err := viper.BindEnv(key); err != nil {
+			return err
+		}
+	}
+	// PORT is what most container platforms tell us to listen on.
+	if os.Getenv(envName("port")) == "" && os.Getenv("PORT") != "" {
+		if err := viper.BindEnv("port", "PORT"); err != nil {
+			return err
+		}
+	}
+
+	t := reflect.TypeOf(Configuration{})
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.Type.Kind() != reflect.Slice || f.Type.Elem().Kind() != reflect.Struct {
+			continue
+		}
+		key := f.Tag.Get("mapstructure")
+		tables, err := envTables(key, f.Type.Elem())
+		if err != nil {
+			return err
+		}
+		if tables != nil {
+			viper.Set(key, tables)
+		}
+	}
+	return nil
+}
+
+// envTables reads the list of tables at key from the environment, either as
+// JSON or indexed variables. It returns nil if neither is set.
+func envTables(key string, elem reflect.Type) ([]interface{}, error) {
+	if v := os.Getenv(envName(key)); v != "" {
+		var tables []interface{}
+		if err := json.Unmarshal([]byte(v), &tables); err != nil {
+			return nil, fmt.Errorf("couldn't parse %s: %w", envName(key), err)
+		}
+		return tables, nil
+	}
+
+	var tables []interface{}
+	fields := leafKeys(elem, "")
+	for i := 0; ; i++ {
+		table := map[string]interface{}{}
+		for _, field := range fields {
+			v := os.Getenv(envName(key + "." + strconv.Itoa(i) + "." + field))
+			if v == "" {
+				continue
+			}
+			setPath(table, strings.Split(field, "."), v)
+		}
+		if len(table) == 0 {
+			return tables, nil
+		}
+		tables = append(tables, table)
+	}
+}
+
+// setPath sets the value at the dotted path in nested maps.
+func setPath(m map[string]interface{}, path []string, v string) {
+	for _, p := range path[:len(path)-1] {
+		next, ok := m[p].(map[string]interface{})
+		if !ok {
+			next = map[string]interface{}{}
+			m[p] = next
+		}
+		m = next
+	}
+	m[path[len(path)-1]] = v
+}
+
+// leafKeys returns the dotted keys of the settings in t that fit in a single
+// environment variable, so lists of tables and maps are left out.
+func leafKeys(t reflect.Type, prefix string) []string {
+	var keys []string
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		key := prefix + f.Tag.Get("mapstructure")
+		switch {
+		case f.Type.Kind() == reflect.Struct && f.Type != durationType:
+			keys = append(keys, leafKeys(f.Type, key+".")...)
+		case f.Type.Kind() == reflect.Map:
+		case f.Type.Kind() == reflect.Slice && f.Type.Elem().Kind() != reflect.String:
+		default:
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// envName returns the environment variable for a dotted key.
+func envName(key string) string {
+	return EnvPrefix + "_" + strings.ToUpper(strings.ReplaceAll(key, ".", "_"))
+}
@@ -18,6 +18,8 @@ limitations under the License.
 package config
 
 import (
+	"errors"
+
 	"github.com/spf13/viper"
 )
 
@@ -32,13 +34,54 @@ var ConfigPaths = [...]string{
 }
 
 func GetConfig() (*Configuration, error) {
+	viper.SetDefault("host", "0.0.0.0")
+	viper.SetDefault("port", 4242) //nolint:gomnd
+	// The monitoring endpoints aren't authenticated.
+	viper.SetDefault("monitoring_host", "127.0.0.1")
+	viper.SetDefault("expiry_interval", "1h")
+	viper.SetDefault("exclude.dotfiles", true)
+	viper.SetDefault("exclude.suffixes", []string{"~"})
+	viper.SetDefault("max_header_bytes", 64<<10) //nolint:gomnd
+	viper.SetDefault("max_body_bytes", 1<<20)    //nolint:gomnd
+	viper.SetDefault("rate_limit.requests", 600) //nolint:gomnd
+	viper.SetDefault("rate_limit.window", "1m")
+	viper.SetDefault("checksum_algorithms", []string{"sha256"})
+	viper.SetDefault("fs_timeouts.stat", "5s")
+	viper.SetDefault("fs_timeouts.scan", "10m")
+	viper.SetDefault("fs_timeouts.threshold", 3) //nolint:gomnd
+	viper.SetDefault("fs_timeouts.cooldown", "1m")
+	viper.SetDefault("keepalive", "30s")
+	viper.SetDefault("shutdown_timeout", "30s")
+	viper.SetDefault("stalled_transfers.after", "30s")
+	viper.SetDefault("stalled_transfers.abort_after", "5m")
+	viper.SetDefault("standby.interval", "30s")
+	viper.SetDefault("standby.timeout", "1m")
+	viper.SetDefault("logging.stderr", true)
+	viper.SetDefault("logging.max_size", 100<<20) //nolint:gomnd
+	viper.SetDefault("logging.max_age", "168h")
+	viper.SetDefault("logging.max_backups", 5)  //nolint:gomnd
+	viper.SetDefault("quarantine.threshold", 3) //nolint:gomnd
+	viper.SetDefault("quarantine.backoff", "1m")
+	viper.SetDefault("quarantine.max_backoff", "24h")
+	viper.SetDefault("uploads.ttl", "24h")
+	viper.SetDefault("uploads.max_chunk_bytes", 64<<20) //nolint:gomnd
+	viper.SetDefault("features.uploads", true)
+	viper.SetDefault("features.deletes", true)
+	viper.SetDefault("features.metrics", true)
+	viper.SetDefault("features.ui", true)
+	viper.SetDefault("scheduled_reports.keep", 30) //nolint:gomnd
 	viper.SetConfigName(ConfigName)
 	for _, cp := range ConfigPaths {
 		viper.AddConfigPath(cp)
 	}
 
+	if err := bindEnv(); err != nil {
+		return &Configuration{}, err
+	}
+
+	// Without a config file everything comes from the environment.
 	err := viper.ReadInConfig()
-	if err != nil {
+	if err != nil && !errors.As(err, &viper.ConfigFileNotFoundError{}) {
 		return &Configuration{}, err
 	}
 
@@ -16,14 +16,254 @@ limitations under the License.
 
 package config
 
+import "time"
+
 type Configuration struct {
-	Host           string     `mapstructure:"host"`
-	Port           int        `mapstructure:"port"`
-	MonitoringPort int        `mapstructure:"monitoring_port"`
-	FilePaths      []FilePath `mapstructure:"file_paths"`
+	Host           string        `mapstructure:"host"`
+	Port           int           `mapstructure:"port"`
+	MonitoringPort int           `mapstructure:"monitoring_port"`
+	MonitoringHost string        `mapstructure:"monitoring_host"`
+	Listeners      []Listener    `mapstructure:"listeners"`
+	H2C            bool          `mapstructure:"h2c"`
+	FilePaths      []FilePath    `mapstructure:"file_paths"`
+	FaultInjection Faults        `mapstructure:"fault_injection"`
+	RecordDir      string        `mapstructure:"record_dir"`
+	ReplayDir      string        `mapstructure:"replay_dir"`
+	TagsFile       string        `mapstructure:"tags_file"`
+	TextIndex      TextIndex     `mapstructure:"text_index"`
+	AllowDedup     bool          `mapstructure:"allow_dedup"`
+	ExpiryInterval time.Duration `mapstructure:"expiry_interval"`
+	Exclude        Exclude       `mapstructure:"exclude"`
+	RequireIfMatch bool          `mapstructure:"require_if_match"`
+	MaxHeaderBytes int           `mapstructure:"max_header_bytes"`
+	MaxBodyBytes   int64         `mapstructure:"max_body_bytes"`
+	RateLimit      RateLimit     `mapstructure:"rate_limit"`
+	// ChecksumAlgorithms clients can choose from, the first is the default.
+	ChecksumAlgorithms []string `mapstructure:"checksum_algorithms"`
+	// TokenSecret signs scoped tokens, when set every request needs one.
+	TokenSecret string `mapstructure:"token_secret"`
+	// Tokens and the tokens in TokenFile, one per line, allow every request.
+	Tokens    []string `mapstructure:"tokens"`
+	TokenFile string   `mapstructure:"token_file"`
+	// TLSCert and TLSKey are PEM files, when set we serve HTTPS.
+	TLSCert string `mapstructure:"tls_cert"`
+	TLSKey  string `mapstructure:"tls_key"`
+	// TLSClientCA is a PEM bundle, when set clients need a certificate it signed.
+	TLSClientCA string `mapstructure:"tls_client_ca"`
+	// ShutdownTimeout is how long requests in flight get to finish on SIGTERM.
+	ShutdownTimeout time.Duration `mapstructure:"shutdown_timeout"`
+	// VerifyDownloads compares served files to their known checksum.
+	VerifyDownloads bool `mapstructure:"verify_downloads"`
+	// LeaderLock is a file on storage shared with other instances, only the
+	// instance holding a lock on it does maintenance.
+	LeaderLock string `mapstructure:"leader_lock"`
+	// CleanLock is a file on shared storage held while deleting anything.
+	CleanLock  string     `mapstructure:"clean_lock"`
+	FSTimeouts FSTimeouts `mapstructure:"fs_timeouts"`
+	// KeepAlive is the TCP keepalive period of client connections.
+	KeepAlive        time.Duration    `mapstructure:"keepalive"`
+	StalledTransfers StalledTransfers `mapstructure:"stalled_transfers"`
+	Standby          Standby          `mapstructure:"standby"`
+	Logging          Logging          `mapstructure:"logging"`
+	// ChecksumProviders are where checksums are kept, xattr and/or sidecar.
+	ChecksumProviders []string   `mapstructure:"checksum_providers"`
+	Metadata          Metadata   `mapstructure:"metadata"`
+	Quarantine        Quarantine `mapstructure:"quarantine"`
+	Uploads           Uploads    `mapstructure:"uploads"`
+	Features          Features   `mapstructure:"features"`
+	// ScheduledReports are generated every interval, served in /reports/history.
+	ScheduledReports ScheduledReports `mapstructure:"scheduled_reports"`
+	// PProf serves the profiling endpoints on the monitoring port.
+	PProf bool `mapstructure:"pprof"`
+	// ChecksumPolicy decides which files are hashed when.
+	ChecksumPolicy ChecksumPolicy `mapstructure:"checksum_policy"`
+}
+
+// ScheduledReports configures generating reports about the library every
+// Interval, zero disables them. The last Keep are kept, in File when it's set.
+type ScheduledReports struct {
+	Interval time.Duration `mapstructure:"interval"`
+	File     string        `mapstructure:"file"`
+	Keep     int           `mapstructure:"keep"`
+}
+
+// Features switch whole subsystems on or off at startup, they're listed in
+// /v1/capabilities. All are on by default.
+type Features struct {
+	// Uploads also need Uploads.Dir to be set.
+	Uploads bool `mapstructure:"uploads"`
+	Deletes bool `mapstructure:"deletes"`
+	// Metrics are the endpoints on the monitoring port besides the health checks.
+	Metrics bool `mapstructure:"metrics"`
+	// UI are the endpoints for browsing UIs, /browse.
+	UI bool `mapstructure:"ui"`
+}
+
+// ChecksumPolicy configures which files are hashed when. Files up to
+// EagerMaxSize bytes are hashed in the background, bigger ones when they're
+// downloaded, zero hashes all in the background. Files with one of
+// SkipExtensions are never hashed.
+type ChecksumPolicy struct {
+	EagerMaxSize   int64    `mapstructure:"eager_max_size"`
+	SkipExtensions []string `mapstructure:"skip_extensions"`
+}
+
+// Uploads configures resumable uploads into the roots, they're enabled when Dir
+// is set. Sessions without a chunk for TTL are removed, zero MaxSize doesn't
+// limit the size of uploads. Chunks are limited by MaxChunkBytes instead of
+// MaxBodyBytes, zero doesn't limit them.
+type Uploads struct {
+	Dir           string        `mapstructure:"dir"`
+	TTL           time.Duration `mapstructure:"ttl"`
+	MaxSize       int64         `mapstructure:"max_size"`
+	MaxChunkBytes int64         `mapstructure:"max_chunk_bytes"`
+}
+
+// Quarantine configures leaving out files that fail threshold times in a row,
+// retrying them after backoff, doubling up to max_backoff.
+type Quarantine struct {
+	Enabled    bool          `mapstructure:"enabled"`
+	Threshold  int           `mapstructure:"threshold"`
+	Backoff    time.Duration `mapstructure:"backoff"`
+	MaxBackoff time.Duration `mapstructure:"max_backoff"`
+}
+
+// Metadata configures including ownership, permissions and extended attributes
+// of files in the manifest.
+type Metadata struct {
+	Enabled bool     `mapstructure:"enabled"`
+	Xattrs  []string `mapstructure:"xattrs"`
+}
+
+// Logging configures where logs go, log files are rotated when they get too big
+// or too old, and reopened on SIGHUP. Zero disables a limit.
+type Logging struct {
+	Stderr     bool          `mapstructure:"stderr"`
+	File       string        `mapstructure:"file"`
+	MaxSize    int64         `mapstructure:"max_size"`
+	MaxAge     time.Duration `mapstructure:"max_age"`
+	MaxBackups int           `mapstructure:"max_backups"`
+}
+
+// Standby configures mirroring the manifest of a primary serving the same
+// storage, instead of scanning and maintaining it ourselves.
+type Standby struct {
+	// Primary is the URL of the primary, empty when we're not a standby.
+	Primary  string        `mapstructure:"primary"`
+	Token    string        `mapstructure:"token"`
+	Interval time.Duration `mapstructure:"interval"`
+	Timeout  time.Duration `mapstructure:"timeout"`
+}
+
+// StalledTransfers configures when a transfer that doesn't make progress counts
+// as stalled, and when it is aborted. Zero disables either.
+type StalledTransfers struct {
+	After      time.Duration `mapstructure:"after"`
+	AbortAfter time.Duration `mapstructure:"abort_after"`
+}
+
+// FSTimeouts configures timeouts around filesystem operations, and how many of
+// them in a row make us stop trying a root for a while.
+type FSTimeouts struct {
+	Enabled   bool          `mapstructure:"enabled"`
+	Stat      time.Duration `mapstructure:"stat"`
+	Scan      time.Duration `mapstructure:"scan"`
+	Threshold int           `mapstructure:"threshold"`
+	Cooldown  time.Duration `mapstructure:"cooldown"`
+}
+
+// RateLimit configures how many requests a client may do per window.
+type RateLimit struct {
+	Enabled  bool          `mapstructure:"enabled"`
+	Requests int           `mapstructure:"requests"`
+	Window   time.Duration `mapstructure:"window"`
+}
+
+// Exclude configures which files are hidden from clients, hidden files can't be
+// downloaded or deleted either.
+type Exclude struct {
+	Dotfiles bool     `mapstructure:"dotfiles"`
+	Suffixes []string `mapstructure:"suffixes"`
+	Globs    []string `mapstructure:"globs"`
+	// MinAge hides files that were modified more recently.
+	MinAge time.Duration `mapstructure:"min_age"`
+	// OpenFiles hides files other processes have open for writing (Linux only).
+	OpenFiles bool `mapstructure:"open_files"`
+}
+
+// TextIndex configures content search of small text sidecars.
+type TextIndex struct {
+	Enabled    bool     `mapstructure:"enabled"`
+	Extensions []string `mapstructure:"extensions"`
+	MaxSize    int64    `mapstructure:"max_size"`
+}
+
+// Faults configures fault injection for testing clients, rates are between 0 and 1.
+type Faults struct {
+	Enabled      bool          `mapstructure:"enabled"`
+	Latency      time.Duration `mapstructure:"latency"`
+	LatencyRate  float64       `mapstructure:"latency_rate"`
+	ErrorRate    float64       `mapstructure:"error_rate"`
+	TruncateRate float64       `mapstructure:"truncate_rate"`
+	DropRate     float64       `mapstructure:"drop_rate"`
+}
+
+// Listener is an additional address to bind to, next to Host and Port.
+type Listener struct {
+	Host string `mapstructure:"host"`
+	Port int    `mapstructure:"port"`
+	// Network is one of tcp, tcp4 or tcp6, tcp6 makes the listener IPv6 only.
+	Network string `mapstructure:"network"`
 }
 
 type FilePath struct {
-	DiskPath  string `mapstructure:"disk_path"`
-	ServePath string `mapstructure:"serve_path"`
+	DiskPath  string   `mapstructure:"disk_path"`
+	ServePath string   `mapstructure:"serve_path"`
+	Sidecars  Sidecars `mapstructure:"sidecars"`
+	Expiry    Expiry   `mapstructure:"expiry"`
+	// Headers are added to every file served from this root.
+	Headers map[string]string `mapstructure:"headers"`
+	// Symlinks exposes symlinks pointing inside the root as links, instead of
+	// serving what they point to.
+	Symlinks bool `mapstructure:"symlinks"`
+	// CaseInsensitive matches download paths ignoring case, and flags files
+	// that would collide on a case-insensitive filesystem.
+	CaseInsensitive bool     `mapstructure:"case_insensitive"`
+	IOTuning        IOTuning `mapstructure:"io_tuning"`
+	// Priority is the sync priority of the files in this root, unless one of
+	// Priorities matches them first.
+	Priority   int        `mapstructure:"priority"`
+	Priorities []Priority `mapstructure:"priorities"`
+}
+
+// Priority gives the files matching Pattern, by path or name, or in a directory
+// matching it, a sync priority. Higher priorities are synced first.
+type Priority struct {
+	Pattern  string `mapstructure:"pattern"`
+	Priority int    `mapstructure:"priority"`
+}
+
+// IOTuning configures reading files for large sequential downloads, the hints
+// are only applied on Linux.
+type IOTuning struct {
+	// Sequential advises the kernel that files are read sequentially.
+	Sequential bool `mapstructure:"sequential"`
+	// ReadAhead is how many bytes to prefetch from where a download starts.
+	ReadAhead int64 `mapstructure:"readahead"`
+	// Direct reads with O_DIRECT, bypassing the page cache.
+	Direct bool `mapstructure:"direct"`
+}
+
+// Expiry configures removing files older than a number of days from a root.
+type Expiry struct {
+	Days     int    `mapstructure:"days"`
+	TrashDir string `mapstructure:"trash_dir"`
+}
+
+// Sidecars configures cleaning up sidecar files whose media file is gone.
+type Sidecars struct {
+	CleanOrphans    bool     `mapstructure:"clean_orphans"`
+	DryRun          bool     `mapstructure:"dry_run"`
+	Extensions      []string `mapstructure:"extensions"`
+	MediaExtensions []string `mapstructure:"media_extensions"`
 }
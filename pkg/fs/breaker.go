@@ -0,0 +1,149 @@
+/*
+Copyright 2020 Daniël Franke
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fs
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+var (
+	// ErrTimeout communicates that a filesystem operation didn't return in time,
+	// e.g. because a network mount hangs.
+	ErrTimeout = errors.New("filesystem operation timed out")
+
+	// ErrCircuitOpen communicates that a root timed out too often, and isn't
+	// tried again until its cooldown passed.
+	ErrCircuitOpen = errors.New("root circuit open")
+)
+
+// Breaker guards the filesystem operations of a root with timeouts, and stops
+// trying the root for a while after repeated timeouts, so a hung network
+// mount only degrades that root instead of wedging every request.
+type Breaker struct {
+	threshold int
+	cooldown  time.Duration
+	logger    *zap.Logger
+
+	mu        sync.Mutex
+	timeouts  int
+	openUntil time.Time
+}
+
+// NewBreaker creates a new Breaker opening after threshold consecutive timeouts.
+func NewBreaker(threshold int, cooldown time.Duration, logger *zap.Logger) *Breaker {
+	return &Breaker{
+		threshold: threshold,
+		cooldown:  cooldown,
+		logger:    logger,
+	}
+}
+
+// Do runs op, giving up after timeout or when ctx is cancelled. op gets a
+// context that is cancelled then too, operations that can't check it keep
+// running in the background until they return. A nil Breaker runs op without
+// a timeout.
+func (b *Breaker) Do(ctx context.Context, timeout time.Duration, op func(context.Context) error) error {
+	if b == nil {
+		return op(ctx)
+	}
+	b.mu.Lock()
+	if time.Now().Before(b.openUntil) {
+		b.mu.Unlock()
+		return ErrCircuitOpen
+	}
+	b.mu.Unlock()
+
+	opCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() { done <- op(opCtx) }()
+	select {
+	case err := <-done:
+		if errors.Is(err, context.DeadlineExceeded) && ctx.Err() == nil {
+			b.record(true)
+			return ErrTimeout
+		}
+		b.record(false)
+		return err
+	case <-opCtx.Done():
+		// Only our own deadline counts against the root.
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		b.record(true)
+		return ErrTimeout
+	}
+}
+
+func (b *Breaker) record(timedOut bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !timedOut {
+		b.timeouts = 0
+		return
+	}
+	b.timeouts++
+	if b.timeouts >= b.threshold {
+		b.logger.Warn("too many filesystem timeouts, opening circuit",
+			zap.Int("timeouts", b.timeouts), zap.Duration("cooldown", b.cooldown))
+		b.openUntil = time.Now().Add(b.cooldown)
+		b.timeouts = 0
+	}
+}
+
+// Timeouts configures the breakers guarding each root.
+type Timeouts struct {
+	// Stat limits checking whether a root is available.
+	Stat time.Duration
+	// Scan limits walking a root.
+	Scan time.Duration
+	// Threshold is the number of consecutive timeouts that opens a breaker.
+	Threshold int
+	// Cooldown is how long an open breaker doesn't try the root.
+	Cooldown time.Duration
+}
+
+// SetTimeouts guards the filesystem operations of every root with a breaker.
+func (r *Registry) SetTimeouts(t Timeouts) {
+	r.timeouts = &t
+	for p := range r.pathFSO {
+		r.breakers[p] = NewBreaker(t.Threshold, t.Cooldown, r.logger.With(zap.String("serve_path", p)))
+	}
+}
+
+// Breaker returns the breaker of the root at servePath, nil without timeouts.
+func (r *Registry) Breaker(servePath string) *Breaker {
+	return r.breakers[servePath]
+}
+
+// guard runs op through the breaker of the root at servePath.
+func (r *Registry) guard(ctx context.Context, servePath string, timeout func(Timeouts) time.Duration,
+	op func(context.Context) error) error {
+	b := r.breakers[servePath]
+	if b == nil {
+		return op(ctx)
+	}
+	return b.Do(ctx, timeout(*r.timeouts), op)
+}
+
+func statTimeout(t Timeouts) time.Duration { return t.Stat }
+func scanTimeout(t Timeouts) time.Duration { return t.Scan }
@@ -0,0 +1,89 @@
+/*
+Copyright 2020 Daniël Franke
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fs
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestBreakerDo(t *testing.T) {
+	errOp := errors.New("op failed")
+	ok := func(context.Context) error { return nil }
+	fails := func(context.Context) error { return errOp }
+	// hangs ignores its context, like a stat on a hung mount.
+	hangs := func(context.Context) error { time.Sleep(50 * time.Millisecond); return nil }
+	deadline := func(ctx context.Context) error { <-ctx.Done(); return ctx.Err() }
+
+	tests := []struct {
+		name string
+		ops  []func(context.Context) error
+		want []error
+	}{
+		{"succeeds", []func(context.Context) error{ok}, []error{nil}},
+		{"passes errors on", []func(context.Context) error{fails, ok}, []error{errOp, nil}},
+		{"times out", []func(context.Context) error{hangs, ok}, []error{ErrTimeout, nil}},
+		{"op sees the deadline", []func(context.Context) error{deadline}, []error{ErrTimeout}},
+		{"opens after threshold", []func(context.Context) error{hangs, deadline, ok},
+			[]error{ErrTimeout, ErrTimeout, ErrCircuitOpen}},
+		{"success resets the count", []func(context.Context) error{hangs, ok, hangs, ok},
+			[]error{ErrTimeout, nil, ErrTimeout, nil}},
+		{"errors reset the count", []func(context.Context) error{hangs, fails, hangs, ok},
+			[]error{ErrTimeout, errOp, ErrTimeout, nil}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := NewBreaker(2, time.Hour, zap.NewNop())
+			for i, op := range tt.ops {
+				if err := b.Do(context.Background(), 10*time.Millisecond, op); !errors.Is(err, tt.want[i]) {
+					t.Errorf("Do() #%d = %v, want %v", i, err, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestBreakerDoCancelled(t *testing.T) {
+	b := NewBreaker(1, time.Hour, zap.NewNop())
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	op := func(ctx context.Context) error { <-ctx.Done(); return ctx.Err() }
+	// Callers going away don't count against the root.
+	for i := 0; i < 2; i++ {
+		if err := b.Do(ctx, time.Hour, op); !errors.Is(err, context.Canceled) {
+			t.Errorf("Do() #%d = %v, want %v", i, err, context.Canceled)
+		}
+	}
+	if err := b.Do(context.Background(), time.Hour, func(context.Context) error { return nil }); err != nil {
+		t.Errorf("Do() after cancellations = %v, want nil", err)
+	}
+}
+
+func TestNilBreaker(t *testing.T) {
+	var b *Breaker
+	err := b.Do(context.Background(), time.Nanosecond, func(context.Context) error {
+		time.Sleep(time.Millisecond)
+		return nil
+	})
+	if err != nil {
+		t.Errorf("Do() = %v, want nil without a timeout", err)
+	}
+}
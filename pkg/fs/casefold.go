@@ -0,0 +1,79 @@
+/*
+Copyright 2020 Daniël Franke
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fs
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+)
+
+// SetCaseInsensitive declares the root at servePath case-insensitive, files
+// whose paths only differ in case are flagged in the manifest, as they collide
+// on such filesystems.
+func (r *Registry) SetCaseInsensitive(servePath string) {
+	if fso, ok := r.pathFSO[servePath]; ok {
+		fso.Lock()
+		fso.caseInsensitive = true
+		fso.Unlock()
+	}
+}
+
+// flagCaseCollisions sets CaseCollision on the files whose web paths are equal
+// ignoring case.
+func flagCaseCollisions(files []*WebObject) {
+	seen := make(map[string]*WebObject, len(files))
+	for _, f := range files {
+		key := strings.ToLower(f.WebPath)
+		if other, ok := seen[key]; ok {
+			other.CaseCollision = true
+			f.CaseCollision = true
+			continue
+		}
+		seen[key] = f
+	}
+}
+
+// ResolveFold finds the file at the slash separated p under root, matching
+// each element of the path case-insensitively when there's no exact match.
+func ResolveFold(root, p string) (string, error) {
+	resolved := root
+	for _, name := range strings.FieldsFunc(p, func(r rune) bool { return r == '/' }) {
+		next := path.Join(resolved, name)
+		if _, err := os.Lstat(next); err == nil {
+			resolved = next
+			continue
+		}
+		entries, err := ioutil.ReadDir(resolved)
+		if err != nil {
+			return "", err
+		}
+		found := false
+		for _, e := range entries {
+			if strings.EqualFold(e.Name(), name) {
+				resolved = path.Join(resolved, e.Name())
+				found = true
+				break
+			}
+		}
+		if !found {
+			return "", &os.PathError{Op: "resolve", Path: path.Join(root, p), Err: os.ErrNotExist}
+		}
+	}
+	return resolved, nil
+}
@@ -0,0 +1,510 @@
+/*
+Copyright 2020 Daniël Franke
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fs
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// ChecksumAlgo is the algorithm of file checksums, by the name clients use.
+// It's the only one kept, so clients wanting another don't get file checksums.
+const ChecksumAlgo = "sha256"
+
+// SidecarChecksumSuffix is appended to the name of a file for its checksum sidecar.
+const SidecarChecksumSuffix = ".sha256"
+
+var (
+	// ErrXattrUnsupported communicates that extended attributes can't be used here.
+	ErrXattrUnsupported = errors.New("extended attributes not supported")
+
+	// ErrChecksumMismatch communicates that a file doesn't match its checksum
+	// anymore, while its size and modification time didn't change.
+	ErrChecksumMismatch = errors.New("file doesn't match its checksum")
+
+	// ErrChecksumSkipped communicates that the checksum policy doesn't hash a
+	// file, and its checksum isn't known.
+	ErrChecksumSkipped = errors.New("checksum policy skips file")
+)
+
+// ChecksumProvider stores SHA-256 checksums of files outside of the server, so
+// they survive restarts and moves, and other tools can use them too.
+type ChecksumProvider interface {
+	// Load returns the stored checksum of fso, if it's still up to date.
+	Load(fso *FilesystemObject) (string, bool)
+	// Store stores the checksum of fso.
+	Store(fso *FilesystemObject, sum string) error
+}
+
+const (
+	// hashBufSize is how much is hashed between checking for cancellation.
+	hashBufSize = 1 << 20
+	// queueSize is how many files can wait for their checksum in the background.
+	queueSize = 4096
+)
+
+// Checksums computes SHA-256 checksums of files and caches them in memory, and
+// with its providers.
+type Checksums struct {
+	providers []ChecksumProvider
+	logger    *zap.Logger
+
+	mu sync.Mutex
+	// cache maps paths to the checksum of a version of the file.
+	cache map[string]cachedChecksum
+	// queue holds the files to hash in the background, pending their paths.
+	queue   chan *FilesystemObject
+	pending map[string]bool
+	// suspect are the paths of files to verify against their checksum.
+	suspect map[string]bool
+	// hashing are the hashes in progress by path, shared by everyone asking.
+	hashing map[string]*hashCall
+	// mismatches counts files read with another checksum than they have, atomic.
+	mismatches int64
+	// quarantine gets the files that can't be hashed.
+	quarantine *Quarantine
+	policy     ChecksumPolicy
+}
+
+// ChecksumPolicy decides which files are hashed when, to balance integrity
+// against IO on huge libraries.
+type ChecksumPolicy struct {
+	// EagerMaxSize is the size up to which files are hashed in the background,
+	// bigger files only when they're downloaded. Zero has no limit.
+	EagerMaxSize int64
+	// SkipExtensions are the extensions of files that are never hashed.
+	SkipExtensions []string
+}
+
+// skips reports whether the policy never hashes fso.
+func (p ChecksumPolicy) skips(fso *FilesystemObject) bool {
+	ext := path.Ext(fso.Path)
+	for _, e := range p.SkipExtensions {
+		if strings.EqualFold(ext, e) {
+			return true
+		}
+	}
+	return false
+}
+
+// eager reports whether the policy hashes fso in the background.
+func (p ChecksumPolicy) eager(fso *FilesystemObject) bool {
+	return !p.skips(fso) && (p.EagerMaxSize <= 0 || fso.Size <= p.EagerMaxSize)
+}
+
+type cachedChecksum struct {
+	// fso is the version of the file the checksum is of.
+	fso *FilesystemObject
+	sum string
+}
+
+// hashCall is a file being hashed, done is closed once sum or err is set.
+type hashCall struct {
+	done chan struct{}
+	sum  string
+	err  error
+}
+
+// NewChecksums creates a new Checksums using providers.
+func NewChecksums(logger *zap.Logger, providers ...ChecksumProvider) *Checksums {
+	return &Checksums{
+		providers: providers,
+		logger:    logger,
+		cache:     make(map[string]cachedChecksum),
+		queue:     make(chan *FilesystemObject, queueSize),
+		pending:   make(map[string]bool),
+		suspect:   make(map[string]bool),
+		hashing:   make(map[string]*hashCall),
+	}
+}
+
+// SetQuarantine records files failing to hash in the background in q.
+func (c *Checksums) SetQuarantine(q *Quarantine) {
+	c.quarantine = q
+}
+
+// SetPolicy decides which files are hashed when, by default all of them are
+// hashed in the background.
+func (c *Checksums) SetPolicy(p ChecksumPolicy) {
+	c.policy = p
+}
+
+// Eager reports whether the policy hashes fso in the background, instead of
+// when it's downloaded.
+func (c *Checksums) Eager(fso *FilesystemObject) bool {
+	return c.policy.eager(fso)
+}
+
+// Known returns the checksum of fso if it's cached or stored by a provider,
+// without hashing anything.
+func (c *Checksums) Known(fso *FilesystemObject) (string, bool) {
+	c.mu.Lock()
+	cached, ok := c.cache[fso.Path]
+	c.mu.Unlock()
+	if ok && cached.fso.IsEqual(fso.Path, fso.Size, fso.ModTime) {
+		return cached.sum, true
+	}
+	sum, ok := c.Load(fso)
+	if ok {
+		c.remember(fso, sum)
+	}
+	return sum, ok
+}
+
+func (c *Checksums) remember(fso *FilesystemObject, sum string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.cache[fso.Path] = cachedChecksum{fso: fso, sum: sum}
+}
+
+// Queue schedules hashing fso in the background, unless the policy leaves it
+// for later or skips it. It's dropped when the queue is full. See Run.
+func (c *Checksums) Queue(fso *FilesystemObject) {
+	if !c.policy.eager(fso) {
+		return
+	}
+	c.enqueue(fso)
+}
+
+// Request schedules hashing fso in the background because a client wants its
+// checksum, even if the policy would leave it for later. Skipped files aren't
+// hashed.
+func (c *Checksums) Request(fso *FilesystemObject) {
+	if c.policy.skips(fso) {
+		return
+	}
+	c.enqueue(fso)
+}
+
+func (c *Checksums) enqueue(fso *FilesystemObject) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.pending[fso.Path] || c.quarantine.Skip(fso.Path) {
+		return
+	}
+	select {
+	case c.queue <- fso:
+		c.pending[fso.Path] = true
+	default:
+	}
+}
+
+// Run hashes queued files one at a time, until ctx is done.
+func (c *Checksums) Run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case fso := <-c.queue:
+			var err error
+			if c.isSuspect(fso.Path) {
+				err = c.verify(ctx, fso)
+			} else {
+				_, err = c.Sum(ctx, fso)
+			}
+			switch {
+			case err == nil:
+				c.quarantine.Clear(fso.Path)
+			case errors.Is(err, ErrFileChanged):
+				// The next scan finds the new version and queues it.
+				c.logger.Debug("file changed while hashing", fso.pathField)
+			case ctx.Err() == nil:
+				c.logger.Info("couldn't compute checksum", fso.pathField, zap.Error(err))
+				c.quarantine.Record(fso.Path, err)
+			}
+			c.mu.Lock()
+			delete(c.pending, fso.Path)
+			c.mu.Unlock()
+		}
+	}
+}
+
+// Suspect records that fso was read with another checksum than it has, and
+// queues hashing it again to tell whether the file or the read was bad.
+func (c *Checksums) Suspect(fso *FilesystemObject) {
+	atomic.AddInt64(&c.mismatches, 1)
+	c.mu.Lock()
+	c.suspect[fso.Path] = true
+	c.mu.Unlock()
+	c.enqueue(fso)
+}
+
+// Mismatches returns how many times a file was read with another checksum than
+// it has.
+func (c *Checksums) Mismatches() int64 {
+	return atomic.LoadInt64(&c.mismatches)
+}
+
+// Prune forgets the cached checksums of files that aren't in paths, the disk
+// paths of the files of the latest scan. See Registry.DiskPaths.
+func (c *Checksums) Prune(paths map[string]bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	pruned := 0
+	for p := range c.cache {
+		if !paths[p] {
+			delete(c.cache, p)
+			pruned++
+		}
+	}
+	c.logger.Debug("pruned cached checksums", zap.Int("pruned", pruned), zap.Int("cached", len(c.cache)))
+}
+
+// Cached returns how many checksums are cached in memory.
+func (c *Checksums) Cached() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.cache)
+}
+
+func (c *Checksums) isSuspect(p string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.suspect[p]
+}
+
+// verify hashes a suspect file and compares it to its known checksum, a file
+// that doesn't match fails with ErrChecksumMismatch.
+func (c *Checksums) verify(ctx context.Context, fso *FilesystemObject) error {
+	defer func() {
+		c.mu.Lock()
+		delete(c.suspect, fso.Path)
+		c.mu.Unlock()
+	}()
+	want, ok := c.Known(fso)
+	if !ok {
+		return nil
+	}
+	sum, err := fso.sha256(ctx)
+	if err != nil {
+		return err
+	}
+	if sum != want {
+		c.logger.Error("file is corrupt", fso.pathField, zap.String("checksum", want), zap.String("actual", sum))
+		return ErrChecksumMismatch
+	}
+	c.logger.Info("file matches its checksum again", fso.pathField)
+	return nil
+}
+
+// Sum returns the hex encoded SHA-256 checksum of fso. It's computed when
+// neither the cache nor the providers have it, which reads the whole file and
+// stops early when ctx is cancelled. Concurrent calls for the same path share
+// one computation. Files the policy skips fail with ErrChecksumSkipped instead.
+func (c *Checksums) Sum(ctx context.Context, fso *FilesystemObject) (string, error) {
+	if sum, ok := c.Known(fso); ok {
+		return sum, nil
+	}
+	if c.policy.skips(fso) {
+		return "", ErrChecksumSkipped
+	}
+
+	var call *hashCall
+	for call == nil {
+		c.mu.Lock()
+		running, ok := c.hashing[fso.Path]
+		if !ok {
+			call = &hashCall{done: make(chan struct{})}
+			c.hashing[fso.Path] = call
+		}
+		c.mu.Unlock()
+		if !ok {
+			break
+		}
+		select {
+		case <-running.done:
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+		// Hashing stopped because whoever started it went away, not us.
+		if errors.Is(running.err, context.Canceled) || errors.Is(running.err, context.DeadlineExceeded) {
+			continue
+		}
+		return running.sum, running.err
+	}
+
+	call.sum, call.err = fso.sha256(ctx)
+	if call.err == nil {
+		c.Store(fso, call.sum)
+		c.remember(fso, call.sum)
+	}
+	c.mu.Lock()
+	delete(c.hashing, fso.Path)
+	c.mu.Unlock()
+	close(call.done)
+	return call.sum, call.err
+}
+
+// sha256 hashes the whole file. It fails with ErrFileChanged when the file
+// isn't what the scan saw before or after hashing, as the checksum would be
+// taken for the version the scan saw.
+func (fso *FilesystemObject) sha256(ctx context.Context) (string, error) {
+	if _, err := fso.unchanged(); err != nil {
+		return "", err
+	}
+	f, err := fso.Open(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	fso.logger.Debug("computing checksum", fso.pathField)
+	h := sha256.New()
+	for {
+		if err := ctx.Err(); err != nil {
+			return "", err
+		}
+		_, err := io.CopyN(h, f, hashBufSize)
+		if err == io.EOF {
+			if _, err := fso.unchanged(); err != nil {
+				return "", err
+			}
+			return hex.EncodeToString(h.Sum(nil)), nil
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+}
+
+// Load returns the checksum of fso from the first provider that has it. A nil
+// Checksums has none.
+func (c *Checksums) Load(fso *FilesystemObject) (string, bool) {
+	if c == nil {
+		return "", false
+	}
+	for _, p := range c.providers {
+		if sum, ok := p.Load(fso); ok {
+			return sum, true
+		}
+	}
+	return "", false
+}
+
+// Store stores the checksum of fso with every provider, failures are logged.
+func (c *Checksums) Store(fso *FilesystemObject, sum string) {
+	if c == nil {
+		return
+	}
+	for _, p := range c.providers {
+		if err := p.Store(fso, sum); err != nil {
+			c.logger.Warn("couldn't store checksum", fso.pathField, zap.Error(err))
+		}
+	}
+}
+
+// XattrChecksums stores checksums in the user.mediasync.sha256 extended
+// attribute, with the modification time they are for in user.mediasync.ts.
+// It also reads the attributes cshatag writes.
+func XattrChecksums() ChecksumProvider {
+	return xattrChecksums{}
+}
+
+type xattrChecksums struct{}
+
+// xattrNames are the pairs of checksum and timestamp attributes we read, we
+// only write the first.
+var xattrNames = [][2]string{
+	{"user.mediasync.sha256", "user.mediasync.ts"},
+	{"user.shatag.sha256", "user.shatag.ts"},
+}
+
+func (xattrChecksums) Load(fso *FilesystemObject) (string, bool) {
+	for _, names := range xattrNames {
+		sum, err := getxattr(fso.Path, names[0])
+		if err != nil {
+			continue
+		}
+		ts, err := getxattr(fso.Path, names[1])
+		if err != nil || ts != xattrTimestamp(fso.ModTime) {
+			continue
+		}
+		if validSHA256(sum) {
+			return sum, true
+		}
+	}
+	return "", false
+}
+
+func (xattrChecksums) Store(fso *FilesystemObject, sum string) error {
+	if err := setxattr(fso.Path, xattrNames[0][0], sum); err != nil {
+		return err
+	}
+	return setxattr(fso.Path, xattrNames[0][1], xattrTimestamp(fso.ModTime))
+}
+
+// xattrTimestamp formats t like cshatag does, seconds and nanoseconds.
+func xattrTimestamp(t time.Time) string {
+	return strconv.FormatInt(t.Unix(), 10) + "." + fmt.Sprintf("%09d", t.Nanosecond())
+}
+
+// SidecarChecksums stores checksums next to files in the format of sha256sum,
+// e.g. movie.mkv.sha256. A sidecar older than its file is out of date.
+func SidecarChecksums() ChecksumProvider {
+	return sidecarChecksums{}
+}
+
+type sidecarChecksums struct{}
+
+func (sidecarChecksums) Load(fso *FilesystemObject) (string, bool) {
+	p := fso.Path + SidecarChecksumSuffix
+	info, err := os.Stat(p)
+	if err != nil || info.ModTime().Before(fso.ModTime) {
+		return "", false
+	}
+	b, err := ioutil.ReadFile(p)
+	if err != nil {
+		return "", false
+	}
+	fields := strings.Fields(string(b))
+	if len(fields) == 0 || !validSHA256(fields[0]) {
+		return "", false
+	}
+	return fields[0], true
+}
+
+func (sidecarChecksums) Store(fso *FilesystemObject, sum string) error {
+	line := sum + "  " + path.Base(fso.Path) + "\n"
+	return ioutil.WriteFile(fso.Path+SidecarChecksumSuffix, []byte(line), 0o640)
+}
+
+// validSHA256 reports whether sum looks like a hex encoded SHA-256 checksum.
+func validSHA256(sum string) bool {
+	if len(sum) != 64 {
+		return false
+	}
+	for _, c := range sum {
+		if !strings.ContainsRune("0123456789abcdef", c) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,147 @@
+/*
+Copyright 2020 Daniël Franke
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fs
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+func TestSumShared(t *testing.T) {
+	dir, err := ioutil.TempDir("", "checksums")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	content := make([]byte, 4*hashBufSize)
+	p := filepath.Join(dir, "file.mkv")
+	if err := ioutil.WriteFile(p, content, 0o640); err != nil {
+		t.Fatal(err)
+	}
+	fso, err := ObjFromPath(p, false, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := sha256.Sum256(content)
+	want := hex.EncodeToString(h[:])
+
+	c := NewChecksums(zap.NewNop())
+	// A caller giving up mustn't fail the others waiting for the same hash.
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := c.Sum(cancelled, fso); !errors.Is(err, context.Canceled) {
+		t.Errorf("Sum() with a cancelled context = %v, want %v", err, context.Canceled)
+	}
+
+	var wg sync.WaitGroup
+	sums := make([]string, 8)
+	errs := make([]error, len(sums))
+	for i := range sums {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			sums[i], errs[i] = c.Sum(context.Background(), fso)
+		}(i)
+	}
+	wg.Wait()
+	for i := range sums {
+		if errs[i] != nil || sums[i] != want {
+			t.Errorf("Sum() = %q, %v, want %q", sums[i], errs[i], want)
+		}
+	}
+	if len(c.hashing) != 0 {
+		t.Errorf("%d hashes still registered as running", len(c.hashing))
+	}
+}
+
+func TestChecksumScheduling(t *testing.T) {
+	policy := ChecksumPolicy{EagerMaxSize: 100, SkipExtensions: []string{".iso"}}
+	tests := []struct {
+		name      string
+		fso       *FilesystemObject
+		queued    bool
+		requested bool
+	}{
+		{"small", &FilesystemObject{Path: "/m/a.mkv", Size: 10}, true, true},
+		{"large", &FilesystemObject{Path: "/m/b.mkv", Size: 1000}, false, true},
+		{"skipped", &FilesystemObject{Path: "/m/c.iso", Size: 10}, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewChecksums(zap.NewNop())
+			c.SetPolicy(policy)
+			c.Queue(tt.fso)
+			if got := c.pending[tt.fso.Path]; got != tt.queued {
+				t.Errorf("Queue() pending = %v, want %v", got, tt.queued)
+			}
+			c = NewChecksums(zap.NewNop())
+			c.SetPolicy(policy)
+			c.Request(tt.fso)
+			if got := c.pending[tt.fso.Path]; got != tt.requested {
+				t.Errorf("Request() pending = %v, want %v", got, tt.requested)
+			}
+		})
+	}
+}
+
+func TestSumChangedFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "checksums")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	p := filepath.Join(dir, "file.mkv")
+	if err := ioutil.WriteFile(p, []byte("old"), 0o640); err != nil {
+		t.Fatal(err)
+	}
+	fso, err := ObjFromPath(p, false, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Written after the scan, the checksum wouldn't be of the version we know.
+	if err := ioutil.WriteFile(p, []byte("newer"), 0o640); err != nil {
+		t.Fatal(err)
+	}
+
+	c := NewChecksums(zap.NewNop())
+	if _, err := c.Sum(context.Background(), fso); !errors.Is(err, ErrFileChanged) {
+		t.Errorf("Sum() = %v, want %v", err, ErrFileChanged)
+	}
+	if c.Cached() != 0 {
+		t.Errorf("Cached() = %d, want 0", c.Cached())
+	}
+}
+
+func TestChecksumPrune(t *testing.T) {
+	c := NewChecksums(zap.NewNop())
+	for _, p := range []string{"/m/a.mkv", "/m/b.mkv"} {
+		c.remember(&FilesystemObject{Path: p}, "sum")
+	}
+	c.Prune(map[string]bool{"/m/a.mkv": true})
+	if _, ok := c.cache["/m/b.mkv"]; ok || c.Cached() != 1 {
+		t.Errorf("cache after Prune() = %v, want only /m/a.mkv", c.cache)
+	}
+}
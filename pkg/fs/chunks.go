@@ -0,0 +1,55 @@
+/*
+Copyright 2020 Daniël Franke
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fs
+
+import (
+	"context"
+	"encoding/hex"
+	"hash"
+	"io"
+
+	"go.uber.org/zap"
+)
+
+// ChunkHashes hashes the file in chunks of chunkSize bytes, the last chunk may
+// be shorter. It stops early when ctx is cancelled.
+func (fso *FilesystemObject) ChunkHashes(ctx context.Context, chunkSize int64, h hash.Hash) ([]string, error) {
+	f, err := fso.Open(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	fso.logger.Debug("hashing chunks", fso.pathField, zap.Int64("chunk_size", chunkSize))
+	hashes := make([]string, 0, fso.Size/chunkSize+1)
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		h.Reset()
+		n, err := io.CopyN(h, f, chunkSize)
+		if n > 0 {
+			hashes = append(hashes, hex.EncodeToString(h.Sum(nil)))
+		}
+		if err == io.EOF {
+			return hashes, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
@@ -0,0 +1,90 @@
+/*
+Copyright 2020 Daniël Franke
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fs
+
+import (
+	"context"
+	"errors"
+	"os"
+
+	"go.uber.org/zap"
+)
+
+var (
+	// ErrFileChanged communicates that a file isn't what the last scan saw anymore.
+	ErrFileChanged = errors.New("file changed since it was scanned")
+
+	// ErrAttributesDiffer communicates that files differ in owner or mode, so
+	// one can't replace the other.
+	ErrAttributesDiffer = errors.New("files differ in owner or mode")
+)
+
+// LinkDuplicate replaces dup with a hardlink to src, after checking that both
+// are still what the scan saw, that their contents match sum, and that dup has
+// the same owner and mode as src, which it would get. Callers should hold the
+// clean lock.
+func LinkDuplicate(ctx context.Context, src, dup *FilesystemObject, sum string) error {
+	srcInfo, err := src.unchanged()
+	if err != nil {
+		return err
+	}
+	dupInfo, err := dup.unchanged()
+	if err != nil {
+		return err
+	}
+	if os.SameFile(srcInfo, dupInfo) {
+		return nil
+	}
+	srcUID, srcGID := fileOwner(srcInfo)
+	dupUID, dupGID := fileOwner(dupInfo)
+	if srcUID != dupUID || srcGID != dupGID || srcInfo.Mode() != dupInfo.Mode() {
+		return ErrAttributesDiffer
+	}
+	for _, f := range []*FilesystemObject{src, dup} {
+		actual, err := f.sha256(ctx)
+		if err != nil {
+			return err
+		}
+		if actual != sum {
+			return ErrFileChanged
+		}
+	}
+
+	tmp := dup.Path + ".mediasync-link"
+	if err := os.Link(src.Path, tmp); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, dup.Path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	dup.logger.Info("replaced duplicate with hardlink", dup.pathField, zap.String("target", src.Path))
+	return nil
+}
+
+// unchanged stats the file again, and fails with ErrFileChanged unless it's the
+// regular file of the size and modification time the scan saw.
+func (fso *FilesystemObject) unchanged() (os.FileInfo, error) {
+	info, err := os.Lstat(fso.Path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.Mode().IsRegular() || info.Size() != fso.Size || !info.ModTime().Equal(fso.ModTime) {
+		return nil, ErrFileChanged
+	}
+	return info, nil
+}
@@ -0,0 +1,102 @@
+/*
+Copyright 2020 Daniël Franke
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fs
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestLinkDuplicate(t *testing.T) {
+	content := []byte("same content")
+	h := sha256.Sum256(content)
+	sum := hex.EncodeToString(h[:])
+
+	tests := []struct {
+		name string
+		// prepare changes the duplicate, before it's scanned with scanned set,
+		// after it otherwise.
+		prepare func(dup string) error
+		scanned bool
+		want    error
+		linked  bool
+	}{
+		{"identical", func(string) error { return nil }, false, nil, true},
+		{"mode differs", func(dup string) error { return os.Chmod(dup, 0o600) }, true, ErrAttributesDiffer, false},
+		{"rewritten", func(dup string) error {
+			if err := ioutil.WriteFile(dup, []byte("other content"), 0o640); err != nil {
+				return err
+			}
+			return os.Chtimes(dup, time.Now(), time.Now().Add(time.Hour))
+		}, false, ErrFileChanged, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "dedup")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			srcPath, dupPath := filepath.Join(dir, "a"), filepath.Join(dir, "b")
+			for _, p := range []string{srcPath, dupPath} {
+				if err := ioutil.WriteFile(p, content, 0o640); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.Chmod(p, 0o640); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tt.scanned {
+				if err := tt.prepare(dupPath); err != nil {
+					t.Fatal(err)
+				}
+			}
+			src, err := ObjFromPath(srcPath, false, zap.NewNop())
+			if err != nil {
+				t.Fatal(err)
+			}
+			dup, err := ObjFromPath(dupPath, false, zap.NewNop())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !tt.scanned {
+				if err := tt.prepare(dupPath); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			err = LinkDuplicate(context.Background(), src, dup, sum)
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("LinkDuplicate() = %v, want %v", err, tt.want)
+			}
+			srcInfo, _ := os.Stat(srcPath)
+			dupInfo, _ := os.Stat(dupPath)
+			if linked := os.SameFile(srcInfo, dupInfo); linked != tt.linked {
+				t.Errorf("linked = %t, want %t", linked, tt.linked)
+			}
+		})
+	}
+}
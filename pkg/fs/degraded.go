@@ -0,0 +1,87 @@
+/*
+Copyright 2020 Daniël Franke
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fs
+
+import (
+	"context"
+	"errors"
+	"os"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// ErrRootUnavailable communicates that the disk path of a root is gone, e.g.
+// because the NAS it lives on was unmounted.
+var ErrRootUnavailable = errors.New("root unavailable")
+
+// RootAvailable reports whether diskPath is a reachable directory.
+func RootAvailable(diskPath string) bool {
+	info, err := os.Stat(diskPath)
+	return err == nil && info.IsDir()
+}
+
+// available checks whether the root at servePath can be read, and marks it
+// degraded or recovered when that changed.
+func (r *Registry) available(ctx context.Context, servePath string, fso *FilesystemObject) bool {
+	err := r.guard(ctx, servePath, statTimeout, func(context.Context) error {
+		if !RootAvailable(fso.Path) {
+			return ErrRootUnavailable
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, ErrRootUnavailable) {
+		r.logger.Warn("couldn't check root", zap.String("serve_path", servePath), zap.Error(err))
+	}
+	ok := err == nil
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, degraded := r.degraded[servePath]
+	switch {
+	case !ok && !degraded:
+		r.logger.Warn("root unavailable, serving last known files",
+			zap.String("serve_path", servePath), zap.String(PathKey, fso.Path))
+		r.degraded[servePath] = time.Now()
+	case ok && degraded:
+		r.logger.Info("root recovered", zap.String("serve_path", servePath), zap.String(PathKey, fso.Path))
+		delete(r.degraded, servePath)
+	}
+	return ok
+}
+
+// markDegraded marks the root at servePath degraded, until it is found
+// available again.
+func (r *Registry) markDegraded(servePath string, fso *FilesystemObject) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.degraded[servePath]; !ok {
+		r.logger.Warn("root degraded", zap.String("serve_path", servePath), zap.String(PathKey, fso.Path))
+		r.degraded[servePath] = time.Now()
+	}
+}
+
+// Degraded returns the serve paths of unavailable roots, and since when they are.
+func (r *Registry) Degraded() map[string]time.Time {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	d := make(map[string]time.Time, len(r.degraded))
+	for p, t := range r.degraded {
+		d[p] = t
+	}
+	return d
+}
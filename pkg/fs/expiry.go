@@ -0,0 +1,142 @@
+/*
+Copyright 2020 Daniël Franke
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fs
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// ExpiryPolicy removes files that haven't been modified for MaxAge.
+type ExpiryPolicy struct {
+	MaxAge time.Duration
+	// TrashDir receives expired files instead of deleting them, if set.
+	TrashDir string
+}
+
+// SetExpiryPolicy sets the expiry policy of the root at servePath, nil disables it.
+func (r *Registry) SetExpiryPolicy(servePath string, ep *ExpiryPolicy) {
+	if fso, ok := r.pathFSO[servePath]; ok {
+		fso.Lock()
+		fso.expiry = ep
+		fso.Unlock()
+	}
+}
+
+// Expire applies the expiry policies of all roots and returns the web paths of
+// the files that were expired.
+func (r *Registry) Expire(ctx context.Context) ([]string, error) {
+	expired := []string{}
+	scanned := false
+	defer func() {
+		if scanned {
+			r.changed()
+		}
+	}()
+	for p, fso := range r.pathFSO {
+		if fso.expiry == nil || !r.available(ctx, p, fso) {
+			continue
+		}
+		err := r.guard(ctx, p, scanTimeout, fso.Scan)
+		if errors.Is(err, ErrTimeout) || errors.Is(err, ErrCircuitOpen) {
+			r.logger.Warn("skipping expiry of root", zap.String("serve_path", p), zap.Error(err))
+			continue
+		}
+		if err != nil {
+			return expired, err
+		}
+		scanned = true
+		before := len(expired)
+		cutoff := time.Now().Add(-fso.expiry.MaxAge)
+		for _, f := range fso.GetAllFiles() {
+			if err := ctx.Err(); err != nil {
+				return expired, err
+			}
+			if !f.ModTime.Before(cutoff) {
+				continue
+			}
+			err := r.cleanLock.Do(func() error { return fso.expire(f) })
+			if err != nil {
+				r.logger.Error("couldn't expire file", zap.String(PathKey, f.Path), zap.Error(err))
+				continue
+			}
+			wo := newWebObject(p, fso.Path, f)
+			// This is the audit trail of what was removed, keep it at info.
+			r.logger.Info("expired file",
+				zap.String(PathKey, f.Path),
+				zap.String("web_path", wo.WebPath),
+				zap.Time("mod_time", f.ModTime),
+				zap.String("trash_dir", fso.expiry.TrashDir),
+			)
+			expired = append(expired, wo.WebPath)
+		}
+		// The index mustn't list what's gone.
+		if len(expired) > before {
+			if err := r.guard(ctx, p, scanTimeout, fso.Scan); err != nil {
+				r.logger.Warn("couldn't rescan root after expiry", zap.String("serve_path", p), zap.Error(err))
+			}
+		}
+	}
+	return expired, nil
+}
+
+// RunMaintenance expires files and cleans up orphaned sidecars every interval,
+// until ctx is cancelled.
+func (r *Registry) RunMaintenance(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		if r.maintains() {
+			expired, err := r.Expire(ctx)
+			if err != nil {
+				r.logger.Error("expiry run failed", zap.Error(err))
+			}
+			r.logger.Info("expiry run done", zap.Int("expired", len(expired)))
+			if err := r.CleanSidecars(ctx); err != nil {
+				r.logger.Error("sidecar cleanup failed", zap.Error(err))
+			}
+		} else {
+			r.logger.Debug("not maintaining, skipping expiry")
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// expire removes f from the root, or moves it to the trash directory.
+func (fso *FilesystemObject) expire(f *FilesystemObject) error {
+	if fso.expiry.TrashDir == "" {
+		return f.Delete()
+	}
+	rel := strings.TrimPrefix(f.Path, fso.Path)
+	dest := filepath.Join(fso.expiry.TrashDir, rel)
+	err := os.MkdirAll(filepath.Dir(dest), 0o750)
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Path, dest)
+}
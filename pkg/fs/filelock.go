@@ -0,0 +1,71 @@
+/*
+Copyright 2020 Daniël Franke
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fs
+
+import (
+	"errors"
+	"os"
+	"sync"
+
+	"go.uber.org/zap"
+)
+
+// ErrLocksUnsupported communicates that lock files don't work on this
+// platform, see LocksSupported.
+var ErrLocksUnsupported = errors.New("file locks aren't supported on this platform")
+
+// FileLock serializes destructive operations between instances serving the
+// same storage, using a lock file on that storage.
+type FileLock struct {
+	path   string
+	logger *zap.Logger
+	// mu serializes within the process, as flock doesn't between descriptors
+	// on every platform.
+	mu sync.Mutex
+}
+
+// NewFileLock creates a new FileLock on the file at path.
+func NewFileLock(path string, logger *zap.Logger) *FileLock {
+	return &FileLock{
+		path:   path,
+		logger: logger.With(zap.String(PathKey, path)),
+	}
+}
+
+// Do runs op while holding the lock, waiting for other instances to release
+// it. A nil FileLock runs op right away.
+func (l *FileLock) Do(op func() error) error {
+	if l == nil {
+		return op()
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	f, err := os.OpenFile(l.path, os.O_CREATE|os.O_RDWR, 0o640)
+	if err != nil {
+		l.logger.Error("couldn't open lock file", zap.Error(err))
+		return err
+	}
+	// Closing the file releases the lock.
+	defer f.Close()
+	l.logger.Debug("waiting for lock")
+	if err := lockFile(f); err != nil {
+		l.logger.Error("couldn't lock", zap.Error(err))
+		return err
+	}
+	return op()
+}
@@ -18,6 +18,7 @@ limitations under the License.
 package fs
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
@@ -25,7 +26,6 @@ import (
 	"net/http"
 	"os"
 	"path"
-	"strings"
 	"sync"
 	"time"
 
@@ -48,6 +48,9 @@ var (
 
 	// ErrIsNotFile communicates that the operation only works on normal files.
 	ErrIsNotFile = errors.New("file is not a normal file")
+
+	// ErrNotFound communicates that a path isn't served.
+	ErrNotFound = errors.New("not found")
 )
 
 // FilesystemObject is a representation of a filesystem object.
@@ -57,13 +60,45 @@ type FilesystemObject struct {
 	Size        int64     `json:"size"`
 	ModTime     time.Time `json:"mod_time"`
 	IsDir       bool      `json:"is_dir"`
+	// ETag identifies this version of a file, it changes when the file does.
+	ETag string `json:"etag,omitempty"`
+	// ID identifies a file across renames and moves within its filesystem,
+	// it's empty where that isn't known.
+	ID string `json:"id,omitempty"`
+	// Sparse is set when less of the file is on disk than its size, e.g. for a
+	// placeholder pre-allocated by a torrent client. AllocatedSize is how much.
+	Sparse        bool  `json:"sparse,omitempty"`
+	AllocatedSize int64 `json:"allocated_size,omitempty"`
+	// LinkTarget is where a symlink points, relative to its directory. It's
+	// only set for roots exposing symlinks.
+	LinkTarget string `json:"link_target,omitempty"`
 
 	Mode     os.FileMode         `json:"-"`
 	Root     bool                `json:"-"`
 	Children []*FilesystemObject `json:"-"`
+	// ScannedAt is when Children were last populated.
+	ScannedAt time.Time `json:"-"`
+	// Orphans are the orphaned sidecars found by the last sidecar cleanup of a
+	// root.
+	Orphans []string `json:"-"`
+
+	sidecars *SidecarPolicy
+	expiry   *ExpiryPolicy
+	rules    *Rules
+	uid, gid uint32
+	// linkRoot is the root path when symlinks are exposed.
+	linkRoot string
+	// caseInsensitive is only set on roots.
+	caseInsensitive bool
+	quarantine      *Quarantine
+	priorities      *PriorityPolicy
 
 	logger *zap.Logger
+	// The Mutex guards Children, ScannedAt and the policies. Walks replacing
+	// Children hold scanning throughout, and only take the Mutex to swap them,
+	// so readers see either the old or the new children.
 	sync.Mutex
+	scanning sync.Mutex
 	// Ugly hack so we don't have to retype the field all the time.
 	pathField zap.Field
 }
@@ -82,6 +117,8 @@ func NewFSObj(path string, info os.FileInfo, root bool, logger *zap.Logger) (*Fi
 		logger:    logger,
 		pathField: pathField,
 	}
+	fso.uid, fso.gid = fileOwner(info)
+	fso.ID = fileID(info)
 
 	if !fso.IsDir && fso.Mode.IsRegular() {
 		err := fso.DetectContentType()
@@ -89,6 +126,11 @@ func NewFSObj(path string, info os.FileInfo, root bool, logger *zap.Logger) (*Fi
 			logger.Error("couldn't detect content-type", pathField, zap.Error(err))
 			return &FilesystemObject{}, fmt.Errorf("couldn't detect content-type for %s: %w", fso.Path, err)
 		}
+		fso.ETag = fmt.Sprintf(`"%x-%x"`, fso.Size, fso.ModTime.UnixNano())
+		if a, ok := allocatedSize(info); ok && a < fso.Size {
+			fso.Sparse = true
+			fso.AllocatedSize = a
+		}
 	}
 
 	return &fso, nil
@@ -140,13 +182,14 @@ func (fso *FilesystemObject) DetectContentType() error {
 	return nil
 }
 
-// Scan recursively scans the directory and populates its children.
-func (fso *FilesystemObject) Scan() error {
+// Scan recursively scans the directory and populates its children, it stops
+// early when ctx is cancelled.
+func (fso *FilesystemObject) Scan(ctx context.Context) error {
 	if !fso.IsDir {
 		return ErrIsNotDir
 	}
-	fso.Lock()
-	defer fso.Unlock()
+	fso.scanning.Lock()
+	defer fso.scanning.Unlock()
 
 	if fso.Root {
 		fso.logger.Info("scanning directory", fso.pathField)
@@ -154,17 +197,26 @@ func (fso *FilesystemObject) Scan() error {
 		fso.logger.Debug("scanning directory", fso.pathField)
 	}
 
-	// Clean up Children.
-	fso.Children = []*FilesystemObject{}
-
 	files, err := ioutil.ReadDir(fso.Path)
 	if err != nil {
 		fso.logger.Error("couldn't read directory", fso.pathField, zap.Error(err))
 		return err
 	}
 
+	// The last known children survive a failed scan.
+	fso.Lock()
+	rules, quarantine, linkRoot := fso.rules, fso.quarantine, fso.linkRoot
+	fso.Unlock()
+	children := []*FilesystemObject{}
 	for _, file := range files {
+		if err := ctx.Err(); err != nil {
+			fso.logger.Info("scan cancelled", fso.pathField, zap.Error(err))
+			return err
+		}
 		path := path.Join(fso.Path, file.Name())
+		if quarantine.Skip(path) {
+			continue
+		}
 		f, err := ObjFromPath(path, false, fso.logger)
 		if err != nil {
 			// We're skipping over files we can't read.
@@ -174,22 +226,55 @@ func (fso *FilesystemObject) Scan() error {
 				continue
 			}
 			fso.logger.Error("couldn't create new FSO", zap.String(PathKey, path), zap.Error(err))
+			if quarantine != nil {
+				quarantine.Record(path, err)
+				continue
+			}
 			return err
 		}
-		fso.Children = append(fso.Children, f)
-		if f.IsDir {
-			err = f.Scan()
+		quarantine.Clear(path)
+		f.rules = rules
+		f.quarantine = quarantine
+		f.linkRoot = linkRoot
+		if linkRoot != "" && file.Mode()&os.ModeSymlink != 0 {
+			f.LinkTarget = fso.linkTarget(path)
+		}
+		children = append(children, f)
+		// Excluded directories are kept, so Clean knows they aren't empty,
+		// but we don't descend into them, or into exposed links.
+		if f.IsDir && f.LinkTarget == "" && !rules.Excludes(f) {
+			err = f.Scan(ctx)
 			if err != nil {
 				fso.logger.Error("couldn't scan child", zap.String(PathKey, f.Path), zap.Error(err))
 				return err
 			}
 		}
 	}
+	fso.Lock()
+	fso.Children = children
+	fso.ScannedAt = time.Now()
+	fso.Unlock()
 	return nil
 }
 
-// Clean cleans out all empty directories under the FSO.
-func (fso *FilesystemObject) Clean() error {
+// children returns the children of the last scan, it's safe to use while fso
+// is rescanned.
+func (fso *FilesystemObject) children() []*FilesystemObject {
+	fso.Lock()
+	defer fso.Unlock()
+	return fso.Children
+}
+
+// scannedAt returns when the children of fso were last scanned.
+func (fso *FilesystemObject) scannedAt() time.Time {
+	fso.Lock()
+	defer fso.Unlock()
+	return fso.ScannedAt
+}
+
+// Clean cleans out all empty directories under the FSO, it stops early when
+// ctx is cancelled.
+func (fso *FilesystemObject) Clean(ctx context.Context) error {
 	if !fso.IsDir {
 		return ErrIsNotDir
 	}
@@ -201,24 +286,27 @@ func (fso *FilesystemObject) Clean() error {
 
 	// Populate the entire tree, but only for the root object
 	if fso.Root {
-		err := fso.Scan()
+		err := fso.Scan(ctx)
 		if err != nil {
 			fso.logger.Error("couldn't scan for cleanup", fso.pathField, zap.Error(err))
 			return err
 		}
 	}
 
-	fso.Lock()
-	defer fso.Unlock()
+	fso.scanning.Lock()
+	defer fso.scanning.Unlock()
 
 	newChildren := []*FilesystemObject{}
-	for _, f := range fso.Children {
-		// We're not touching normal files.
-		if !f.IsDir {
+	for _, f := range fso.children() {
+		// We're not touching normal files, links or anything excluded.
+		if !f.IsDir || f.LinkTarget != "" || fso.rules.Excludes(f) {
 			newChildren = append(newChildren, f)
 			continue
 		}
-		err := f.Clean()
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		err := f.Clean(ctx)
 		if err != nil {
 			if errors.Is(err, ErrDirNotEmpty) {
 				newChildren = append(newChildren, f)
@@ -228,7 +316,9 @@ func (fso *FilesystemObject) Clean() error {
 			return err
 		}
 	}
+	fso.Lock()
 	fso.Children = newChildren
+	fso.Unlock()
 
 	// Don't delete the root.
 	if fso.Root {
@@ -236,7 +326,7 @@ func (fso *FilesystemObject) Clean() error {
 	}
 
 	// If not empty, we're not going to delete.
-	if len(fso.Children) > 0 {
+	if len(newChildren) > 0 {
 		return ErrDirNotEmpty
 	}
 
@@ -245,10 +335,14 @@ func (fso *FilesystemObject) Clean() error {
 	return fso.Delete()
 }
 
-func (fso *FilesystemObject) Open() (*os.File, error) {
+// Open opens the file for reading, unless ctx is already done.
+func (fso *FilesystemObject) Open(ctx context.Context) (*os.File, error) {
 	if fso.IsDir || !fso.Mode.IsRegular() {
 		return nil, ErrIsNotFile
 	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	return os.Open(fso.Path)
 }
 
@@ -265,12 +359,14 @@ func (fso *FilesystemObject) Delete() error {
 // GetAllFiles gets all files in the children of the FilesystemObject
 func (fso *FilesystemObject) GetAllFiles() []*FilesystemObject {
 	r := make([]*FilesystemObject, 0)
-	for _, f := range fso.Children {
+	for _, f := range fso.children() {
 		if f.IsDir {
-			r = append(r, f.GetAllFiles()...)
+			if !fso.rules.Excludes(f) {
+				r = append(r, f.GetAllFiles()...)
+			}
 			continue
 		}
-		if !f.IsDir && f.Mode.IsRegular() && !strings.HasPrefix(path.Base(f.Path), ".") && !strings.HasSuffix(f.Path, "~") {
+		if f.isListable() {
 			r = append(r, f)
 			continue
 		}
@@ -278,6 +374,45 @@ func (fso *FilesystemObject) GetAllFiles() []*FilesystemObject {
 	return r
 }
 
+// child returns the direct child with the given name, or nil.
+func (fso *FilesystemObject) child(name string) *FilesystemObject {
+	for _, f := range fso.children() {
+		if path.Base(f.Path) == name {
+			return f
+		}
+	}
+	return nil
+}
+
+// isListable reports whether the FSO is a file we want to show to clients.
+// Its rules are inherited from the root it was scanned under.
+func (fso *FilesystemObject) isListable() bool {
+	return !fso.IsDir && fso.Mode.IsRegular() && !fso.rules.Excludes(fso)
+}
+
+// Summarize returns the number and total size of the files under a directory,
+// counting the same files GetAllFiles returns.
+func (fso *FilesystemObject) Summarize() (int, int64) {
+	count := 0
+	var size int64
+	for _, f := range fso.children() {
+		if f.IsDir {
+			if fso.rules.Excludes(f) {
+				continue
+			}
+			c, s := f.Summarize()
+			count += c
+			size += s
+			continue
+		}
+		if f.isListable() {
+			count++
+			size += f.Size
+		}
+	}
+	return count, size
+}
+
 // IsEqual deterimines if the FSO is the same as on disk.
 // Just a quick check to see if the checsum needs to be updated.
 func (fso *FilesystemObject) IsEqual(path string, size int64, modTime time.Time) bool {
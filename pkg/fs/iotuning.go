@@ -0,0 +1,44 @@
+/*
+Copyright 2020 Daniël Franke
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fs
+
+import "io"
+
+// IOTuning tunes reading files for large sequential downloads, it mostly pays
+// off on spinning disks. The hints are only applied on Linux.
+type IOTuning struct {
+	// Sequential tells the kernel files are read from start to end, so it
+	// reads ahead further.
+	Sequential bool
+	// ReadAhead is how many bytes to start reading in the background from
+	// where a download starts.
+	ReadAhead int64
+	// Direct bypasses the page cache with O_DIRECT, so large downloads don't
+	// push everything else out of it. Filesystems without it read normally.
+	Direct bool
+}
+
+// ReadSeekCloser is a file opened for a download.
+type ReadSeekCloser interface {
+	io.ReadSeeker
+	io.Closer
+}
+
+// Enabled reports whether t changes anything.
+func (t IOTuning) Enabled() bool {
+	return t.Sequential || t.ReadAhead > 0 || t.Direct
+}
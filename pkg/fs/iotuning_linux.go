@@ -0,0 +1,136 @@
+/*
+Copyright 2020 Daniël Franke
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fs
+
+import (
+	"errors"
+	"io"
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// directBufSize is how much is read at once with O_DIRECT, it's a multiple of
+// any block size.
+const directBufSize = 1 << 20
+
+// Open opens the file at p for a download starting at offset, with the tuning
+// applied. The hints are best effort, failing to apply them isn't an error.
+func (t IOTuning) Open(p string, offset int64) (ReadSeekCloser, error) {
+	flags := os.O_RDONLY
+	if t.Direct {
+		flags |= unix.O_DIRECT
+	}
+	f, err := os.OpenFile(p, flags, 0)
+	direct := t.Direct
+	if direct && errors.Is(err, syscall.EINVAL) {
+		f, err = os.Open(p)
+		direct = false
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	fd := int(f.Fd())
+	if t.Sequential {
+		_ = unix.Fadvise(fd, 0, 0, unix.FADV_SEQUENTIAL)
+	}
+	if t.ReadAhead > 0 {
+		_ = unix.Fadvise(fd, offset, t.ReadAhead, unix.FADV_WILLNEED)
+	}
+	if !direct {
+		return f, nil
+	}
+	dr, err := newDirectReader(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return dr, nil
+}
+
+// directReader reads a file opened with O_DIRECT, which only reads whole
+// blocks into aligned memory, through a buffer.
+type directReader struct {
+	f    *os.File
+	size int64
+	// buf is page aligned, it holds n bytes of the file from bufOff.
+	buf    []byte
+	bufOff int64
+	n      int
+	off    int64
+}
+
+func newDirectReader(f *os.File) (*directReader, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	// Anonymous mappings are page aligned, which satisfies every filesystem.
+	buf, err := unix.Mmap(-1, 0, directBufSize, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_ANON|unix.MAP_PRIVATE)
+	if err != nil {
+		return nil, err
+	}
+	return &directReader{f: f, size: info.Size(), buf: buf}, nil
+}
+
+func (dr *directReader) Read(p []byte) (int, error) {
+	if dr.off >= dr.size {
+		return 0, io.EOF
+	}
+	if dr.off < dr.bufOff || dr.off >= dr.bufOff+int64(dr.n) {
+		dr.bufOff = dr.off &^ (directBufSize - 1)
+		n, err := dr.f.ReadAt(dr.buf, dr.bufOff)
+		if err != nil && err != io.EOF {
+			dr.n = 0
+			return 0, err
+		}
+		dr.n = n
+		if dr.off >= dr.bufOff+int64(n) {
+			return 0, io.ErrUnexpectedEOF
+		}
+	}
+	n := copy(p, dr.buf[dr.off-dr.bufOff:dr.n])
+	dr.off += int64(n)
+	return n, nil
+}
+
+func (dr *directReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += dr.off
+	case io.SeekEnd:
+		offset += dr.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	dr.off = offset
+	return offset, nil
+}
+
+func (dr *directReader) Close() error {
+	err := unix.Munmap(dr.buf)
+	if cerr := dr.f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
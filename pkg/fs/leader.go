@@ -0,0 +1,98 @@
+/*
+Copyright 2020 Daniël Franke
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fs
+
+import (
+	"context"
+	"errors"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Leadership elects a single instance, out of several serving the same
+// storage, to do background maintenance: cleaning up directories and expiring
+// files. The leader holds an exclusive lock on a file on the shared storage,
+// which is released when it exits, so a follower can take over.
+type Leadership struct {
+	path   string
+	leader int32
+	file   *os.File
+	logger *zap.Logger
+}
+
+// NewLeadership creates a new Leadership using the lock file at path.
+func NewLeadership(path string, logger *zap.Logger) *Leadership {
+	return &Leadership{
+		path:   path,
+		logger: logger.With(zap.String(PathKey, path)),
+	}
+}
+
+// IsLeader reports whether this instance holds the lock, a nil Leadership is
+// always the leader.
+func (l *Leadership) IsLeader() bool {
+	return l == nil || atomic.LoadInt32(&l.leader) == 1
+}
+
+// Run tries to take the lock every interval until it succeeds or ctx is
+// cancelled. The lock is held until the process exits. Without lock files we
+// stay a follower.
+func (l *Leadership) Run(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		ok, err := l.tryAcquire()
+		if ok {
+			l.logger.Info("elected leader, running maintenance")
+			return
+		}
+		if errors.Is(err, ErrLocksUnsupported) {
+			l.logger.Error("can't elect a leader, not running maintenance", zap.Error(err))
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+func (l *Leadership) tryAcquire() (bool, error) {
+	if l.file == nil {
+		f, err := os.OpenFile(l.path, os.O_CREATE|os.O_RDWR, 0o640)
+		if err != nil {
+			l.logger.Error("couldn't open lock file", zap.Error(err))
+			return false, err
+		}
+		l.file = f
+	}
+	ok, err := tryLockFile(l.file)
+	if err != nil {
+		l.logger.Error("couldn't lock", zap.Error(err))
+		return false, err
+	}
+	if !ok {
+		l.logger.Debug("another instance is leader")
+		return false, nil
+	}
+	atomic.StoreInt32(&l.leader, 1)
+	return true, nil
+}
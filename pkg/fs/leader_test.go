@@ -0,0 +1,59 @@
+/*
+Copyright 2020 Daniël Franke
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fs
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestLeadership(t *testing.T) {
+	if !LocksSupported {
+		t.Skip("lock files aren't supported on this platform")
+	}
+	dir, err := ioutil.TempDir("", "leader")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "leader.lock")
+
+	first := NewLeadership(path, zap.NewNop())
+	second := NewLeadership(path, zap.NewNop())
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	first.Run(ctx, time.Millisecond)
+	if !first.IsLeader() {
+		t.Fatal("first instance isn't the leader")
+	}
+	if ok, err := second.tryAcquire(); ok || err != nil {
+		t.Errorf("second tryAcquire() = %t, %v, want false, nil", ok, err)
+	}
+
+	// Exiting releases the lock.
+	first.file.Close()
+	if ok, err := second.tryAcquire(); !ok || err != nil {
+		t.Errorf("second tryAcquire() after release = %t, %v, want true, nil", ok, err)
+	}
+	second.file.Close()
+}
@@ -0,0 +1,36 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd
+// +build !linux,!darwin,!freebsd,!netbsd,!openbsd
+
+/*
+Copyright 2020 Daniël Franke
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fs
+
+import "os"
+
+// LocksSupported reports whether lock files work on this platform, they need
+// flock.
+const LocksSupported = false
+
+// tryLockFile can't lock without flock, so nobody gets the lock.
+func tryLockFile(_ *os.File) (bool, error) {
+	return false, ErrLocksUnsupported
+}
+
+// lockFile can't lock without flock.
+func lockFile(_ *os.File) error {
+	return ErrLocksUnsupported
+}
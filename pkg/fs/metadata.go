@@ -0,0 +1,58 @@
+/*
+Copyright 2020 Daniël Franke
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fs
+
+// Metadata is what is needed to restore a file with the same ownership,
+// permissions and extended attributes elsewhere.
+type Metadata struct {
+	UID uint32 `json:"uid"`
+	GID uint32 `json:"gid"`
+	// Mode holds the permission bits.
+	Mode   uint32            `json:"mode"`
+	Xattrs map[string][]byte `json:"xattrs,omitempty"`
+}
+
+// MetadataOptions configures which metadata is included in the manifest, next
+// to ownership and permissions.
+type MetadataOptions struct {
+	// Xattrs are the names of the extended attributes to include, if set.
+	Xattrs []string
+}
+
+// SetMetadata includes the metadata in opts with every file, nil disables it.
+func (r *Registry) SetMetadata(opts *MetadataOptions) {
+	r.metadata = opts
+}
+
+// metadataOf returns the metadata of fso to include, or nil.
+func (r *Registry) metadataOf(fso *FilesystemObject) *Metadata {
+	if r.metadata == nil {
+		return nil
+	}
+	m := &Metadata{UID: fso.uid, GID: fso.gid, Mode: uint32(fso.Mode.Perm())}
+	for _, name := range r.metadata.Xattrs {
+		v, err := getxattr(fso.Path, name)
+		if err != nil {
+			continue
+		}
+		if m.Xattrs == nil {
+			m.Xattrs = make(map[string][]byte, len(r.metadata.Xattrs))
+		}
+		m.Xattrs[name] = []byte(v)
+	}
+	return m
+}
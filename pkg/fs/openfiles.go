@@ -0,0 +1,62 @@
+/*
+Copyright 2020 Daniël Franke
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fs
+
+import (
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// OpenFileChecker reports files that are currently open for writing by any
+// process, such as torrent clients that preallocate full-size files. The set of
+// open files is cached for ttl, as collecting it is expensive.
+type OpenFileChecker struct {
+	ttl       time.Duration
+	writing   map[string]bool
+	collected time.Time
+	logger    *zap.Logger
+	sync.Mutex
+}
+
+// NewOpenFileChecker creates a new OpenFileChecker.
+func NewOpenFileChecker(ttl time.Duration, logger *zap.Logger) *OpenFileChecker {
+	return &OpenFileChecker{
+		ttl:    ttl,
+		logger: logger,
+	}
+}
+
+// IsOpenForWriting reports whether p is open for writing, a nil checker
+// always returns false.
+func (c *OpenFileChecker) IsOpenForWriting(p string) bool {
+	if c == nil {
+		return false
+	}
+	c.Lock()
+	defer c.Unlock()
+	if time.Since(c.collected) > c.ttl {
+		writing, err := filesOpenForWriting()
+		if err != nil {
+			c.logger.Error("couldn't collect open files", zap.Error(err))
+		}
+		c.writing = writing
+		c.collected = time.Now()
+	}
+	return c.writing[p]
+}
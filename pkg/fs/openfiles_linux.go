@@ -0,0 +1,67 @@
+/*
+Copyright 2020 Daniël Franke
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fs
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// filesOpenForWriting walks procfs for file descriptors opened write-only or
+// read-write. Processes we aren't allowed to inspect are skipped.
+func filesOpenForWriting() (map[string]bool, error) {
+	fds, err := filepath.Glob("/proc/[0-9]*/fd/[0-9]*")
+	if err != nil {
+		return nil, err
+	}
+	writing := make(map[string]bool)
+	for _, fd := range fds {
+		target, err := os.Readlink(fd)
+		if err != nil || !strings.HasPrefix(target, "/") {
+			continue
+		}
+		flags, err := fdFlags(strings.Replace(fd, "/fd/", "/fdinfo/", 1))
+		if err != nil {
+			continue
+		}
+		if flags&syscall.O_ACCMODE != syscall.O_RDONLY {
+			writing[target] = true
+		}
+	}
+	return writing, nil
+}
+
+// fdFlags reads the octal open flags from a procfs fdinfo file.
+func fdFlags(fdinfo string) (int, error) {
+	f, err := os.Open(fdinfo)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		if v := strings.TrimPrefix(s.Text(), "flags:"); v != s.Text() {
+			flags, err := strconv.ParseInt(strings.TrimSpace(v), 8, 64)
+			return int(flags), err
+		}
+	}
+	return 0, s.Err()
+}
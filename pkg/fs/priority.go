@@ -0,0 +1,72 @@
+/*
+Copyright 2020 Daniël Franke
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fs
+
+import (
+	"path"
+	"strings"
+)
+
+// PriorityPolicy sets the sync priority of the files of a root, files of higher
+// priority are listed first in the manifest.
+type PriorityPolicy struct {
+	// Default is the priority of files no rule matches.
+	Default int
+	// Rules are tried in order, the first one matching wins.
+	Rules []PriorityRule
+}
+
+// PriorityRule gives the files matching Pattern a priority. The pattern is
+// matched against the slash separated path of a file in its root, the paths of
+// its directories, so "incoming" matches everything below it, and its name.
+type PriorityRule struct {
+	Pattern  string
+	Priority int
+}
+
+// SetPriorityPolicy sets the priority policy of the root at servePath, nil
+// gives every file priority 0.
+func (r *Registry) SetPriorityPolicy(servePath string, pp *PriorityPolicy) {
+	if fso, ok := r.pathFSO[servePath]; ok {
+		fso.Lock()
+		fso.priorities = pp
+		fso.Unlock()
+	}
+}
+
+// Of returns the priority of the file at the slash separated p in the root.
+func (pp *PriorityPolicy) Of(p string) int {
+	if pp == nil {
+		return 0
+	}
+	for _, rule := range pp.Rules {
+		if ok, _ := path.Match(rule.Pattern, path.Base(p)); ok {
+			return rule.Priority
+		}
+		for dir := p; dir != "." && dir != "/" && dir != ""; dir = path.Dir(dir) {
+			if ok, _ := path.Match(rule.Pattern, dir); ok {
+				return rule.Priority
+			}
+		}
+	}
+	return pp.Default
+}
+
+// priorityOf returns the priority of f in the root fso.
+func (fso *FilesystemObject) priorityOf(f *FilesystemObject) int {
+	return fso.priorities.Of(strings.TrimPrefix(f.Path, fso.Path+"/"))
+}
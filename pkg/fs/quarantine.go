@@ -0,0 +1,159 @@
+/*
+Copyright 2020 Daniël Franke
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fs
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Quarantined is a file that failed too often, it is left out of manifests
+// until retrying it succeeds.
+type Quarantined struct {
+	Path      string    `json:"path"`
+	Failures  int       `json:"failures"`
+	LastError string    `json:"last_error"`
+	Since     time.Time `json:"since"`
+	RetryAt   time.Time `json:"retry_at"`
+}
+
+// Quarantine tracks files that repeatedly fail to stat, open or hash, so a
+// single bad file doesn't break whole scans. Quarantined files are retried
+// with exponential backoff.
+type Quarantine struct {
+	threshold  int
+	backoff    time.Duration
+	maxBackoff time.Duration
+	logger     *zap.Logger
+
+	mu sync.Mutex
+	// failing maps paths to their failures, quarantined or not yet.
+	failing map[string]*Quarantined
+}
+
+// NewQuarantine creates a new Quarantine, quarantining files after threshold
+// consecutive failures.
+func NewQuarantine(threshold int, backoff, maxBackoff time.Duration, logger *zap.Logger) *Quarantine {
+	return &Quarantine{
+		threshold:  threshold,
+		backoff:    backoff,
+		maxBackoff: maxBackoff,
+		logger:     logger,
+		failing:    make(map[string]*Quarantined),
+	}
+}
+
+// Record records a failure of the file at p.
+func (q *Quarantine) Record(p string, err error) {
+	if q == nil {
+		return
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	f, ok := q.failing[p]
+	if !ok {
+		f = &Quarantined{Path: p}
+		q.failing[p] = f
+	}
+	f.Failures++
+	f.LastError = err.Error()
+	if f.Failures < q.threshold {
+		return
+	}
+	if f.Failures == q.threshold {
+		q.logger.Warn("quarantining file", zap.String(PathKey, p), zap.Error(err))
+		f.Since = time.Now()
+	}
+	wait := q.maxBackoff
+	if shift := uint(f.Failures - q.threshold); shift < 32 && q.backoff<<shift < q.maxBackoff {
+		wait = q.backoff << shift
+	}
+	f.RetryAt = time.Now().Add(wait)
+}
+
+// Clear forgets the failures of the file at p, after it worked.
+func (q *Quarantine) Clear(p string) {
+	if q == nil {
+		return
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if f, ok := q.failing[p]; ok {
+		if f.Failures >= q.threshold {
+			q.logger.Info("file recovered from quarantine", zap.String(PathKey, p))
+		}
+		delete(q.failing, p)
+	}
+}
+
+// Contains reports whether the file at p is quarantined.
+func (q *Quarantine) Contains(p string) bool {
+	if q == nil {
+		return false
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	f, ok := q.failing[p]
+	return ok && f.Failures >= q.threshold
+}
+
+// Skip reports whether the file at p is quarantined, and not due for a retry.
+func (q *Quarantine) Skip(p string) bool {
+	if q == nil {
+		return false
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	f, ok := q.failing[p]
+	return ok && f.Failures >= q.threshold && time.Now().Before(f.RetryAt)
+}
+
+// Entries returns the quarantined files, by path.
+func (q *Quarantine) Entries() []Quarantined {
+	r := []Quarantined{}
+	if q == nil {
+		return r
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, f := range q.failing {
+		if f.Failures >= q.threshold {
+			r = append(r, *f)
+		}
+	}
+	sort.Slice(r, func(i, j int) bool { return r[i].Path < r[j].Path })
+	return r
+}
+
+// SetQuarantine quarantines files of all roots that keep failing, instead of
+// failing their scans.
+func (r *Registry) SetQuarantine(q *Quarantine) {
+	r.quarantine = q
+	for _, fso := range r.pathFSO {
+		fso.Lock()
+		fso.quarantine = q
+		fso.Unlock()
+	}
+}
+
+// Quarantined returns the quarantined files.
+func (r *Registry) Quarantined() []Quarantined {
+	return r.quarantine.Entries()
+}
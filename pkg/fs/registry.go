@@ -17,8 +17,12 @@ limitations under the License.
 package fs
 
 import (
-	"fmt"
+	"context"
+	"errors"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 
 	"go.uber.org/zap"
 )
@@ -28,25 +32,66 @@ type WebObject struct {
 	*FilesystemObject
 	// WebPath is where the file is downloadable.
 	WebPath string `json:"web_path"`
+	// Tags are the labels attached to the file, filled in by the caller.
+	Tags []string `json:"tags,omitempty"`
+	// Stale is set when the root is unavailable, and the file is from the last
+	// successful scan.
+	Stale bool `json:"stale,omitempty"`
+	// Meta is only set when the registry is configured to include it.
+	Meta *Metadata `json:"meta,omitempty"`
+	// Checksum is the SHA-256 of the file, when it's known yet.
+	Checksum string `json:"checksum,omitempty"`
+	// CaseCollision is set when another file of a case-insensitive root has
+	// the same path ignoring case.
+	CaseCollision bool `json:"case_collision,omitempty"`
+	// Priority orders syncing, files of higher priority are fetched first.
+	Priority int `json:"priority,omitempty"`
 }
 
 func newWebObject(webPath, diskPath string, fso *FilesystemObject) *WebObject {
 	wp := strings.ReplaceAll(fso.Path, diskPath, strings.TrimRight(webPath, "/"))
-	return &WebObject{fso, wp}
+	return &WebObject{FilesystemObject: fso, WebPath: wp}
 }
 
 // Registry is a struct that keeps track of what paths we serve.
 type Registry struct {
 	// pathFSO maps web paths to FSOs.
-	pathFSO map[string]*FilesystemObject
-	logger  *zap.Logger
+	pathFSO    map[string]*FilesystemObject
+	rules      *Rules
+	leadership *Leadership
+	// readOnly disables maintenance altogether, e.g. on a standby.
+	readOnly   bool
+	cleanLock  *FileLock
+	timeouts   *Timeouts
+	breakers   map[string]*Breaker
+	metadata   *MetadataOptions
+	quarantine *Quarantine
+	// onChange are called after a scan or expiry changed the files of a root.
+	onChange []func()
+	logger   *zap.Logger
+
+	mu sync.Mutex
+	// degraded are the serve paths of unavailable roots, and since when.
+	degraded map[string]time.Time
+	// stats are the results of the last scan of each root, by serve path.
+	stats map[string]RootStats
+}
+
+// RootStats describe the last scan of a root.
+type RootStats struct {
+	Files        int
+	Bytes        int64
+	ScanDuration time.Duration
 }
 
 // NewRegistry returns a new Register instance.
 func NewRegistry(logger *zap.Logger) *Registry {
 	return &Registry{
-		pathFSO: make(map[string]*FilesystemObject),
-		logger:  logger,
+		pathFSO:  make(map[string]*FilesystemObject),
+		logger:   logger,
+		degraded: make(map[string]time.Time),
+		breakers: make(map[string]*Breaker),
+		stats:    make(map[string]RootStats),
 	}
 }
 
@@ -57,22 +102,261 @@ func (r *Registry) Register(servePath, diskPath string) error {
 		return err
 	}
 	r.logger.Info("Registering root", zap.String("diskPath", fso.Path), zap.String("servePath", servePath))
+	fso.rules = r.rules
+	fso.quarantine = r.quarantine
 	r.pathFSO[servePath] = fso
+	if r.timeouts != nil {
+		r.SetTimeouts(*r.timeouts)
+	}
 	return nil
 }
 
+// SetRules sets the rules deciding what is hidden from clients, for all roots.
+// nil means the default rules.
+func (r *Registry) SetRules(rules *Rules) {
+	r.rules = rules
+	for _, fso := range r.pathFSO {
+		fso.Lock()
+		fso.rules = rules
+		fso.Unlock()
+	}
+}
+
+// SetLeadership makes maintenance conditional on being the leader, followers
+// only read the disk.
+func (r *Registry) SetLeadership(l *Leadership) {
+	r.leadership = l
+}
+
+// SetReadOnly makes the registry never clean up or expire anything.
+func (r *Registry) SetReadOnly() {
+	r.readOnly = true
+}
+
+// maintains reports whether this instance does maintenance.
+func (r *Registry) maintains() bool {
+	return !r.readOnly && r.leadership.IsLeader()
+}
+
+// SetCleanLock makes cleaning up and expiring hold lock, so instances sharing
+// storage don't race each other deleting the same files.
+func (r *Registry) SetCleanLock(lock *FileLock) {
+	r.cleanLock = lock
+}
+
+// OnChange makes the registry call fn after a scan or an expiry run changed
+// what the roots hold, so derived data can be rebuilt. fn shouldn't block.
+func (r *Registry) OnChange(fn func()) {
+	r.onChange = append(r.onChange, fn)
+}
+
+func (r *Registry) changed() {
+	for _, fn := range r.onChange {
+		fn()
+	}
+}
+
+// SetSidecarPolicy sets the orphaned sidecar policy of the root at servePath.
+func (r *Registry) SetSidecarPolicy(servePath string, sp *SidecarPolicy) {
+	if fso, ok := r.pathFSO[servePath]; ok {
+		fso.SetSidecarPolicy(sp)
+	}
+}
+
+// Orphans returns the orphaned sidecars found by the last cleanup, by root.
+func (r *Registry) Orphans() map[string][]string {
+	o := make(map[string][]string, len(r.pathFSO))
+	for p, fso := range r.pathFSO {
+		if fso.sidecars != nil {
+			fso.Lock()
+			o[p] = fso.Orphans
+			fso.Unlock()
+		}
+	}
+	return o
+}
+
+// Browse returns the entries of the directory at webPath from the last scan,
+// scanning its root first if that never happened.
+func (r *Registry) Browse(ctx context.Context, webPath string) ([]*WebObject, error) {
+	for p, root := range r.pathFSO {
+		if !strings.HasPrefix(webPath+"/", p) {
+			continue
+		}
+		if root.scannedAt().IsZero() {
+			if !r.available(ctx, p, root) {
+				return nil, ErrRootUnavailable
+			}
+			if err := r.guard(ctx, p, scanTimeout, root.Scan); err != nil {
+				return nil, err
+			}
+		}
+		dir := root
+		for _, name := range strings.FieldsFunc(strings.TrimPrefix(webPath+"/", p), func(r rune) bool { return r == '/' }) {
+			dir = dir.child(name)
+			if dir == nil || !dir.IsDir || r.rules.Excludes(dir) {
+				return nil, ErrNotFound
+			}
+		}
+
+		children := dir.children()
+		entries := make([]*WebObject, 0, len(children))
+		for _, f := range children {
+			if f.IsDir || f.isListable() {
+				entries = append(entries, newWebObject(p, root.Path, f))
+			}
+		}
+		return entries, nil
+	}
+	return nil, ErrNotFound
+}
+
 // GetAllFiles simply returns a list of all files of all registered roots.
-func (r *Registry) GetAllFiles() ([]*WebObject, error) {
-	fmt.Printf("%+v\n", r.pathFSO)
+// Empty directories are cleaned up along the way, when we're the leader.
+// Roots failing to scan are marked degraded and listed from their last scan.
+// Cancelling ctx aborts the underlying scans.
+func (r *Registry) GetAllFiles(ctx context.Context) ([]*WebObject, error) {
+	if !r.maintains() {
+		return r.ScanAllFiles(ctx)
+	}
+	return r.collect(ctx, func(fso *FilesystemObject, ctx context.Context) error {
+		return r.cleanLock.Do(func() error { return fso.Clean(ctx) })
+	})
+}
+
+// ScanAllFiles returns the same list as GetAllFiles, but only reads the disk.
+func (r *Registry) ScanAllFiles(ctx context.Context) ([]*WebObject, error) {
+	return r.collect(ctx, (*FilesystemObject).Scan)
+}
+
+// DiskPaths returns the disk paths of the files found by the last scan of each
+// root, including the ones left out of listings.
+func (r *Registry) DiskPaths() map[string]bool {
+	paths := make(map[string]bool)
+	for _, fso := range r.pathFSO {
+		for _, f := range fso.GetAllFiles() {
+			paths[f.Path] = true
+		}
+	}
+	return paths
+}
+
+// IndexedFiles returns the files found by the last scan of each root, roots
+// that were never scanned are scanned first.
+func (r *Registry) IndexedFiles(ctx context.Context) ([]*WebObject, error) {
+	return r.collect(ctx, func(fso *FilesystemObject, ctx context.Context) error {
+		if !fso.scannedAt().IsZero() {
+			return nil
+		}
+		return fso.Scan(ctx)
+	})
+}
+
+// Index scans the roots that weren't scanned yet, and retries the ones that
+// fail every interval, until all are scanned or ctx is done.
+func (r *Registry) Index(ctx context.Context, interval time.Duration) {
+	for {
+		if _, err := r.IndexedFiles(ctx); err != nil && ctx.Err() == nil {
+			r.logger.Error("initial scan failed", zap.Error(err))
+		}
+		pending := r.Pending()
+		if len(pending) == 0 {
+			return
+		}
+		r.logger.Warn("roots not scanned yet, retrying",
+			zap.Strings("serve_paths", pending), zap.Duration("interval", interval))
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+func (r *Registry) collect(ctx context.Context, walk func(*FilesystemObject, context.Context) error) ([]*WebObject, error) {
+	r.logger.Debug("collecting files", zap.Int("roots", len(r.pathFSO)))
+	rescanned := false
+	defer func() {
+		if rescanned {
+			r.changed()
+		}
+	}()
 	f := make([]*WebObject, 0)
 	for p, fso := range r.pathFSO {
-		err := fso.Clean()
-		if err != nil {
-			return f, err
+		stale := !r.available(ctx, p, fso)
+		start := time.Now()
+		if !stale {
+			err := r.guard(ctx, p, scanTimeout, func(ctx context.Context) error { return walk(fso, ctx) })
+			if errors.Is(err, ErrTimeout) || errors.Is(err, ErrCircuitOpen) {
+				// The walk may still be changing the tree, so leave the root out.
+				r.logger.Warn("skipping root", zap.String("serve_path", p), zap.Error(err))
+				r.markDegraded(p, fso)
+				continue
+			}
+			if err != nil && ctx.Err() != nil {
+				return f, ctx.Err()
+			}
+			if err != nil {
+				// Other roots are still served, this one from its last scan.
+				r.logger.Error("couldn't scan root", zap.String("serve_path", p), zap.Error(err))
+				r.markDegraded(p, fso)
+				stale = true
+			}
+		}
+		files := fso.GetAllFiles()
+		root := make([]*WebObject, 0, len(files))
+		var size int64
+		for _, l := range files {
+			if r.quarantine.Contains(l.Path) {
+				continue
+			}
+			wo := newWebObject(p, fso.Path, l)
+			wo.Stale = stale
+			wo.Meta = r.metadataOf(l)
+			wo.Priority = fso.priorityOf(l)
+			root = append(root, wo)
+			size += l.Size
 		}
-		for _, l := range fso.GetAllFiles() {
-			f = append(f, newWebObject(p, fso.Path, l))
+		if fso.caseInsensitive {
+			flagCaseCollisions(root)
 		}
+		if fso.scannedAt().After(start) {
+			r.setStats(p, RootStats{Files: len(root), Bytes: size, ScanDuration: time.Since(start)})
+			rescanned = true
+		}
+		f = append(f, root...)
 	}
 	return f, nil
 }
+
+func (r *Registry) setStats(servePath string, s RootStats) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.stats[servePath] = s
+}
+
+// Pending returns the serve paths of the roots that weren't scanned yet.
+func (r *Registry) Pending() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	pending := make([]string, 0)
+	for p := range r.pathFSO {
+		if _, ok := r.stats[p]; !ok {
+			pending = append(pending, p)
+		}
+	}
+	sort.Strings(pending)
+	return pending
+}
+
+// Stats returns the results of the last scan of each root that was scanned, by
+// serve path.
+func (r *Registry) Stats() map[string]RootStats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s := make(map[string]RootStats, len(r.stats))
+	for p, rs := range r.stats {
+		s[p] = rs
+	}
+	return s
+}
@@ -0,0 +1,188 @@
+/*
+Copyright 2020 Daniël Franke
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fs
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// testRoots creates a directory with a subdirectory per root, each holding the
+// given files.
+func testRoots(t *testing.T, roots map[string][]string) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "registry")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for root, files := range roots {
+		for _, f := range files {
+			p := filepath.Join(dir, root, filepath.FromSlash(f))
+			if err := os.MkdirAll(filepath.Dir(p), 0o750); err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(p, []byte(f), 0o640); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	return dir
+}
+
+func webPaths(files []*WebObject) []string {
+	paths := make([]string, 0, len(files))
+	for _, f := range files {
+		paths = append(paths, f.WebPath)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+func TestCollectContinuesPastFailingRoot(t *testing.T) {
+	dir := testRoots(t, map[string][]string{
+		"good": {"a.mkv"},
+		"bad":  {"b.mkv"},
+	})
+	defer os.RemoveAll(dir)
+
+	r := NewRegistry(zap.NewNop())
+	for _, root := range []string{"good", "bad"} {
+		if err := r.Register("/"+root+"/", filepath.Join(dir, root)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	files, err := r.ScanAllFiles(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := webPaths(files); len(got) != 2 {
+		t.Fatalf("files = %v, want both roots", got)
+	}
+
+	// A dangling link fails the scan of its root.
+	if err := os.Symlink(filepath.Join(dir, "nowhere"), filepath.Join(dir, "bad", "broken")); err != nil {
+		t.Fatal(err)
+	}
+	files, err = r.ScanAllFiles(context.Background())
+	if err != nil {
+		t.Fatalf("ScanAllFiles() = %v, want the failing root skipped", err)
+	}
+	for _, f := range files {
+		if want := f.WebPath == "/bad/b.mkv"; f.Stale != want {
+			t.Errorf("%s stale = %t, want %t", f.WebPath, f.Stale, want)
+		}
+	}
+	if got := webPaths(files); len(got) != 2 {
+		t.Errorf("files = %v, want the last known files of the failing root too", got)
+	}
+	if _, ok := r.Degraded()["/bad/"]; !ok {
+		t.Errorf("Degraded() = %v, want /bad/", r.Degraded())
+	}
+}
+
+func TestIndexRetries(t *testing.T) {
+	dir := testRoots(t, map[string][]string{"media": {"a.mkv"}})
+	defer os.RemoveAll(dir)
+	root := filepath.Join(dir, "media")
+
+	r := NewRegistry(zap.NewNop())
+	if err := r.Register("/media/", root); err != nil {
+		t.Fatal(err)
+	}
+	// The root is unavailable for the first scan.
+	if err := os.Rename(root, root+".away"); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		r.Index(ctx, 10*time.Millisecond)
+		close(done)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	if got := r.Pending(); len(got) != 1 {
+		t.Fatalf("Pending() = %v, want the unavailable root", got)
+	}
+	if err := os.Rename(root+".away", root); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-done:
+	case <-ctx.Done():
+		t.Fatal("Index didn't finish after the root came back")
+	}
+	if got := r.Pending(); len(got) != 0 {
+		t.Errorf("Pending() = %v, want none", got)
+	}
+}
+
+// TestConcurrentReads is meant for the race detector, listings mustn't see a
+// tree that's being rescanned.
+func TestConcurrentReads(t *testing.T) {
+	dir := testRoots(t, map[string][]string{"media": {"a/1.mkv", "a/2.mkv", "b/3.mkv", "4.mkv"}})
+	defer os.RemoveAll(dir)
+
+	r := NewRegistry(zap.NewNop())
+	if err := r.Register("/media/", filepath.Join(dir, "media")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.ScanAllFiles(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				if _, err := r.ScanAllFiles(context.Background()); err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				files, err := r.IndexedFiles(context.Background())
+				if err != nil {
+					t.Error(err)
+				}
+				if len(files) != 4 {
+					t.Errorf("IndexedFiles() = %v, want all 4 files", webPaths(files))
+				}
+				if n, _ := r.pathFSO["/media/"].Summarize(); n != 4 {
+					t.Errorf("Summarize() = %d files, want 4", n)
+				}
+				if _, err := r.Browse(context.Background(), "/media/a"); err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,130 @@
+/*
+Copyright 2020 Daniël Franke
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fs
+
+import (
+	"path"
+	"strings"
+	"time"
+)
+
+// Rule decides whether a filesystem object is hidden from clients. Hidden
+// objects aren't listed, and can't be downloaded or deleted directly.
+type Rule interface {
+	Excludes(fso *FilesystemObject) bool
+}
+
+// RuleFunc adapts a function to a Rule.
+type RuleFunc func(fso *FilesystemObject) bool
+
+// Excludes calls f.
+func (f RuleFunc) Excludes(fso *FilesystemObject) bool {
+	return f(fso)
+}
+
+// Rules is a set of rules, an object is excluded when any rule excludes it.
+type Rules struct {
+	rules []Rule
+}
+
+// defaultRules is what we've always hidden: dotfiles and editor backups.
+var defaultRules = NewRules(DotfileRule(), SuffixRule("~"))
+
+// NewRules creates a new set of rules.
+func NewRules(rules ...Rule) *Rules {
+	return &Rules{rules: rules}
+}
+
+// Add adds a rule to the set.
+func (rs *Rules) Add(r Rule) {
+	rs.rules = append(rs.rules, r)
+}
+
+// Excludes reports whether any rule excludes fso, nil rules are the defaults.
+func (rs *Rules) Excludes(fso *FilesystemObject) bool {
+	if rs == nil {
+		rs = defaultRules
+	}
+	for _, r := range rs.rules {
+		if r.Excludes(fso) {
+			return true
+		}
+	}
+	return false
+}
+
+// DotfileRule excludes files and directories starting with a dot.
+func DotfileRule() Rule {
+	return RuleFunc(func(fso *FilesystemObject) bool {
+		return strings.HasPrefix(path.Base(fso.Path), ".")
+	})
+}
+
+// SuffixRule excludes names ending in any of the suffixes, e.g. temp files.
+func SuffixRule(suffixes ...string) Rule {
+	return RuleFunc(func(fso *FilesystemObject) bool {
+		for _, s := range suffixes {
+			if strings.HasSuffix(fso.Path, s) {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// GlobRule excludes names matching any of the patterns, matched against the
+// base name only.
+func GlobRule(patterns ...string) Rule {
+	return RuleFunc(func(fso *FilesystemObject) bool {
+		name := path.Base(fso.Path)
+		for _, p := range patterns {
+			if ok, _ := path.Match(p, name); ok {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// MinAgeRule excludes files modified less than age ago, as they might still be
+// in the process of being written.
+func MinAgeRule(age time.Duration) Rule {
+	return RuleFunc(func(fso *FilesystemObject) bool {
+		return !fso.IsDir && time.Since(fso.ModTime) < age
+	})
+}
+
+// OpenFileRule excludes files other processes have open for writing.
+func OpenFileRule(c *OpenFileChecker) Rule {
+	return RuleFunc(func(fso *FilesystemObject) bool {
+		return !fso.IsDir && c.IsOpenForWriting(fso.Path)
+	})
+}
+
+// ExcludesPath reports whether fso, or any of the directories between root and
+// it, is excluded. Used when a file is requested without going through a scan.
+func (rs *Rules) ExcludesPath(root string, fso *FilesystemObject) bool {
+	if rs.Excludes(fso) {
+		return true
+	}
+	for dir := path.Dir(fso.Path); strings.HasPrefix(dir, root) && len(dir) > len(root); dir = path.Dir(dir) {
+		if rs.Excludes(&FilesystemObject{Path: dir, IsDir: true}) {
+			return true
+		}
+	}
+	return false
+}
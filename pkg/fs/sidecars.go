@@ -0,0 +1,193 @@
+/*
+Copyright 2020 Daniël Franke
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fs
+
+import (
+	"context"
+	"errors"
+	"path"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// SidecarPolicy decides which files are sidecars (subtitles, nfo, artwork) of
+// media files, and what to do with sidecars whose media is gone.
+type SidecarPolicy struct {
+	// DryRun only reports orphans instead of deleting them.
+	DryRun bool
+
+	sidecarExtensions map[string]bool
+	mediaExtensions   map[string]bool
+}
+
+// NewSidecarPolicy creates a SidecarPolicy from lists of file extensions.
+func NewSidecarPolicy(sidecarExtensions, mediaExtensions []string, dryRun bool) *SidecarPolicy {
+	return &SidecarPolicy{
+		DryRun:            dryRun,
+		sidecarExtensions: extensionSet(sidecarExtensions),
+		mediaExtensions:   extensionSet(mediaExtensions),
+	}
+}
+
+func extensionSet(extensions []string) map[string]bool {
+	s := make(map[string]bool, len(extensions))
+	for _, e := range extensions {
+		s[strings.ToLower(e)] = true
+	}
+	return s
+}
+
+func (sp *SidecarPolicy) isSidecar(f *FilesystemObject) bool {
+	return !f.IsDir && sp.sidecarExtensions[strings.ToLower(path.Ext(f.Path))]
+}
+
+func (sp *SidecarPolicy) isMedia(f *FilesystemObject) bool {
+	return !f.IsDir && sp.mediaExtensions[strings.ToLower(path.Ext(f.Path))]
+}
+
+// directorySidecars are the names, without extension, media centers give the
+// sidecars of a whole directory, like tvshow.nfo and poster.jpg. Names starting
+// with season are too, like season01-poster.jpg.
+var directorySidecars = map[string]bool{
+	"tvshow": true, "movie": true, "folder": true, "poster": true, "fanart": true, "banner": true,
+	"thumb": true, "landscape": true, "clearart": true, "clearlogo": true, "logo": true, "backdrop": true,
+	"cover": true, "disc": true, "discart": true,
+}
+
+// stem returns the name of f without its extension.
+func stem(f *FilesystemObject) string {
+	name := path.Base(f.Path)
+	return strings.TrimSuffix(name, path.Ext(name))
+}
+
+// isDirectorySidecar reports whether the sidecar f describes its directory.
+func isDirectorySidecar(f *FilesystemObject) bool {
+	s := strings.ToLower(stem(f))
+	return directorySidecars[s] || strings.HasPrefix(s, "season")
+}
+
+// belongsTo reports whether the sidecar f is named after a media file with
+// one of stems, like ep1.en.srt and ep1-thumb.jpg are after ep1.mkv.
+func belongsTo(f *FilesystemObject, stems []string) bool {
+	s := stem(f)
+	for _, m := range stems {
+		if s == m || strings.HasPrefix(s, m+".") || strings.HasPrefix(s, m+"-") {
+			return true
+		}
+	}
+	return false
+}
+
+// SetSidecarPolicy makes Clean handle orphaned sidecars according to sp, nil
+// disables it. Only has effect on roots.
+func (fso *FilesystemObject) SetSidecarPolicy(sp *SidecarPolicy) {
+	fso.Lock()
+	defer fso.Unlock()
+	fso.sidecars = sp
+}
+
+// cleanSidecars removes the sidecars whose media file is gone, and returns the
+// orphans found and whether any media is left below fso. A sidecar is kept
+// when it's named after a media file in its directory, when it describes a
+// directory with media below it, or when it's in a directory without media of
+// its own next to media, like subtitle subdirectories. Excluded files and
+// directories are left alone.
+func (fso *FilesystemObject) cleanSidecars(ctx context.Context, sp *SidecarPolicy,
+	parentHasMedia bool) ([]string, bool, error) {
+	fso.scanning.Lock()
+	defer fso.scanning.Unlock()
+
+	children := fso.children()
+	var stems []string
+	for _, f := range children {
+		if sp.isMedia(f) && !fso.rules.Excludes(f) {
+			stems = append(stems, stem(f))
+		}
+	}
+	hasMedia := len(stems) > 0
+	mediaBelow := hasMedia
+	orphans := []string{}
+	for _, f := range children {
+		if !f.IsDir || f.LinkTarget != "" || fso.rules.Excludes(f) {
+			continue
+		}
+		o, below, err := f.cleanSidecars(ctx, sp, hasMedia)
+		orphans = append(orphans, o...)
+		if err != nil {
+			return orphans, mediaBelow, err
+		}
+		mediaBelow = mediaBelow || below
+	}
+
+	newChildren := []*FilesystemObject{}
+	for _, f := range children {
+		if err := ctx.Err(); err != nil {
+			return orphans, mediaBelow, err
+		}
+		keep := f.IsDir || !sp.isSidecar(f) || fso.rules.Excludes(f) || belongsTo(f, stems) ||
+			(isDirectorySidecar(f) && mediaBelow) || (!hasMedia && parentHasMedia)
+		if keep {
+			newChildren = append(newChildren, f)
+			continue
+		}
+
+		orphans = append(orphans, f.Path)
+		if sp.DryRun {
+			fso.logger.Info("found orphaned sidecar", zap.String(PathKey, f.Path))
+			newChildren = append(newChildren, f)
+			continue
+		}
+		fso.logger.Info("deleting orphaned sidecar", zap.String(PathKey, f.Path))
+		if err := f.Delete(); err != nil {
+			return orphans, mediaBelow, err
+		}
+	}
+	fso.Lock()
+	fso.Children = newChildren
+	fso.Unlock()
+	return orphans, mediaBelow, nil
+}
+
+// CleanSidecars handles the orphaned sidecars of every root with a sidecar
+// policy, see SidecarPolicy. The orphans found are kept for Orphans.
+func (r *Registry) CleanSidecars(ctx context.Context) error {
+	for p, fso := range r.pathFSO {
+		if fso.sidecars == nil || !r.available(ctx, p, fso) {
+			continue
+		}
+		err := r.guard(ctx, p, scanTimeout, fso.Scan)
+		if errors.Is(err, ErrTimeout) || errors.Is(err, ErrCircuitOpen) {
+			r.logger.Warn("skipping sidecar cleanup of root", zap.String("serve_path", p), zap.Error(err))
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		err = r.cleanLock.Do(func() error {
+			orphans, _, err := fso.cleanSidecars(ctx, fso.sidecars, false)
+			fso.Lock()
+			fso.Orphans = orphans
+			fso.Unlock()
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+/*
+Copyright 2020 Daniël Franke
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fs
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+func TestCleanSidecars(t *testing.T) {
+	root, err := ioutil.TempDir("", "sidecars")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	files := []string{
+		"Show/tvshow.nfo",
+		"Show/poster.jpg",
+		"Show/Season 1/season01-poster.jpg",
+		"Show/Season 1/ep1.srt",
+		"Show/Season 1/ep1.en.srt",
+		"Show/Season 1/ep2.mkv",
+		"Show/Season 1/ep2.srt",
+		"Show/Season 1/ep2-thumb.jpg",
+		"Movie/Movie.mkv",
+		"Movie/Subs/English.srt",
+		"Gone/tvshow.nfo",
+		"Gone/.hidden/old.srt",
+	}
+	for _, f := range files {
+		p := filepath.Join(root, filepath.FromSlash(f))
+		if err := os.MkdirAll(filepath.Dir(p), 0o750); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(f), 0o640); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, dryRun := range []bool{true, false} {
+		r := NewRegistry(zap.NewNop())
+		if err := r.Register("/media/", root); err != nil {
+			t.Fatal(err)
+		}
+		r.SetRules(NewRules(DotfileRule()))
+		r.SetSidecarPolicy("/media/", NewSidecarPolicy([]string{".srt", ".nfo", ".jpg"}, []string{".mkv"}, dryRun))
+		if err := r.CleanSidecars(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+
+		got := r.Orphans()["/media/"]
+		sort.Strings(got)
+		want := []string{
+			filepath.Join(root, "Gone/tvshow.nfo"),
+			filepath.Join(root, "Show/Season 1/ep1.en.srt"),
+			filepath.Join(root, "Show/Season 1/ep1.srt"),
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("dry run %t: orphans = %v, want %v", dryRun, got, want)
+		}
+		_, err := os.Stat(want[0])
+		if dryRun != (err == nil) {
+			t.Errorf("dry run %t: stat orphan: %v", dryRun, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(root, "Gone/.hidden/old.srt")); err != nil {
+		t.Errorf("excluded sidecar was touched: %v", err)
+	}
+}
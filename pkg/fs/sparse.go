@@ -0,0 +1,56 @@
+/*
+Copyright 2020 Daniël Franke
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fs
+
+import (
+	"context"
+	"os"
+)
+
+// Extent is a range of a file holding data, the rest of a sparse file reads as
+// zeroes.
+type Extent struct {
+	Offset int64 `json:"offset"`
+	Length int64 `json:"length"`
+}
+
+// Extents returns the ranges of the file that hold data, so clients can skip
+// the holes of sparse files. Where holes can't be found the whole file is one
+// extent.
+func (fso *FilesystemObject) Extents(ctx context.Context) ([]Extent, error) {
+	f, err := fso.Open(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return dataExtents(ctx, f, fso.Size)
+}
+
+// wholeFile is the single extent of a file without holes.
+func wholeFile(size int64) []Extent {
+	if size == 0 {
+		return []Extent{}
+	}
+	return []Extent{{Offset: 0, Length: size}}
+}
+
+// allocatedSize returns how many bytes of the file info is of are allocated on
+// disk, if known.
+func allocatedSize(info os.FileInfo) (int64, bool) {
+	blocks, ok := statBlocks(info)
+	return blocks * 512, ok //nolint:gomnd // st_blocks is in 512 byte units.
+}
@@ -0,0 +1,60 @@
+/*
+Copyright 2020 Daniël Franke
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fs
+
+import (
+	"context"
+	"errors"
+	"os"
+	"syscall"
+)
+
+// Whence values for finding data and holes, see lseek(2).
+const (
+	seekData = 3
+	seekHole = 4
+)
+
+// dataExtents finds the data ranges of f by seeking from data to hole.
+func dataExtents(ctx context.Context, f *os.File, size int64) ([]Extent, error) {
+	extents := []Extent{}
+	var off int64
+	for off < size {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		start, err := f.Seek(off, seekData)
+		if errors.Is(err, syscall.ENXIO) {
+			// Only a hole is left.
+			break
+		}
+		if errors.Is(err, syscall.EINVAL) {
+			// The filesystem doesn't know about holes.
+			return wholeFile(size), nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		end, err := f.Seek(start, seekHole)
+		if err != nil {
+			return nil, err
+		}
+		extents = append(extents, Extent{Offset: start, Length: end - start})
+		off = end
+	}
+	return extents, nil
+}
@@ -0,0 +1,52 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd
+// +build linux darwin freebsd netbsd openbsd
+
+/*
+Copyright 2020 Daniël Franke
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fs
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// fileOwner returns the uid and gid of the file info is of.
+func fileOwner(info os.FileInfo) (uint32, uint32) {
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		return st.Uid, st.Gid
+	}
+	return 0, 0
+}
+
+// fileID identifies the file info is of by device and inode, so it's the same
+// after a rename or move within the filesystem.
+func fileID(info os.FileInfo) string {
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		return fmt.Sprintf("%x-%x", uint64(st.Dev), uint64(st.Ino)) //nolint:unconvert // Types differ per OS.
+	}
+	return ""
+}
+
+// statBlocks returns the number of 512 byte blocks allocated for the file info
+// is of, if known.
+func statBlocks(info os.FileInfo) (int64, bool) {
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		return st.Blocks, true
+	}
+	return 0, false
+}
@@ -0,0 +1,101 @@
+/*
+Copyright 2020 Daniël Franke
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fs
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// SetSymlinks makes the root at servePath expose symlinks pointing inside it,
+// instead of serving them as the files they point to. Links to directories
+// aren't followed then.
+func (r *Registry) SetSymlinks(servePath string) {
+	if fso, ok := r.pathFSO[servePath]; ok {
+		fso.Lock()
+		fso.linkRoot = filepath.Clean(fso.Path)
+		fso.Unlock()
+	}
+}
+
+// linkTarget returns the target of the symlink at p relative to the directory
+// it is in, if the link stays inside the root. Other links are followed.
+func (fso *FilesystemObject) linkTarget(p string) string {
+	target, err := os.Readlink(p)
+	if err != nil {
+		fso.logger.Info("couldn't read link", zap.String(PathKey, p), zap.Error(err))
+		return ""
+	}
+	dir := filepath.Dir(p)
+	abs := target
+	if !filepath.IsAbs(abs) {
+		abs = filepath.Join(dir, target)
+	}
+	if abs != fso.linkRoot && !strings.HasPrefix(abs, fso.linkRoot+string(filepath.Separator)) {
+		return ""
+	}
+	rel, err := filepath.Rel(dir, abs)
+	if err != nil {
+		return ""
+	}
+	return filepath.ToSlash(rel)
+}
+
+// Links returns the symlinks of the roots exposing them, from the last scan.
+// Roots that were never scanned are scanned first.
+func (r *Registry) Links(ctx context.Context) ([]*WebObject, error) {
+	links := make([]*WebObject, 0)
+	for p, root := range r.pathFSO {
+		if root.linkRoot == "" {
+			continue
+		}
+		if root.scannedAt().IsZero() {
+			if !r.available(ctx, p, root) {
+				return nil, ErrRootUnavailable
+			}
+			if err := r.guard(ctx, p, scanTimeout, root.Scan); err != nil {
+				return nil, err
+			}
+		}
+		for _, l := range root.links() {
+			links = append(links, newWebObject(p, root.Path, l))
+		}
+	}
+	return links, nil
+}
+
+// links returns the exposed symlinks under the FSO, skipping excluded ones.
+func (fso *FilesystemObject) links() []*FilesystemObject {
+	r := make([]*FilesystemObject, 0)
+	for _, f := range fso.children() {
+		if fso.rules.Excludes(f) {
+			continue
+		}
+		if f.LinkTarget != "" {
+			r = append(r, f)
+			continue
+		}
+		if f.IsDir {
+			r = append(r, f.links()...)
+		}
+	}
+	return r
+}
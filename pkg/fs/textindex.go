@@ -0,0 +1,122 @@
+/*
+Copyright 2020 Daniël Franke
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fs
+
+import (
+	"context"
+	"io/ioutil"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// TextMatch is a file whose content matched a query, with the matching line.
+type TextMatch struct {
+	*WebObject
+	Line string `json:"line"`
+}
+
+type textEntry struct {
+	size    int64
+	modTime time.Time
+	lines   []string
+}
+
+// TextIndex keeps the contents of small text sidecars (subtitles, nfo files)
+// in memory, so they can be searched. Entries are refreshed when the size or
+// modification time of a file changes.
+type TextIndex struct {
+	extensions map[string]bool
+	maxSize    int64
+	entries    map[string]*textEntry
+	logger     *zap.Logger
+	sync.Mutex
+}
+
+// NewTextIndex creates a TextIndex for files with the given extensions that are
+// at most maxSize bytes.
+func NewTextIndex(extensions []string, maxSize int64, logger *zap.Logger) *TextIndex {
+	ext := make(map[string]bool, len(extensions))
+	for _, e := range extensions {
+		ext[strings.ToLower(e)] = true
+	}
+	return &TextIndex{
+		extensions: ext,
+		maxSize:    maxSize,
+		entries:    make(map[string]*textEntry),
+		logger:     logger,
+	}
+}
+
+// Search returns the indexable files containing q, case-insensitively. It stops
+// early when ctx is cancelled.
+func (ti *TextIndex) Search(ctx context.Context, files []*WebObject, q string) ([]*TextMatch, error) {
+	ti.Lock()
+	defer ti.Unlock()
+
+	q = strings.ToLower(q)
+	seen := make(map[string]bool, len(ti.entries))
+	r := make([]*TextMatch, 0)
+	for _, f := range files {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if f.Size > ti.maxSize || !ti.extensions[strings.ToLower(path.Ext(f.Path))] {
+			continue
+		}
+		seen[f.Path] = true
+		e := ti.entry(f)
+		if e == nil {
+			continue
+		}
+		for _, l := range e.lines {
+			if strings.Contains(strings.ToLower(l), q) {
+				r = append(r, &TextMatch{WebObject: f, Line: strings.TrimSpace(l)})
+				break
+			}
+		}
+	}
+
+	// Drop files that disappeared.
+	for p := range ti.entries {
+		if !seen[p] {
+			delete(ti.entries, p)
+		}
+	}
+	return r, nil
+}
+
+// entry returns the up to date entry for f, or nil if it can't be read.
+func (ti *TextIndex) entry(f *WebObject) *textEntry {
+	e, ok := ti.entries[f.Path]
+	if ok && e.size == f.Size && e.modTime.Equal(f.ModTime) {
+		return e
+	}
+	ti.logger.Debug("indexing text file", zap.String(PathKey, f.Path))
+	b, err := ioutil.ReadFile(f.Path)
+	if err != nil {
+		ti.logger.Info("couldn't index text file", zap.String(PathKey, f.Path), zap.Error(err))
+		delete(ti.entries, f.Path)
+		return nil
+	}
+	e = &textEntry{size: f.Size, modTime: f.ModTime, lines: strings.Split(string(b), "\n")}
+	ti.entries[f.Path] = e
+	return e
+}
@@ -0,0 +1,38 @@
+/*
+Copyright 2020 Daniël Franke
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fs
+
+import "syscall"
+
+// getxattr returns the value of the extended attribute name of the file at p.
+func getxattr(p, name string) (string, error) {
+	size, err := syscall.Getxattr(p, name, nil)
+	if err != nil {
+		return "", err
+	}
+	buf := make([]byte, size)
+	n, err := syscall.Getxattr(p, name, buf)
+	if err != nil {
+		return "", err
+	}
+	return string(buf[:n]), nil
+}
+
+// setxattr sets the extended attribute name of the file at p.
+func setxattr(p, name, value string) error {
+	return syscall.Setxattr(p, name, []byte(value), 0)
+}
@@ -0,0 +1,77 @@
+/*
+Copyright 2020 Daniël Franke
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package httputil
+
+import (
+	"crypto/md5"  //nolint:gosec // Only offered for old clients.
+	"crypto/sha1" //nolint:gosec // Only offered for old clients.
+	"crypto/sha256"
+	"crypto/sha512"
+	"errors"
+	"fmt"
+	"hash"
+	"net/http"
+	"strings"
+)
+
+// DefaultChecksumAlgo is used when the client doesn't ask for anything else.
+const DefaultChecksumAlgo = "sha256"
+
+// ErrNoAcceptableChecksum communicates that none of the algorithms a client
+// accepts is allowed.
+var ErrNoAcceptableChecksum = errors.New("no acceptable checksum algorithm")
+
+// checksumAlgos are the algorithms we know, by the name clients use.
+var checksumAlgos = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+}
+
+// NewChecksum returns a new hash for algo.
+func NewChecksum(algo string) (hash.Hash, error) {
+	h, ok := checksumAlgos[algo]
+	if !ok {
+		return nil, fmt.Errorf("unknown checksum algorithm %q", algo)
+	}
+	return h(), nil
+}
+
+// NegotiateChecksum returns the first algorithm in the ChecksumAlgoHeader of r,
+// a comma separated list in order of preference, that is also allowed. Without
+// the header the first allowed algorithm is used, or the default when there are
+// none. It fails with ErrNoAcceptableChecksum when nothing the client accepts
+// is allowed.
+func NegotiateChecksum(r *http.Request, allowed []string) (string, error) {
+	if len(allowed) == 0 {
+		allowed = []string{DefaultChecksumAlgo}
+	}
+	accepted := r.Header.Get(ChecksumAlgoHeader)
+	if strings.TrimSpace(accepted) == "" {
+		return allowed[0], nil
+	}
+	for _, a := range strings.Split(accepted, ",") {
+		a = strings.ToLower(strings.TrimSpace(a))
+		for _, ok := range allowed {
+			if a == ok {
+				return a, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("%w, use one of %s", ErrNoAcceptableChecksum, strings.Join(allowed, ", "))
+}
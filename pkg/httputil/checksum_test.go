@@ -0,0 +1,51 @@
+/*
+Copyright 2020 Daniël Franke
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package httputil
+
+import (
+	"errors"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNegotiateChecksum(t *testing.T) {
+	tests := []struct {
+		name    string
+		header  string
+		allowed []string
+		want    string
+		err     error
+	}{
+		{"no header", "", []string{"sha1", "sha256"}, "sha1", nil},
+		{"nothing allowed", "", nil, DefaultChecksumAlgo, nil},
+		{"preference", "md5, SHA256,sha1", []string{"sha1", "sha256"}, "sha256", nil},
+		{"no match", "md5", []string{"sha256"}, "", ErrNoAcceptableChecksum},
+		{"default not accepted", "sha1", nil, "", ErrNoAcceptableChecksum},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			if tt.header != "" {
+				r.Header.Set(ChecksumAlgoHeader, tt.header)
+			}
+			got, err := NegotiateChecksum(r, tt.allowed)
+			if got != tt.want || !errors.Is(err, tt.err) {
+				t.Errorf("NegotiateChecksum() = %q, %v, want %q, %v", got, err, tt.want, tt.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,72 @@
+/*
+Copyright 2020 Daniël Franke
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package httputil
+
+import (
+	"net/http"
+	"strings"
+	"time"
+)
+
+// MatchesETag reports whether an If-Match header value matches etag, using
+// strong comparison as RFC 7232 requires, so weak tags never match.
+func MatchesETag(ifMatch, etag string) bool {
+	for _, t := range strings.Split(ifMatch, ",") {
+		t = strings.TrimSpace(t)
+		if t == "*" || (t == etag && !strings.HasPrefix(t, "W/")) {
+			return true
+		}
+	}
+	return false
+}
+
+// NotModified sets the ETag and Last-Modified headers, and answers with 304 Not
+// Modified when the conditional headers of r show the client is up to date.
+// If-None-Match takes precedence over If-Modified-Since, as RFC 7232 requires.
+func NotModified(w http.ResponseWriter, r *http.Request, etag string, modTime time.Time) bool {
+	w.Header().Set("ETag", etag)
+	if !modTime.IsZero() {
+		w.Header().Set("Last-Modified", modTime.UTC().Format(http.TimeFormat))
+	}
+	if r.Method != "GET" && r.Method != "HEAD" {
+		return false
+	}
+
+	notModified := false
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		notModified = matchesWeak(inm, etag)
+	} else if ims, err := http.ParseTime(r.Header.Get("If-Modified-Since")); err == nil && !modTime.IsZero() {
+		// HTTP dates have second precision.
+		notModified = !modTime.Truncate(time.Second).After(ims)
+	}
+	if notModified {
+		w.WriteHeader(http.StatusNotModified)
+	}
+	return notModified
+}
+
+// matchesWeak compares If-None-Match with etag using weak comparison.
+func matchesWeak(ifNoneMatch, etag string) bool {
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, t := range strings.Split(ifNoneMatch, ",") {
+		t = strings.TrimSpace(t)
+		if t == "*" || strings.TrimPrefix(t, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
@@ -17,5 +17,31 @@ limitations under the License.
 package httputil
 
 const (
-	JSONContentType = "application/json"
+	JSONContentType     = "application/json"
+	CBORContentType     = "application/cbor"
+	ProtobufContentType = "application/x-protobuf"
+
+	ChecksumHeader = "X-MediaServer-Checksum"
+	// ChecksumAlgoHeader carries the algorithms a client accepts in requests,
+	// and the one that was used in responses.
+	ChecksumAlgoHeader = "X-MediaServer-Checksum-Algo"
+	// DegradedHeader lists the serve paths of unavailable roots, whose files
+	// are from the last successful scan.
+	DegradedHeader = "X-MediaServer-Degraded"
+	// MTimeHeader carries the modification time of a file in RFC 3339 with
+	// nanoseconds, Last-Modified only has seconds.
+	MTimeHeader = "X-MediaServer-MTime"
+	// UploadOffsetHeader carries how much of an upload arrived, and where a
+	// chunk goes. UploadLengthHeader carries the size of the whole upload.
+	UploadOffsetHeader = "Upload-Offset"
+	UploadLengthHeader = "Upload-Length"
+	// VerifiedTrailer tells whether a served file matched its checksum, ok or
+	// failed, for clients that accept trailers.
+	VerifiedTrailer = "X-MediaServer-Verified"
+
+	// ManifestCacheControl makes caches revalidate the manifest every time.
+	ManifestCacheControl = "no-cache"
+	// DownloadCacheControl lets shared caches store files, but revalidate them
+	// as they may be replaced or deleted.
+	DownloadCacheControl = "public, max-age=0, must-revalidate"
 )
@@ -0,0 +1,107 @@
+/*
+Copyright 2020 Daniël Franke
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package httputil
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Negotiate picks the offered content type the client prefers according to its
+// Accept header. The first offer is the default when nothing better matches.
+func Negotiate(r *http.Request, offers ...string) string {
+	if len(offers) == 0 {
+		return ""
+	}
+	accept := r.Header.Get("Accept")
+	if accept == "" {
+		return offers[0]
+	}
+
+	best := offers[0]
+	bestQ := -1.0
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, q := parseAcceptPart(part)
+		for _, o := range offers {
+			if !matchesMediaType(mediaType, o) {
+				continue
+			}
+			// Exact matches win over wildcards with the same weight.
+			if q > bestQ || (q == bestQ && mediaType == o && best != o) {
+				best = o
+				bestQ = q
+			}
+		}
+	}
+	if bestQ <= 0 {
+		return offers[0]
+	}
+	return best
+}
+
+func parseAcceptPart(part string) (string, float64) {
+	fields := strings.Split(part, ";")
+	mediaType := strings.ToLower(strings.TrimSpace(fields[0]))
+	q := 1.0
+	for _, param := range fields[1:] {
+		param = strings.TrimSpace(param)
+		if !strings.HasPrefix(param, "q=") {
+			continue
+		}
+		v, err := strconv.ParseFloat(strings.TrimPrefix(param, "q="), 64)
+		if err == nil {
+			q = v
+		}
+	}
+	return mediaType, q
+}
+
+func matchesMediaType(pattern, mediaType string) bool {
+	if pattern == "*/*" || pattern == mediaType {
+		return true
+	}
+	if strings.HasSuffix(pattern, "/*") {
+		return strings.HasPrefix(mediaType, strings.TrimSuffix(pattern, "*"))
+	}
+	return false
+}
+
+// AcceptsTrailers reports whether the client said it handles trailers, with
+// "trailers" in its TE header. HTTP/2 always does.
+func AcceptsTrailers(r *http.Request) bool {
+	if r.ProtoMajor >= 2 {
+		return true
+	}
+	for _, te := range strings.Split(r.Header.Get("TE"), ",") {
+		if strings.EqualFold(strings.TrimSpace(te), "trailers") {
+			return true
+		}
+	}
+	return false
+}
+
+// AcceptsGzip reports whether the Accept-Encoding header of r allows gzip.
+func AcceptsGzip(r *http.Request) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		coding, q := parseAcceptPart(part)
+		if (coding == "gzip" || coding == "*") && q > 0 {
+			return true
+		}
+	}
+	return false
+}
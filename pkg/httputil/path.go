@@ -0,0 +1,56 @@
+/*
+Copyright 2020 Daniël Franke
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package httputil
+
+import (
+	"errors"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// ErrInvalidPath communicates that a request path can't be safely mapped to disk.
+var ErrInvalidPath = errors.New("invalid path")
+
+// SanitizePath checks a decoded URL path for anything that could escape the
+// directory it gets joined to, and returns it cleaned. It rejects NUL bytes,
+// backslashes and ".." segments instead of trying to repair them.
+func SanitizePath(p string) (string, error) {
+	if strings.ContainsRune(p, 0) || strings.ContainsRune(p, '\\') {
+		return "", ErrInvalidPath
+	}
+	for _, ent := range strings.Split(p, "/") {
+		if ent == ".." {
+			return "", ErrInvalidPath
+		}
+	}
+	return path.Clean("/" + p), nil
+}
+
+// RequestPath returns the sanitized path of the request relative to prefix.
+// Separators that were percent-encoded in the raw URL are rejected as well,
+// as they would otherwise be indistinguishable from real ones after decoding.
+func RequestPath(r *http.Request, prefix string) (string, error) {
+	raw := strings.ToLower(r.URL.EscapedPath())
+	if strings.Contains(raw, "%2f") || strings.Contains(raw, "%5c") || strings.Contains(raw, "%00") {
+		return "", ErrInvalidPath
+	}
+	if !strings.HasPrefix(r.URL.Path, prefix) {
+		return "", ErrInvalidPath
+	}
+	return SanitizePath(strings.TrimPrefix(r.URL.Path, prefix))
+}
@@ -0,0 +1,128 @@
+/*
+Copyright 2020 Daniël Franke
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package httputil
+
+import (
+	"errors"
+	"net/http/httptest"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestSanitizePath(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    string
+		wantErr error
+	}{
+		{"", "/", nil},
+		{"a/b.mkv", "/a/b.mkv", nil},
+		{"/a//b/./c.mkv", "/a/b/c.mkv", nil},
+		{"/a/b/", "/a/b", nil},
+		{"/a/..b/c", "/a/..b/c", nil},
+		{"/a/b..", "/a/b..", nil},
+		{"/a/../b", "", ErrInvalidPath},
+		{"..", "", ErrInvalidPath},
+		{"/a/..", "", ErrInvalidPath},
+		{`/a\..\b`, "", ErrInvalidPath},
+		{"/a\x00b", "", ErrInvalidPath},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := SanitizePath(tt.in)
+			if !errors.Is(err, tt.wantErr) || got != tt.want {
+				t.Errorf("SanitizePath(%q) = %q, %v, want %q, %v", tt.in, got, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
+
+// sanitizeCorpus returns every sequence of up to depth fragments, the pieces
+// traversal attempts are made of.
+func sanitizeCorpus(depth int) []string {
+	fragments := []string{"", "/", "//", ".", "..", "...", "a", "a..", "..a", "./", "../", "\\", "\x00", "%2e", " "}
+	corpus := []string{""}
+	last := []string{""}
+	for i := 0; i < depth; i++ {
+		var next []string
+		for _, prefix := range last {
+			for _, f := range fragments {
+				next = append(next, prefix+f)
+			}
+		}
+		corpus = append(corpus, next...)
+		last = next
+	}
+	return corpus
+}
+
+func TestSanitizePathCorpus(t *testing.T) {
+	for _, in := range sanitizeCorpus(4) {
+		got, err := SanitizePath(in)
+		if err != nil {
+			if !errors.Is(err, ErrInvalidPath) {
+				t.Errorf("SanitizePath(%q) failed with %v, want %v", in, err, ErrInvalidPath)
+			}
+			continue
+		}
+		if !strings.HasPrefix(got, "/") {
+			t.Errorf("SanitizePath(%q) = %q, doesn't start with /", in, got)
+		}
+		for _, seg := range strings.Split(got, "/") {
+			if seg == ".." {
+				t.Errorf("SanitizePath(%q) = %q, has a .. segment", in, got)
+			}
+		}
+		if strings.ContainsAny(got, "\\\x00") {
+			t.Errorf("SanitizePath(%q) = %q, has a backslash or NUL", in, got)
+		}
+		if got != path.Clean(got) {
+			t.Errorf("SanitizePath(%q) = %q, isn't clean", in, got)
+		}
+		if joined := path.Join("/root", got); joined != "/root" && !strings.HasPrefix(joined, "/root/") {
+			t.Errorf("SanitizePath(%q) = %q, escapes the root as %q", in, got, joined)
+		}
+	}
+}
+
+func TestRequestPath(t *testing.T) {
+	tests := []struct {
+		url     string
+		prefix  string
+		want    string
+		wantErr error
+	}{
+		{"/files/a/b.mkv", "/files/", "/a/b.mkv", nil},
+		{"/files/a%20b.mkv", "/files/", "/a b.mkv", nil},
+		{"/files/", "/files/", "/", nil},
+		{"/other/a.mkv", "/files/", "", ErrInvalidPath},
+		{"/files/a%2F..%2Fb", "/files/", "", ErrInvalidPath},
+		{"/files/a%2fb", "/files/", "", ErrInvalidPath},
+		{"/files/a%5Cb", "/files/", "", ErrInvalidPath},
+		{"/files/a%00b", "/files/", "", ErrInvalidPath},
+		{"/files/a/%2E%2E/b", "/files/", "", ErrInvalidPath},
+	}
+	for _, tt := range tests {
+		t.Run(tt.url, func(t *testing.T) {
+			got, err := RequestPath(httptest.NewRequest("GET", tt.url, nil), tt.prefix)
+			if !errors.Is(err, tt.wantErr) || got != tt.want {
+				t.Errorf("RequestPath(%q, %q) = %q, %v, want %q, %v", tt.url, tt.prefix, got, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
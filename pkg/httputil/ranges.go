@@ -0,0 +1,100 @@
+/*
+Copyright 2020 Daniël Franke
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package httputil
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// MaxRanges is the most ranges a single request may ask for.
+const MaxRanges = 16
+
+var (
+	// ErrRangeSyntax communicates that a Range header can't be parsed, such
+	// headers are ignored and the whole file is served.
+	ErrRangeSyntax = errors.New("invalid range")
+
+	// ErrRangeUnsatisfiable communicates that no range of a Range header is in
+	// the file, or that there are too many.
+	ErrRangeUnsatisfiable = errors.New("range not satisfiable")
+)
+
+// ByteRange is a range of bytes of a file, Length bytes from Start.
+type ByteRange struct {
+	Start  int64
+	Length int64
+}
+
+// ParseRange parses a Range header for a file of size bytes, as RFC 7233
+// describes. Ranges that start beyond the end of the file are dropped.
+func ParseRange(header string, size int64) ([]ByteRange, error) {
+	if !strings.HasPrefix(header, "bytes=") {
+		return nil, ErrRangeSyntax
+	}
+	specs := strings.Split(strings.TrimPrefix(header, "bytes="), ",")
+	if len(specs) > MaxRanges {
+		return nil, ErrRangeUnsatisfiable
+	}
+	ranges := make([]ByteRange, 0, len(specs))
+	for _, spec := range specs {
+		spec = strings.TrimSpace(spec)
+		i := strings.Index(spec, "-")
+		if i < 0 {
+			return nil, ErrRangeSyntax
+		}
+		first, last := strings.TrimSpace(spec[:i]), strings.TrimSpace(spec[i+1:])
+		if first == "" {
+			// A suffix range, the last n bytes.
+			n, err := strconv.ParseInt(last, 10, 64)
+			if err != nil || n < 0 {
+				return nil, ErrRangeSyntax
+			}
+			if n == 0 {
+				continue
+			}
+			if n > size {
+				n = size
+			}
+			ranges = append(ranges, ByteRange{Start: size - n, Length: n})
+			continue
+		}
+		start, err := strconv.ParseInt(first, 10, 64)
+		if err != nil || start < 0 {
+			return nil, ErrRangeSyntax
+		}
+		end := size - 1
+		if last != "" {
+			end, err = strconv.ParseInt(last, 10, 64)
+			if err != nil || end < start {
+				return nil, ErrRangeSyntax
+			}
+			if end >= size {
+				end = size - 1
+			}
+		}
+		if start >= size {
+			continue
+		}
+		ranges = append(ranges, ByteRange{Start: start, Length: end - start + 1})
+	}
+	if len(ranges) == 0 {
+		return nil, ErrRangeUnsatisfiable
+	}
+	return ranges, nil
+}
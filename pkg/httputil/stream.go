@@ -0,0 +1,47 @@
+/*
+Copyright 2020 Daniël Franke
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package httputil
+
+import (
+	"encoding/hex"
+	"io"
+	"net/http"
+)
+
+// StreamResponse streams a body generated by gen, without knowing its length
+// up front. The checksum of the body, using algo, is computed while streaming
+// and sent in the ChecksumHeader trailer, so clients can still verify what they
+// received. Errors from gen can't be sent to the client anymore, so they're
+// returned for logging and no trailer is sent.
+func StreamResponse(w http.ResponseWriter, contentType, algo string, statusCode int, gen func(io.Writer) error) error {
+	h, err := NewChecksum(algo)
+	if err != nil {
+		ErrResponse(w, err, http.StatusInternalServerError)
+		return err
+	}
+	w.Header().Add("content-type", contentType)
+	w.Header().Set(ChecksumAlgoHeader, algo)
+	w.Header().Add("Trailer", ChecksumHeader)
+	w.WriteHeader(statusCode)
+
+	err = gen(io.MultiWriter(w, h))
+	if err != nil {
+		return err
+	}
+	w.Header().Set(ChecksumHeader, hex.EncodeToString(h.Sum(nil)))
+	return nil
+}
@@ -0,0 +1,185 @@
+/*
+Copyright 2020 Daniël Franke
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package logging builds the server logger, and manages the files it logs to.
+package logging
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// backupTimeFormat is appended to the name of rotated files, it sorts by time.
+const backupTimeFormat = "2006-01-02T15-04-05.000"
+
+// File is a log file that rotates itself when it gets too big or too old, and
+// can be reopened after something else moved it, like logrotate.
+type File struct {
+	path string
+	// maxSize and maxAge trigger a rotation, zero disables either.
+	maxSize int64
+	maxAge  time.Duration
+	// maxBackups is how many rotated files are kept, zero keeps all.
+	maxBackups int
+
+	mu     sync.Mutex
+	f      *os.File
+	size   int64
+	opened time.Time
+}
+
+// OpenFile opens the log file at path for appending, creating it if needed.
+func OpenFile(path string, maxSize int64, maxAge time.Duration, maxBackups int) (*File, error) {
+	lf := &File{path: path, maxSize: maxSize, maxAge: maxAge, maxBackups: maxBackups}
+	if err := lf.open(); err != nil {
+		return nil, err
+	}
+	return lf, nil
+}
+
+func (lf *File) open() error {
+	f, err := os.OpenFile(lf.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o640)
+	if err != nil {
+		return fmt.Errorf("couldn't open log file %s: %w", lf.path, err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("couldn't stat log file %s: %w", lf.path, err)
+	}
+	lf.f = f
+	lf.size = info.Size()
+	lf.opened = time.Now()
+	return nil
+}
+
+// Write writes an entry, rotating the file first if the entry wouldn't fit.
+func (lf *File) Write(p []byte) (int, error) {
+	lf.mu.Lock()
+	defer lf.mu.Unlock()
+	if lf.due(int64(len(p))) {
+		if err := lf.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := lf.f.Write(p)
+	lf.size += int64(n)
+	return n, err
+}
+
+// due reports whether writing n more bytes needs a rotation first. An empty
+// file is never rotated, so a single big entry doesn't rotate every time.
+func (lf *File) due(n int64) bool {
+	if lf.size == 0 {
+		return false
+	}
+	if lf.maxSize > 0 && lf.size+n > lf.maxSize {
+		return true
+	}
+	return lf.maxAge > 0 && time.Since(lf.opened) > lf.maxAge
+}
+
+// rotate moves the current file aside, opens a new one and removes backups we
+// don't keep.
+func (lf *File) rotate() error {
+	if err := lf.f.Close(); err != nil {
+		return err
+	}
+	backup := lf.path + "." + time.Now().Format(backupTimeFormat)
+	if err := os.Rename(lf.path, backup); err != nil {
+		return fmt.Errorf("couldn't rotate log file %s: %w", lf.path, err)
+	}
+	if err := lf.open(); err != nil {
+		return err
+	}
+	return lf.prune()
+}
+
+// prune removes the oldest backups beyond maxBackups.
+func (lf *File) prune() error {
+	if lf.maxBackups <= 0 {
+		return nil
+	}
+	backups, err := filepath.Glob(lf.path + ".*")
+	if err != nil {
+		return err
+	}
+	sort.Strings(backups)
+	for len(backups) > lf.maxBackups {
+		if err := os.Remove(backups[0]); err != nil {
+			return err
+		}
+		backups = backups[1:]
+	}
+	return nil
+}
+
+// Reopen closes the file and opens it at its path again, for when it was moved
+// by something else.
+func (lf *File) Reopen() error {
+	lf.mu.Lock()
+	defer lf.mu.Unlock()
+	if err := lf.f.Close(); err != nil {
+		return err
+	}
+	return lf.open()
+}
+
+// ReopenOn reopens the file whenever one of sigs is received, the signals are
+// usually SIGHUP.
+func (lf *File) ReopenOn(logger *zap.Logger, sigs ...os.Signal) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, sigs...)
+	go func() {
+		for range c {
+			if err := lf.Reopen(); err != nil {
+				logger.Error("couldn't reopen log file", zap.String("path", lf.path), zap.Error(err))
+				continue
+			}
+			logger.Info("reopened log file", zap.String("path", lf.path))
+		}
+	}()
+}
+
+// Sync flushes the file to disk.
+func (lf *File) Sync() error {
+	lf.mu.Lock()
+	defer lf.mu.Unlock()
+	return lf.f.Sync()
+}
+
+// New returns a production logger writing JSON to stderr and files, it writes
+// to stderr anyway when there's nowhere else to write.
+func New(stderr bool, files ...*File) *zap.Logger {
+	enc := zapcore.NewJSONEncoder(zap.NewProductionEncoderConfig())
+	level := zap.NewAtomicLevelAt(zap.InfoLevel)
+	cores := make([]zapcore.Core, 0, len(files)+1)
+	if stderr || len(files) == 0 {
+		cores = append(cores, zapcore.NewCore(enc, zapcore.Lock(os.Stderr), level))
+	}
+	for _, f := range files {
+		cores = append(cores, zapcore.NewCore(enc.Clone(), f, level))
+	}
+	return zap.New(zapcore.NewTee(cores...), zap.AddCaller(), zap.AddStacktrace(zap.ErrorLevel))
+}
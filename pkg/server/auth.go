@@ -0,0 +1,180 @@
+/*
+Copyright 2020 Daniël Franke
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/ainmosni/mediasync-server/pkg/fs"
+	"github.com/ainmosni/mediasync-server/pkg/httputil"
+	"github.com/ainmosni/mediasync-server/pkg/tokens"
+	"go.uber.org/zap"
+)
+
+// claimsKey is the context key of the claims a request was authorized with.
+type claimsKey struct{}
+
+// TokenAuth wraps handlers to require a token in the Authorization header as
+// a bearer token. That's either a static token, allowing everything, or a
+// scoped token, see package tokens.
+type TokenAuth struct {
+	secret []byte
+	// static are the SHA-256 sums of the static tokens, so comparing them
+	// takes the same time whatever their length.
+	static [][sha256.Size]byte
+	logger *zap.Logger
+}
+
+// NewTokenAuth creates a new TokenAuth verifying tokens signed with secret, an
+// empty secret only accepts static tokens.
+func NewTokenAuth(secret []byte, logger *zap.Logger) *TokenAuth {
+	logger.Info("requiring tokens")
+	return &TokenAuth{
+		secret: secret,
+		logger: logger,
+	}
+}
+
+// AddTokens adds static tokens, which allow every request.
+func (ta *TokenAuth) AddTokens(tokens ...string) {
+	for _, t := range tokens {
+		ta.static = append(ta.static, sha256.Sum256([]byte(t)))
+	}
+}
+
+// ReadTokenFile reads static tokens from a file with one per line, ignoring
+// empty lines and lines starting with #.
+func ReadTokenFile(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var tokens []string
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		tokens = append(tokens, line)
+	}
+	return tokens, s.Err()
+}
+
+// isStatic reports whether token is one of the static tokens.
+func (ta *TokenAuth) isStatic(token string) bool {
+	sum := sha256.Sum256([]byte(token))
+	found := 0
+	for i := range ta.static {
+		found |= subtle.ConstantTimeCompare(sum[:], ta.static[i][:])
+	}
+	return found == 1
+}
+
+// Wrap returns h requiring a token, a nil TokenAuth returns h as is.
+func (ta *TokenAuth) Wrap(h http.Handler) http.Handler {
+	if ta == nil {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		logger := ta.logger.With(zap.String("path", r.URL.Path), zap.String("method", r.Method))
+
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if token == "" || token == r.Header.Get("Authorization") {
+			logger.Info("missing token")
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			httputil.ErrResponse(w, errors.New("token required"), http.StatusUnauthorized)
+			return
+		}
+		if ta.isStatic(token) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		claims, err := ta.verify(token)
+		if err != nil {
+			logger.Info("rejected token", zap.Error(err))
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			httputil.ErrResponse(w, err, http.StatusUnauthorized)
+			return
+		}
+		if !claims.Allows(r.Method, r.URL.Path) {
+			logger.Info("token not valid for request")
+			httputil.ErrResponse(w, errors.New("token not valid for this request"), http.StatusForbidden)
+			return
+		}
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), claimsKey{}, claims)))
+	})
+}
+
+// claimsFrom returns the claims of the scoped token a request was authorized
+// with, for handlers acting on other paths than the request's. It's nil for
+// static tokens and without authentication, which allow everything.
+func claimsFrom(ctx context.Context) *tokens.Claims {
+	claims, _ := ctx.Value(claimsKey{}).(*tokens.Claims)
+	return claims
+}
+
+// scopedFiles returns the files of a listing the token of the request allows,
+// listings are served from one path but describe files under many.
+func scopedFiles(ctx context.Context, files []*fs.WebObject) []*fs.WebObject {
+	claims := claimsFrom(ctx)
+	if claims == nil {
+		return files
+	}
+	r := make([]*fs.WebObject, 0, len(files))
+	for _, f := range files {
+		if claims.AllowsPath(f.WebPath) {
+			r = append(r, f)
+		}
+	}
+	return r
+}
+
+// allowsPath reports whether the token of the request allows webPath, for
+// handlers taking paths from the query or body.
+func allowsPath(ctx context.Context, webPath string) bool {
+	claims := claimsFrom(ctx)
+	return claims == nil || claims.AllowsPath(path.Clean("/"+webPath))
+}
+
+// scopeKey tells apart the scopes of cached listings, empty when everything
+// is allowed.
+func scopeKey(ctx context.Context) string {
+	claims := claimsFrom(ctx)
+	if claims == nil || len(claims.Paths) == 0 {
+		return ""
+	}
+	return "\x00" + strings.Join(claims.Paths, "\x00")
+}
+
+// verify verifies a scoped token, there are none without a secret.
+func (ta *TokenAuth) verify(token string) (*tokens.Claims, error) {
+	if len(ta.secret) == 0 {
+		return nil, tokens.ErrInvalid
+	}
+	return tokens.Verify(ta.secret, token, time.Now())
+}
@@ -0,0 +1,141 @@
+/*
+Copyright 2020 Daniël Franke
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/ainmosni/mediasync-server/pkg/fs"
+	"github.com/ainmosni/mediasync-server/pkg/tags"
+	"github.com/ainmosni/mediasync-server/pkg/tokens"
+	"go.uber.org/zap"
+)
+
+func TestScopedFiles(t *testing.T) {
+	files := []*fs.WebObject{
+		{WebPath: "/files/a"},
+		{WebPath: "/files/a/x.mkv"},
+		{WebPath: "/files/ab/y.mkv"},
+		{WebPath: "/other/z.mkv"},
+	}
+	tests := []struct {
+		name   string
+		claims *tokens.Claims
+		want   []string
+	}{
+		{"unscoped", nil, []string{"/files/a", "/files/a/x.mkv", "/files/ab/y.mkv", "/other/z.mkv"}},
+		{"all paths", &tokens.Claims{}, []string{"/files/a", "/files/a/x.mkv", "/files/ab/y.mkv", "/other/z.mkv"}},
+		{"directory", &tokens.Claims{Paths: []string{"/files/a"}}, []string{"/files/a", "/files/a/x.mkv"}},
+		{"several", &tokens.Claims{Paths: []string{"/files/ab", "/other"}}, []string{"/files/ab/y.mkv", "/other/z.mkv"}},
+	}
+	listings := make(map[string][]string)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			if tt.claims != nil {
+				ctx = context.WithValue(ctx, claimsKey{}, tt.claims)
+			}
+			got := make([]string, 0)
+			for _, f := range scopedFiles(ctx, files) {
+				got = append(got, f.WebPath)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("scopedFiles() = %v, want %v", got, tt.want)
+			}
+			// Listings of different scopes mustn't share caches.
+			key := scopeKey(ctx)
+			if other, ok := listings[key]; ok && !reflect.DeepEqual(got, other) {
+				t.Errorf("scopeKey() = %q, shared with the listing %v", key, other)
+			}
+			listings[key] = got
+		})
+	}
+}
+
+func TestTagsScope(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tags")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store, err := tags.NewStore(filepath.Join(dir, "tags.json"), zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for p, tt := range map[string][]string{"/files/a/x.mkv": {"new"}, "/other/z.mkv": {"old"}} {
+		if err := store.Set(p, tt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	h := NewTagsHandler(store, zap.NewNop())
+	scoped := &tokens.Claims{Paths: []string{"/files/a"}}
+
+	tests := []struct {
+		name   string
+		claims *tokens.Claims
+		method string
+		target string
+		body   string
+		status int
+		want   string
+	}{
+		{"all unscoped", nil, "GET", "/tags", "", http.StatusOK, `{"/files/a/x.mkv":["new"],"/other/z.mkv":["old"]}`},
+		{"all scoped", scoped, "GET", "/tags", "", http.StatusOK, `{"/files/a/x.mkv":["new"]}`},
+		{"path in scope", scoped, "GET", "/tags?path=/files/a/x.mkv", "", http.StatusOK, `{"path":"/files/a/x.mkv","tags":["new"]}`},
+		{"path out of scope", scoped, "GET", "/tags?path=/other/z.mkv", "", http.StatusForbidden, ""},
+		{"path escaping scope", scoped, "GET", "/tags?path=/files/a/../../other/z.mkv", "", http.StatusForbidden, ""},
+		{"set in scope", scoped, "PUT", "/tags", `{"path":"/files/a/y.mkv","tags":["x"]}`, http.StatusNoContent, ""},
+		{"set out of scope", scoped, "PUT", "/tags", `{"path":"/other/z.mkv","tags":["x"]}`, http.StatusForbidden, ""},
+		{"set escaping scope", scoped, "PUT", "/tags", `{"path":"/files/a/../b.mkv","tags":["x"]}`, http.StatusForbidden, ""},
+		{"set unscoped", nil, "PUT", "/tags", `{"path":"/other/y.mkv","tags":["x"]}`, http.StatusNoContent, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, tt.target, strings.NewReader(tt.body))
+			if tt.claims != nil {
+				r = r.WithContext(context.WithValue(r.Context(), claimsKey{}, tt.claims))
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			if tt.want != "" {
+				var got, want interface{}
+				if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+					t.Fatal(err)
+				}
+				_ = json.Unmarshal([]byte(tt.want), &want)
+				if !reflect.DeepEqual(got, want) {
+					t.Errorf("body = %s, want %s", w.Body, tt.want)
+				}
+			}
+		})
+	}
+	if got := store.Get("/other/z.mkv"); !reflect.DeepEqual(got, []string{"old"}) {
+		t.Errorf("tags outside the scope = %v, want them untouched", got)
+	}
+}
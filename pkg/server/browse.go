@@ -0,0 +1,92 @@
+/*
+Copyright 2020 Daniël Franke
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/ainmosni/mediasync-server/pkg/fs"
+	"github.com/ainmosni/mediasync-server/pkg/httputil"
+	"go.uber.org/zap"
+)
+
+// browseEntry is a directory entry, directories carry recursive totals.
+type browseEntry struct {
+	*fs.WebObject
+	FileCount int   `json:"file_count,omitempty"`
+	TotalSize int64 `json:"total_size,omitempty"`
+}
+
+// BrowseHandler lists a single directory, so UIs don't need the full manifest.
+type BrowseHandler struct {
+	registry *fs.Registry
+	logger   *zap.Logger
+}
+
+// NewBrowseHandler creates a new BrowseHandler.
+func NewBrowseHandler(registry *fs.Registry, logger *zap.Logger) *BrowseHandler {
+	return &BrowseHandler{
+		registry: registry,
+		logger:   logger,
+	}
+}
+
+// ServeHTTP for the BrowseHandler, lists the directory at the web path in ?path=.
+func (h *BrowseHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	logger := h.logger.With(zap.String("path", r.URL.Path), zap.String("method", r.Method))
+	logger.Info("Received HTTP request")
+	if r.Method != "GET" {
+		httputil.ErrResponse(w, errors.New("method not supported"), http.StatusMethodNotAllowed)
+		return
+	}
+
+	webPath, err := httputil.SanitizePath(r.URL.Query().Get("path"))
+	if httputil.ErrResponse(w, err, http.StatusBadRequest) {
+		return
+	}
+	files, err := h.registry.Browse(r.Context(), webPath)
+	if errors.Is(err, fs.ErrNotFound) {
+		httputil.ErrResponse(w, err, http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, fs.ErrRootUnavailable) {
+		httputil.ErrResponse(w, err, http.StatusServiceUnavailable)
+		return
+	}
+	if httputil.ErrResponse(w, err, http.StatusInternalServerError) {
+		logger.Error("couldn't browse", zap.Error(err))
+		return
+	}
+
+	files = scopedFiles(r.Context(), files)
+	entries := make([]browseEntry, 0, len(files))
+	for _, f := range files {
+		e := browseEntry{WebObject: f}
+		if f.IsDir {
+			e.FileCount, e.TotalSize = f.Summarize()
+		}
+		entries = append(entries, e)
+	}
+	b, err := json.Marshal(entries)
+	if httputil.ErrResponse(w, err, http.StatusInternalServerError) {
+		logger.Error("couldn't encode to JSON", zap.Error(err))
+		return
+	}
+	httputil.JSONResponse(w, b, http.StatusOK)
+}
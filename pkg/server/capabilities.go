@@ -0,0 +1,80 @@
+/*
+Copyright 2020 Daniël Franke
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+
+	"github.com/ainmosni/mediasync-server/pkg/httputil"
+)
+
+// Capabilities describes what the server offers, so clients can adapt to it.
+type Capabilities struct {
+	// Features are the optional subsystems, and whether they're enabled.
+	Features           map[string]bool `json:"features"`
+	ChecksumAlgorithms []string        `json:"checksum_algorithms"`
+	ManifestFormats    []string        `json:"manifest_formats"`
+	// Listeners are the addresses the server binds to, for clients picking one.
+	// See ExpandListeners.
+	Listeners []Listener `json:"listeners"`
+}
+
+// ExpandListeners replaces listeners on all addresses, like 0.0.0.0 and ::,
+// with one per address of the interfaces, as clients can't connect to the
+// wildcards. They're left out when the interfaces can't be listed.
+func ExpandListeners(listeners []Listener) ([]Listener, error) {
+	addrs, err := net.InterfaceAddrs()
+	r := expandListeners(listeners, addrs)
+	return r, err
+}
+
+func expandListeners(listeners []Listener, addrs []net.Addr) []Listener {
+	r := make([]Listener, 0, len(listeners))
+	for _, l := range listeners {
+		ip := net.ParseIP(l.Host)
+		if l.Host != "" && (ip == nil || !ip.IsUnspecified()) {
+			r = append(r, l)
+			continue
+		}
+		for _, a := range addrs {
+			ipnet, ok := a.(*net.IPNet)
+			// Link-local addresses are useless without the zone of the interface.
+			if !ok || ipnet.IP.IsLinkLocalUnicast() {
+				continue
+			}
+			v4 := ipnet.IP.To4() != nil
+			if (l.Network == "tcp4" && !v4) || (l.Network == "tcp6" && v4) {
+				continue
+			}
+			r = append(r, Listener{Network: l.Network, Host: ipnet.IP.String(), Port: l.Port})
+		}
+	}
+	return r
+}
+
+// CapabilitiesHandler serves caps as JSON.
+func CapabilitiesHandler(caps Capabilities) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		out, err := json.Marshal(caps)
+		if httputil.ErrResponse(w, err, http.StatusInternalServerError) {
+			return
+		}
+		httputil.JSONResponse(w, out, http.StatusOK)
+	})
+}
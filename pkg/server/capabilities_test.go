@@ -0,0 +1,58 @@
+/*
+Copyright 2020 Daniël Franke
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestExpandListeners(t *testing.T) {
+	addrs := []net.Addr{
+		&net.IPNet{IP: net.ParseIP("127.0.0.1"), Mask: net.CIDRMask(8, 32)},
+		&net.IPNet{IP: net.ParseIP("192.0.2.10"), Mask: net.CIDRMask(24, 32)},
+		&net.IPNet{IP: net.ParseIP("2001:db8::10"), Mask: net.CIDRMask(64, 128)},
+		&net.IPNet{IP: net.ParseIP("fe80::1"), Mask: net.CIDRMask(64, 128)},
+	}
+	tests := []struct {
+		name     string
+		listener Listener
+		addrs    []net.Addr
+		want     []Listener
+	}{
+		{"specific", Listener{"tcp", "192.0.2.10", 80}, addrs, []Listener{{"tcp", "192.0.2.10", 80}}},
+		{"hostname", Listener{"tcp", "localhost", 80}, addrs, []Listener{{"tcp", "localhost", 80}}},
+		{"ipv4 wildcard", Listener{"tcp", "0.0.0.0", 80}, addrs, []Listener{
+			{"tcp", "127.0.0.1", 80}, {"tcp", "192.0.2.10", 80}, {"tcp", "2001:db8::10", 80},
+		}},
+		{"empty host", Listener{"tcp", "", 80}, addrs, []Listener{
+			{"tcp", "127.0.0.1", 80}, {"tcp", "192.0.2.10", 80}, {"tcp", "2001:db8::10", 80},
+		}},
+		{"tcp4", Listener{"tcp4", "0.0.0.0", 80}, addrs, []Listener{{"tcp4", "127.0.0.1", 80}, {"tcp4", "192.0.2.10", 80}}},
+		{"tcp6", Listener{"tcp6", "::", 80}, addrs, []Listener{{"tcp6", "2001:db8::10", 80}}},
+		{"no interfaces", Listener{"tcp", "::", 80}, nil, []Listener{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := expandListeners([]Listener{tt.listener}, tt.addrs)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("expandListeners() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
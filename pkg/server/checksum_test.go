@@ -0,0 +1,140 @@
+/*
+Copyright 2020 Daniël Franke
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ainmosni/mediasync-server/pkg/fs"
+	"github.com/ainmosni/mediasync-server/pkg/httputil"
+	"go.uber.org/zap"
+)
+
+func TestChecksumNegotiation(t *testing.T) {
+	root, err := ioutil.TempDir("", "negotiation")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	p := filepath.Join(root, "a.mkv")
+	if err := ioutil.WriteFile(p, []byte("a"), 0o640); err != nil {
+		t.Fatal(err)
+	}
+	fso, err := fs.ObjFromPath(p, false, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	checksums := fs.NewChecksums(zap.NewNop())
+	sum, err := checksums.Sum(context.Background(), fso)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := fs.NewRegistry(zap.NewNop())
+	if err := r.Register("/files/", root); err != nil {
+		t.Fatal(err)
+	}
+	algos := []string{"sha256", "sha1"}
+	fi := NewFileInfoHandler(r, nil, zap.NewNop())
+	fi.SetChecksumAlgorithms(algos)
+	fi.SetChecksums(checksums)
+	fi.lastRescan = time.Now()
+	dh := NewDownloadHandler(root, "/files/", nil, zap.NewNop())
+	dh.SetChecksumAlgorithms(algos)
+	dh.SetChecksums(checksums)
+
+	tests := []struct {
+		name   string
+		accept string
+		gzip   bool
+		status int
+		algo   string
+		sum    string
+	}{
+		{"default", "", false, http.StatusOK, "sha256", sum},
+		{"sha256", "sha256", false, http.StatusOK, "sha256", sum},
+		{"sha1", "sha1", false, http.StatusOK, "sha1", ""},
+		{"sha1 snapshot", "sha1", true, http.StatusOK, "sha1", ""},
+		{"sha256 snapshot", "sha256", true, http.StatusOK, "sha256", sum},
+		{"unknown", "md5", false, http.StatusNotAcceptable, "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/fileinfo", nil)
+			if tt.accept != "" {
+				req.Header.Set(httputil.ChecksumAlgoHeader, tt.accept)
+			}
+			if tt.gzip {
+				req.Header.Set("Accept-Encoding", "gzip")
+			}
+			w := httptest.NewRecorder()
+			fi.ServeHTTP(w, req)
+			if w.Code != tt.status {
+				t.Fatalf("manifest status = %d, want %d", w.Code, tt.status)
+			}
+			if tt.status == http.StatusOK {
+				if got := w.Header().Get(httputil.ChecksumAlgoHeader); got != tt.algo {
+					t.Errorf("manifest algorithm = %q, want %q", got, tt.algo)
+				}
+				body := w.Body.String()
+				if tt.gzip {
+					zr, err := gzip.NewReader(w.Body)
+					if err != nil {
+						t.Fatal(err)
+					}
+					b, err := ioutil.ReadAll(zr)
+					if err != nil {
+						t.Fatal(err)
+					}
+					body = string(b)
+				}
+				var files []fs.WebObject
+				if err := json.Unmarshal([]byte(body), &files); err != nil || len(files) != 1 {
+					t.Fatalf("manifest = %s, %v", body, err)
+				}
+				if files[0].Checksum != tt.sum {
+					t.Errorf("manifest checksum = %q, want %q", files[0].Checksum, tt.sum)
+				}
+			}
+
+			req = httptest.NewRequest(http.MethodGet, "/files/a.mkv", nil)
+			if tt.accept != "" {
+				req.Header.Set(httputil.ChecksumAlgoHeader, tt.accept)
+			}
+			w = httptest.NewRecorder()
+			dh.ServeHTTP(w, req)
+			if w.Code != tt.status {
+				t.Fatalf("download status = %d, want %d", w.Code, tt.status)
+			}
+			if got := w.Header().Get(httputil.ChecksumHeader); got != tt.sum {
+				t.Errorf("download checksum = %q, want %q", got, tt.sum)
+			}
+			if tt.sum != "" && w.Header().Get(httputil.ChecksumAlgoHeader) != "sha256" {
+				t.Errorf("download algorithm = %q, want sha256", w.Header().Get(httputil.ChecksumAlgoHeader))
+			}
+		})
+	}
+}
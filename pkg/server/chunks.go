@@ -0,0 +1,113 @@
+/*
+Copyright 2020 Daniël Franke
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/ainmosni/mediasync-server/pkg/fs"
+	"github.com/ainmosni/mediasync-server/pkg/httputil"
+	"go.uber.org/zap"
+)
+
+// minChunkSize keeps hash lists of large files at a sane length.
+const minChunkSize = 64 << 10
+
+// sizeUnits are the suffixes parseSize understands.
+var sizeUnits = []struct {
+	suffix string
+	factor int64
+}{
+	{"GiB", 1 << 30},
+	{"MiB", 1 << 20},
+	{"KiB", 1 << 10},
+	{"B", 1},
+}
+
+// chunkHashes is the response to ?hashes=, the hashes of consecutive chunks.
+type chunkHashes struct {
+	Algorithm string   `json:"algorithm"`
+	ChunkSize int64    `json:"chunk_size"`
+	Size      int64    `json:"size"`
+	ETag      string   `json:"etag"`
+	Hashes    []string `json:"hashes"`
+}
+
+// serveChunkHashes serves the chunk hashes of fso, for clients verifying
+// ranged downloads chunk by chunk.
+func (dh DownloadHandler) serveChunkHashes(w http.ResponseWriter, r *http.Request, fso *fs.FilesystemObject, logger *zap.Logger) {
+	chunkSize, err := parseSize(r.URL.Query().Get("hashes"))
+	if err == nil && chunkSize < minChunkSize {
+		err = errors.New("chunk size must be at least " + strconv.Itoa(minChunkSize) + " bytes")
+	}
+	if httputil.ErrResponse(w, err, http.StatusBadRequest) {
+		logger.Info("invalid chunk size", zap.Error(err))
+		return
+	}
+
+	algo, err := httputil.NegotiateChecksum(r, dh.checksumAlgos)
+	if httputil.ErrResponse(w, err, http.StatusNotAcceptable) {
+		logger.Info("no acceptable checksum algorithm", zap.Error(err))
+		return
+	}
+	h, err := httputil.NewChecksum(algo)
+	if httputil.ErrResponse(w, err, http.StatusInternalServerError) {
+		logger.Error("couldn't create checksum", zap.Error(err))
+		return
+	}
+	hashes, err := fso.ChunkHashes(r.Context(), chunkSize, h)
+	if httputil.ErrResponse(w, err, http.StatusInternalServerError) {
+		logger.Error("couldn't hash chunks", zap.Error(err))
+		return
+	}
+
+	out, err := json.Marshal(chunkHashes{
+		Algorithm: algo,
+		ChunkSize: chunkSize,
+		Size:      fso.Size,
+		ETag:      fso.ETag,
+		Hashes:    hashes,
+	})
+	if httputil.ErrResponse(w, err, http.StatusInternalServerError) {
+		logger.Error("couldn't encode to JSON", zap.Error(err))
+		return
+	}
+	w.Header().Set(httputil.ChecksumAlgoHeader, algo)
+	w.Header().Set("ETag", fso.ETag)
+	httputil.JSONResponse(w, out, http.StatusOK)
+}
+
+// parseSize parses sizes like 4MiB, 512KiB or a plain number of bytes.
+func parseSize(s string) (int64, error) {
+	factor := int64(1)
+	for _, u := range sizeUnits {
+		if strings.HasSuffix(s, u.suffix) {
+			s = strings.TrimSuffix(s, u.suffix)
+			factor = u.factor
+			break
+		}
+	}
+	n, err := strconv.ParseInt(strings.TrimSpace(s), 10, 64)
+	if err != nil || n <= 0 {
+		return 0, errors.New("invalid size: " + s)
+	}
+	return n * factor, nil
+}
@@ -17,34 +17,125 @@ limitations under the License.
 package server
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"net/http"
 	"os"
 	"path"
-	"strings"
+	"time"
 
 	"github.com/ainmosni/mediasync-server/pkg/fs"
 	"github.com/ainmosni/mediasync-server/pkg/httputil"
 	"go.uber.org/zap"
 )
 
+// rootRetryAfter is when clients should retry downloads from an unavailable root.
+const rootRetryAfter = "60"
+
 type DownloadHandler struct {
 	diskPath  string
 	servePath string
-	logger    *zap.Logger
+	rules     *fs.Rules
+	// requireIfMatch rejects DELETE requests without an If-Match header.
+	requireIfMatch bool
+	// headers are added to served files, overriding our own.
+	headers http.Header
+	// checksumAlgos are the algorithms clients may pick for chunk hashes.
+	checksumAlgos []string
+	// breaker guards looking up files, reading them isn't guarded.
+	breaker     *fs.Breaker
+	statTimeout time.Duration
+	// deleteLock is held while deleting, shared with other instances.
+	deleteLock *fs.FileLock
+	checksums  *fs.Checksums
+	// caseInsensitive matches paths ignoring case, when nothing matches exactly.
+	caseInsensitive bool
+	journal         *Journal
+	ioTuning        fs.IOTuning
+	// verify compares served files to their checksum while they're sent.
+	verify  bool
+	metrics *Metrics
+	logger  *zap.Logger
 }
 
-// NewDownloadHandler creates a new DownloadHandler
-func NewDownloadHandler(diskPath, servePath string, logger *zap.Logger) *DownloadHandler {
+// NewDownloadHandler creates a new DownloadHandler, nil rules are the defaults.
+func NewDownloadHandler(diskPath, servePath string, rules *fs.Rules, logger *zap.Logger) *DownloadHandler {
 	logger = logger.With(zap.String("serve_path", servePath), zap.String("disk_path", diskPath))
 	logger.Info("Starting download handler")
 	return &DownloadHandler{
 		diskPath:  diskPath,
 		servePath: servePath,
+		rules:     rules,
 		logger:    logger,
 	}
 }
 
+// RequireIfMatch makes DELETE requests fail unless they carry the ETag of the
+// file they mean to delete in If-Match.
+func (dh *DownloadHandler) RequireIfMatch() {
+	dh.requireIfMatch = true
+}
+
+// SetHeaders sets extra response headers for served files, e.g. to override
+// Cache-Control for a CDN.
+func (dh *DownloadHandler) SetHeaders(headers map[string]string) {
+	dh.headers = make(http.Header, len(headers))
+	for k, v := range headers {
+		dh.headers.Set(k, v)
+	}
+}
+
+// SetChecksumAlgorithms sets the checksum algorithms clients can choose from,
+// the first one is the default.
+func (dh *DownloadHandler) SetChecksumAlgorithms(algos []string) {
+	dh.checksumAlgos = algos
+}
+
+// SetBreaker guards looking up files with the breaker of the root.
+func (dh *DownloadHandler) SetBreaker(b *fs.Breaker, statTimeout time.Duration) {
+	dh.breaker = b
+	dh.statTimeout = statTimeout
+}
+
+// SetDeleteLock makes deletes hold lock, so they don't race cleanups by other
+// instances serving the same storage.
+func (dh *DownloadHandler) SetDeleteLock(lock *fs.FileLock) {
+	dh.deleteLock = lock
+}
+
+// SetChecksums makes served files carry their checksum when it's known, files
+// without one are hashed in the background instead of delaying the download.
+func (dh *DownloadHandler) SetChecksums(c *fs.Checksums) {
+	dh.checksums = c
+}
+
+// SetCaseInsensitive makes paths that only match ignoring case find files.
+func (dh *DownloadHandler) SetCaseInsensitive() {
+	dh.caseInsensitive = true
+}
+
+// SetJournal records what clients fetch of files in j.
+func (dh *DownloadHandler) SetJournal(j *Journal) {
+	dh.journal = j
+}
+
+// VerifyDownloads hashes complete files while they're served, and compares
+// them to their known checksum, see SetChecksums.
+func (dh *DownloadHandler) VerifyDownloads() {
+	dh.verify = true
+}
+
+// SetIOTuning tunes reading served files, see fs.IOTuning.
+func (dh *DownloadHandler) SetIOTuning(t fs.IOTuning) {
+	dh.ioTuning = t
+}
+
+// SetMetrics counts the downloads and deletes in m.
+func (dh *DownloadHandler) SetMetrics(m *Metrics) {
+	dh.metrics = m
+}
+
 // ServeHTTP for the DownloadHandler, mostly checks if the file exists, and then
 // routes it based on method.
 func (dh DownloadHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -52,15 +143,39 @@ func (dh DownloadHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	logger.Info("Received HTTP request")
 
 	// Check for any directory traversal problems.
-	if containsDotDot(r.URL.Path) {
-		httputil.ErrResponse(w, errors.New("invalid path"), http.StatusBadRequest)
+	reqPath, err := httputil.RequestPath(r, dh.servePath)
+	if httputil.ErrResponse(w, err, http.StatusBadRequest) {
+		logger.Info("rejected path", zap.Error(err))
+		return
 	}
 
-	diskPath := path.Join(dh.diskPath, strings.TrimPrefix(r.URL.Path, dh.servePath))
-	fso, err := fs.ObjFromPath(diskPath, false, dh.logger)
+	diskPath := path.Join(dh.diskPath, reqPath)
+	var fso *fs.FilesystemObject
+	err = dh.breaker.Do(r.Context(), dh.statTimeout, func(context.Context) error {
+		var err error
+		fso, err = fs.ObjFromPath(diskPath, false, dh.logger)
+		if err != nil && dh.caseInsensitive && os.IsNotExist(errors.Unwrap(err)) {
+			folded, ferr := fs.ResolveFold(dh.diskPath, reqPath)
+			if ferr != nil {
+				return err
+			}
+			fso, err = fs.ObjFromPath(folded, false, dh.logger)
+		}
+		return err
+	})
 
 	if err != nil {
 		logger.Error("couldn't serve file", zap.Error(err))
+		if errors.Is(err, fs.ErrTimeout) || errors.Is(err, fs.ErrCircuitOpen) {
+			w.Header().Set("Retry-After", rootRetryAfter)
+			httputil.ErrResponse(w, fs.ErrRootUnavailable, http.StatusServiceUnavailable)
+			return
+		}
+		if !fs.RootAvailable(dh.diskPath) {
+			w.Header().Set("Retry-After", rootRetryAfter)
+			httputil.ErrResponse(w, fs.ErrRootUnavailable, http.StatusServiceUnavailable)
+			return
+		}
 		if os.IsNotExist(errors.Unwrap(err)) {
 			httputil.ErrResponse(w, errors.New("file not found"), http.StatusNotFound)
 			return
@@ -70,28 +185,108 @@ func (dh DownloadHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 		httputil.ErrResponse(w, err, http.StatusInternalServerError)
+		return
 	}
 	if fso.IsDir || !fso.Mode.IsRegular() {
 		err := errors.New("not a regular file")
 		logger.Error("non-files not supported", zap.Error(err))
 		httputil.ErrResponse(w, err, http.StatusBadRequest)
+		return
+	}
+	// Hidden files don't exist as far as clients are concerned.
+	if dh.rules.ExcludesPath(path.Clean(dh.diskPath), fso) {
+		logger.Info("file is excluded")
+		httputil.ErrResponse(w, errors.New("file not found"), http.StatusNotFound)
+		return
 	}
 
 	switch r.Method {
 	case "GET", "HEAD":
+		if r.URL.Query().Get("hashes") != "" {
+			logger.Info("Serving chunk hashes")
+			dh.serveChunkHashes(w, r, fso, logger)
+			return
+		}
+		if _, ok := r.URL.Query()["extents"]; ok {
+			logger.Info("Serving extents")
+			dh.serveExtents(w, r, fso, logger)
+			return
+		}
 		logger.Info("Serving file")
-		w.Header().Add("X-MediaServer-Checksum", "NOT_IMPLEMENTED")
-		http.ServeFile(w, r, fso.Path)
+		algo, err := httputil.NegotiateChecksum(r, dh.checksumAlgos)
+		if httputil.ErrResponse(w, err, http.StatusNotAcceptable) {
+			logger.Info("no acceptable checksum algorithm", zap.Error(err))
+			return
+		}
+		w.Header().Add("Vary", httputil.ChecksumAlgoHeader)
+		if dh.checksums != nil && algo == fs.ChecksumAlgo {
+			if sum, ok := dh.checksums.Known(fso); ok {
+				w.Header().Set(httputil.ChecksumHeader, sum)
+				w.Header().Set(httputil.ChecksumAlgoHeader, algo)
+			} else {
+				dh.checksums.Request(fso)
+			}
+		}
+		// ServeFile handles the conditional headers using ETag and the mod time.
+		w.Header().Set("ETag", fso.ETag)
+		w.Header().Set(httputil.MTimeHeader, fso.ModTime.UTC().Format(time.RFC3339Nano))
+		w.Header().Set("Cache-Control", httputil.DownloadCacheControl)
+		w.Header().Set("Accept-Ranges", "bytes")
+		for k, v := range dh.headers {
+			w.Header()[k] = v
+		}
+		if !dh.checkRange(w, r, fso, logger) {
+			return
+		}
+		if r.Method == "GET" {
+			dh.metrics.downloaded()
+		}
+		out := w
+		var cw *countingWriter
+		if r.Method == "GET" && dh.journal != nil {
+			cw = newCountingWriter(w, r)
+			out = cw
+		}
+		dh.serveContent(dh.verifying(out, r, fso, logger), r, fso, logger)
+		if cw != nil {
+			dh.journal.record(r, fso, cw)
+		}
 	case "DELETE":
-		err := deleteFile(w, fso)
+		if !dh.checkIfMatch(w, r, fso) {
+			logger.Info("precondition failed", zap.String("if_match", r.Header.Get("If-Match")))
+			return
+		}
+		err := dh.deleteLock.Do(func() error { return deleteFile(w, fso) })
 		if err != nil {
 			logger.Error("Failed to delete file", zap.Error(err))
+			return
 		}
+		dh.metrics.deleted()
 	default:
 		httputil.ErrResponse(w, errors.New("method not supported"), http.StatusMethodNotAllowed)
 	}
 }
 
+// serveContent serves the file, or the ranges asked for unless If-Range shows
+// the file changed.
+func (dh DownloadHandler) serveContent(w http.ResponseWriter, r *http.Request, fso *fs.FilesystemObject, logger *zap.Logger) {
+	if !dh.ioTuning.Enabled() {
+		http.ServeFile(w, r, fso.Path)
+		return
+	}
+	var offset int64
+	if ranges, err := httputil.ParseRange(r.Header.Get("Range"), fso.Size); err == nil && len(ranges) > 0 {
+		offset = ranges[0].Start
+	}
+	f, err := dh.ioTuning.Open(fso.Path, offset)
+	if httputil.ErrResponse(w, err, http.StatusInternalServerError) {
+		logger.Error("couldn't open file", zap.Error(err))
+		return
+	}
+	defer f.Close()
+	http.ServeContent(w, r, path.Base(fso.Path), fso.ModTime, f)
+}
+
 func deleteFile(w http.ResponseWriter, fso *fs.FilesystemObject) error {
 	err := fso.Delete()
 	if httputil.ErrResponse(w, err, http.StatusInternalServerError) {
@@ -100,19 +295,50 @@ func deleteFile(w http.ResponseWriter, fso *fs.FilesystemObject) error {
 	return nil
 }
 
-func containsDotDot(p string) bool {
-	// If .. is not present at all, we can quickly be done.
-	if !strings.Contains(p, "..") {
+// checkRange validates the Range header of r, answering 416 when no range is
+// in the file. Resumed downloads are logged.
+func (dh DownloadHandler) checkRange(w http.ResponseWriter, r *http.Request, fso *fs.FilesystemObject, logger *zap.Logger) bool {
+	header := r.Header.Get("Range")
+	if header == "" {
+		return true
+	}
+	ranges, err := httputil.ParseRange(header, fso.Size)
+	if errors.Is(err, httputil.ErrRangeSyntax) {
+		// Invalid ranges are ignored, the whole file is served.
+		logger.Info("ignoring invalid range", zap.String("range", header))
+		r.Header.Del("Range")
+		return true
+	}
+	if err != nil {
+		logger.Info("range not satisfiable", zap.String("range", header), zap.Int64("size", fso.Size))
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", fso.Size))
+		httputil.ErrResponse(w, err, http.StatusRequestedRangeNotSatisfiable)
 		return false
 	}
+	if len(ranges) == 1 && ranges[0].Start > 0 {
+		logger.Info("resuming download", zap.Int64("offset", ranges[0].Start),
+			zap.Int64("length", ranges[0].Length), zap.Int64("size", fso.Size))
+	} else {
+		logger.Info("serving ranges", zap.Int("ranges", len(ranges)), zap.Int64("size", fso.Size))
+	}
+	return true
+}
 
-	// We only consider .. dangerous if it's a directory specifier, e.g. surrounded by slashes
-	for _, ent := range strings.FieldsFunc(p, isSlashRune) {
-		if ent == ".." {
-			return true
+// checkIfMatch writes an error and returns false when the If-Match header of r
+// doesn't match fso, or when it is required but missing.
+func (dh DownloadHandler) checkIfMatch(w http.ResponseWriter, r *http.Request, fso *fs.FilesystemObject) bool {
+	ifMatch := r.Header.Get("If-Match")
+	if ifMatch == "" {
+		if dh.requireIfMatch {
+			httputil.ErrResponse(w, errors.New("If-Match header required"), http.StatusPreconditionRequired)
+			return false
 		}
+		return true
 	}
-	return false
+	if !httputil.MatchesETag(ifMatch, fso.ETag) {
+		w.Header().Set("ETag", fso.ETag)
+		httputil.ErrResponse(w, errors.New("file changed"), http.StatusPreconditionFailed)
+		return false
+	}
+	return true
 }
-
-func isSlashRune(r rune) bool { return r == '/' || r == '\\' }
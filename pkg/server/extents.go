@@ -0,0 +1,61 @@
+/*
+Copyright 2020 Daniël Franke
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/ainmosni/mediasync-server/pkg/fs"
+	"github.com/ainmosni/mediasync-server/pkg/httputil"
+	"go.uber.org/zap"
+)
+
+// fileExtents is the response to ?extents, the ranges of a file holding data.
+type fileExtents struct {
+	Size          int64       `json:"size"`
+	AllocatedSize int64       `json:"allocated_size"`
+	ETag          string      `json:"etag"`
+	Extents       []fs.Extent `json:"extents"`
+}
+
+// serveExtents serves the data extents of fso, so clients can fetch only those
+// with range requests and leave the holes of sparse files unallocated.
+func (dh DownloadHandler) serveExtents(w http.ResponseWriter, r *http.Request, fso *fs.FilesystemObject, logger *zap.Logger) {
+	extents, err := fso.Extents(r.Context())
+	if httputil.ErrResponse(w, err, http.StatusInternalServerError) {
+		logger.Error("couldn't find extents", zap.Error(err))
+		return
+	}
+	allocated := fso.Size
+	if fso.Sparse {
+		allocated = fso.AllocatedSize
+	}
+
+	out, err := json.Marshal(fileExtents{
+		Size:          fso.Size,
+		AllocatedSize: allocated,
+		ETag:          fso.ETag,
+		Extents:       extents,
+	})
+	if httputil.ErrResponse(w, err, http.StatusInternalServerError) {
+		logger.Error("couldn't encode to JSON", zap.Error(err))
+		return
+	}
+	w.Header().Set("ETag", fso.ETag)
+	httputil.JSONResponse(w, out, http.StatusOK)
+}
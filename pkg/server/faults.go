@@ -0,0 +1,107 @@
+/*
+Copyright 2020 Daniël Franke
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"errors"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"github.com/ainmosni/mediasync-server/pkg/httputil"
+	"go.uber.org/zap"
+)
+
+// FaultConfig configures the rates, between 0 and 1, at which faults are injected.
+type FaultConfig struct {
+	Latency      time.Duration
+	LatencyRate  float64
+	ErrorRate    float64
+	TruncateRate float64
+	DropRate     float64
+}
+
+// FaultInjector wraps handlers to inject faults, so client retry and resume
+// logic can be exercised against a real server. Never enable this in production.
+type FaultInjector struct {
+	config FaultConfig
+	logger *zap.Logger
+}
+
+// NewFaultInjector creates a new FaultInjector.
+func NewFaultInjector(config FaultConfig, logger *zap.Logger) *FaultInjector {
+	logger.Warn("fault injection enabled", zap.Any("config", config))
+	return &FaultInjector{
+		config: config,
+		logger: logger,
+	}
+}
+
+// Wrap returns h with fault injection, a nil FaultInjector returns h as is.
+func (fi *FaultInjector) Wrap(h http.Handler) http.Handler {
+	if fi == nil {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		logger := fi.logger.With(zap.String("path", r.URL.Path), zap.String("method", r.Method))
+
+		if roll(fi.config.LatencyRate) {
+			logger.Info("injecting latency", zap.Duration("latency", fi.config.Latency))
+			time.Sleep(fi.config.Latency)
+		}
+
+		switch {
+		case roll(fi.config.DropRate):
+			logger.Info("injecting dropped connection")
+			// Aborting the handler closes the connection without a response.
+			panic(http.ErrAbortHandler)
+		case roll(fi.config.ErrorRate):
+			logger.Info("injecting server error")
+			httputil.ErrResponse(w, errors.New("injected fault"), http.StatusServiceUnavailable)
+		case roll(fi.config.TruncateRate):
+			logger.Info("injecting truncated body")
+			h.ServeHTTP(&truncatingWriter{ResponseWriter: w, remaining: rand.Int63n(truncateMax)}, r) //nolint:gosec
+		default:
+			h.ServeHTTP(w, r)
+		}
+	})
+}
+
+// truncateMax is the maximum number of bytes written before truncating.
+const truncateMax = 64 * 1024
+
+// truncatingWriter aborts the connection once remaining bytes have been written.
+type truncatingWriter struct {
+	http.ResponseWriter
+	remaining int64
+}
+
+func (tw *truncatingWriter) Write(p []byte) (int, error) {
+	if int64(len(p)) <= tw.remaining {
+		tw.remaining -= int64(len(p))
+		return tw.ResponseWriter.Write(p)
+	}
+	_, _ = tw.ResponseWriter.Write(p[:tw.remaining])
+	if f, ok := tw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+	panic(http.ErrAbortHandler)
+}
+
+func roll(rate float64) bool {
+	return rate > 0 && rand.Float64() < rate //nolint:gosec
+}
@@ -17,25 +17,95 @@ limitations under the License.
 package server
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
 	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/ainmosni/mediasync-server/pkg/fs"
 	"github.com/ainmosni/mediasync-server/pkg/httputil"
+	"github.com/ainmosni/mediasync-server/pkg/tags"
 	"go.uber.org/zap"
 )
 
+// maxGenerations limits how many distinct queries we track manifest changes of.
+const maxGenerations = 64
+
 type FileInfoHandler struct {
 	logger   *zap.Logger
 	registry *fs.Registry
+	tags     *tags.Store
+	// checksumAlgos are the algorithms clients may pick for the manifest checksum.
+	checksumAlgos []string
+	// files lists the files to serve, the registry's unless we're a standby.
+	files func(context.Context) ([]*fs.WebObject, error)
+	// indexed lists them without reading the disk, for snapshots.
+	indexed   func(context.Context) ([]*fs.WebObject, error)
+	mirrored  bool
+	checksums *fs.Checksums
+
+	mu sync.Mutex
+	// generations tracks the current manifest version per query string.
+	generations map[string]generation
+	snapshots   map[snapshotKey]*snapshot
+	// sources are what the snapshots of each query are built from.
+	sources map[string]snapshotSource
+	// rebuilding is set while snapshots are rebuilt, rebuildAgain when the
+	// files changed again meanwhile.
+	rebuilding   bool
+	rebuildAgain bool
+	rescanning   bool
+	lastRescan   time.Time
+}
+
+// generation is a version of the manifest, and when it was first served.
+type generation struct {
+	hash  string
+	since time.Time
 }
 
-func NewFileInfoHandler(registry *fs.Registry, logger *zap.Logger) *FileInfoHandler {
-	return &FileInfoHandler{
+// NewFileInfoHandler creates a new FileInfoHandler, tagStore may be nil.
+func NewFileInfoHandler(registry *fs.Registry, tagStore *tags.Store, logger *zap.Logger) *FileInfoHandler {
+	h := &FileInfoHandler{
 		logger:   logger,
 		registry: registry,
+		tags:     tagStore,
+		files:    registry.GetAllFiles,
+		indexed:  registry.IndexedFiles,
+
+		generations: make(map[string]generation),
+		snapshots:   make(map[snapshotKey]*snapshot),
+		sources:     make(map[string]snapshotSource),
 	}
+	registry.OnChange(h.scheduleRebuild)
+	return h
+}
+
+// SetStandby serves the manifest mirrored from the primary instead.
+func (h *FileInfoHandler) SetStandby(sb *Standby) {
+	h.files = sb.Files
+	h.indexed = sb.Files
+	h.mirrored = true
+}
+
+// SetChecksums includes the checksums of files in the manifest once they are
+// known, unknown ones are queued to be computed in the background.
+func (h *FileInfoHandler) SetChecksums(c *fs.Checksums) {
+	h.checksums = c
+}
+
+// SetChecksumAlgorithms sets the checksum algorithms clients can choose from,
+// the first one is the default.
+func (h *FileInfoHandler) SetChecksumAlgorithms(algos []string) {
+	h.checksumAlgos = algos
 }
 
 // ServeHTTP for the FileInfoHandler, which simply serves all the files in the cache.
@@ -44,22 +114,187 @@ func (h *FileInfoHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	logger.Info("Received HTTP request")
 	switch m := r.Method; m {
 	case "GET":
-		h.serveFiles(w, logger)
+		h.serveFiles(w, r, logger)
 	default:
 		httputil.ErrResponse(w, errors.New("method not supported"), http.StatusMethodNotAllowed)
 	}
 }
 
-func (h *FileInfoHandler) serveFiles(w http.ResponseWriter, logger *zap.Logger) {
-	files, err := h.registry.GetAllFiles()
+func (h *FileInfoHandler) serveFiles(w http.ResponseWriter, r *http.Request, logger *zap.Logger) {
+	// Everything in the manifest carrying a checksum uses this algorithm.
+	algo, err := httputil.NegotiateChecksum(r, h.checksumAlgos)
+	if httputil.ErrResponse(w, err, http.StatusNotAcceptable) {
+		logger.Info("no acceptable checksum algorithm", zap.Error(err))
+		return
+	}
+	// Ignoring the filter would hand out every file instead of the tagged ones.
+	wanted := r.URL.Query()["tag"]
+	if len(wanted) > 0 && h.tags == nil {
+		httputil.ErrResponse(w, errors.New("filtering by tag needs a tags_file"), http.StatusNotImplemented)
+		return
+	}
+	// Compressed manifests are served from snapshots of the index, which is
+	// brought up to date in the background.
+	gz := httputil.AcceptsGzip(r)
+	list := h.files
+	if gz {
+		list = h.indexed
+		defer h.scheduleRescan()
+	}
+	files, err := list(r.Context())
 	if httputil.ErrResponse(w, err, http.StatusInternalServerError) {
 		logger.Error("Couldn't scan files.", zap.Error(err))
 		return
 	}
-	f, err := json.Marshal(files)
-	if httputil.ErrResponse(w, err, http.StatusInternalServerError) {
-		logger.Error("couldn't encode to JSON", zap.Error(err))
+	files = h.manifest(r.Context(), files, wanted, algo)
+	for p := range h.registry.Degraded() {
+		w.Header().Add(httputil.DegradedHeader, p)
+	}
+
+	w.Header().Add("Vary", "Accept")
+	w.Header().Add("Vary", httputil.ChecksumAlgoHeader)
+	w.Header().Add("Vary", "Accept-Encoding")
+	w.Header().Set("Cache-Control", httputil.ManifestCacheControl)
+	// Binary manifests are a lot smaller and faster to parse for large libraries.
+	ct := httputil.Negotiate(r, httputil.JSONContentType, httputil.CBORContentType, httputil.ProtobufContentType)
+	// Scoped tokens see different manifests for the same query, and file
+	// checksums depend on the algorithm.
+	query := r.URL.RawQuery + scopeKey(r.Context()) + "\x00" + algo
+	hash, since := h.generation(query, files)
+	// Every representation needs its own ETag.
+	etag := fmt.Sprintf(`"%s-%s"`, hash, manifestFormat(ct))
+	if gz {
+		etag = fmt.Sprintf(`"%s-%s-gz"`, hash, manifestFormat(ct))
+	}
+	if httputil.NotModified(w, r, etag, since) {
+		logger.Debug("manifest not modified")
 		return
 	}
-	httputil.JSONResponse(w, f, http.StatusOK)
+	if gz {
+		key := snapshotKey{query: query, ct: ct, algo: algo}
+		h.setSource(query, snapshotSource{claims: claimsFrom(r.Context()), tags: wanted, algo: algo})
+		h.serveSnapshot(w, key, hash, files, logger)
+		return
+	}
+	w.Header().Set(httputil.ChecksumAlgoHeader, algo)
+	switch ct {
+	case httputil.CBORContentType:
+		httputil.Response(w, ct, encodeManifestCBOR(files), http.StatusOK)
+	case httputil.ProtobufContentType:
+		httputil.Response(w, ct, encodeManifestProtobuf(files), http.StatusOK)
+	default:
+		// The JSON manifest is streamed, with its checksum in a trailer.
+		err := httputil.StreamResponse(w, httputil.JSONContentType, algo, http.StatusOK, func(out io.Writer) error {
+			return json.NewEncoder(out).Encode(files)
+		})
+		if err != nil {
+			logger.Error("couldn't encode to JSON", zap.Error(err))
+		}
+	}
+}
+
+// manifest returns the files the scope of ctx allows and carrying the wanted
+// tags, in the order clients sync them: what matters most first. Files only
+// have checksums when algo is the one they're kept in.
+func (h *FileInfoHandler) manifest(ctx context.Context, files []*fs.WebObject, wanted []string, algo string) []*fs.WebObject {
+	files = h.applyTags(scopedFiles(ctx, files), wanted)
+	if algo == fs.ChecksumAlgo {
+		h.applyChecksums(files)
+	} else {
+		files = withoutChecksums(files)
+	}
+	sort.SliceStable(files, func(i, j int) bool { return files[i].Priority > files[j].Priority })
+	return files
+}
+
+// withoutChecksums returns copies of files without checksums, as the files
+// may be shared with other manifests.
+func withoutChecksums(files []*fs.WebObject) []*fs.WebObject {
+	r := make([]*fs.WebObject, 0, len(files))
+	for _, f := range files {
+		c := *f
+		c.Checksum = ""
+		r = append(r, &c)
+	}
+	return r
+}
+
+// applyChecksums fills in the known checksums of files, a standby has the
+// checksums of its primary.
+func (h *FileInfoHandler) applyChecksums(files []*fs.WebObject) {
+	if h.checksums == nil || h.mirrored {
+		return
+	}
+	for _, f := range files {
+		sum, ok := h.checksums.Known(f.FilesystemObject)
+		if !ok {
+			h.checksums.Queue(f.FilesystemObject)
+			continue
+		}
+		f.Checksum = sum
+	}
+}
+
+// generation returns the hash of the manifest of files for query, and since
+// when it is the current version.
+func (h *FileInfoHandler) generation(query string, files []*fs.WebObject) (string, time.Time) {
+	sum := sha256.New()
+	for _, f := range files {
+		fmt.Fprintf(sum, "%s\x00%s\x00%s\x00%s\x00%t\x00%d\x00%s\x00%t\x00%s\x00%s\x00%d", f.WebPath, f.Path, f.ETag, strings.Join(f.Tags, ","), f.Stale,
+			f.AllocatedSize, f.LinkTarget, f.CaseCollision, f.ID, f.Checksum, f.Priority)
+		if m := f.Meta; m != nil {
+			fmt.Fprintf(sum, "\x00%d\x00%d\x00%o\x00%v", m.UID, m.GID, m.Mode, m.Xattrs)
+		}
+		fmt.Fprintln(sum)
+	}
+	hash := hex.EncodeToString(sum.Sum(nil))[:32]
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	g, ok := h.generations[query]
+	if !ok || g.hash != hash {
+		if len(h.generations) >= maxGenerations {
+			h.generations = make(map[string]generation)
+		}
+		g = generation{hash: hash, since: time.Now()}
+		h.generations[query] = g
+	}
+	return g.hash, g.since
+}
+
+// manifestFormat is a short name for a manifest content type.
+func manifestFormat(ct string) string {
+	switch ct {
+	case httputil.CBORContentType:
+		return "cbor"
+	case httputil.ProtobufContentType:
+		return "pb"
+	default:
+		return "json"
+	}
+}
+
+// applyTags fills in the tags of files, and only keeps those carrying all of
+// the wanted tags.
+func (h *FileInfoHandler) applyTags(files []*fs.WebObject, wanted []string) []*fs.WebObject {
+	if h.tags == nil {
+		return files
+	}
+	r := make([]*fs.WebObject, 0, len(files))
+	for _, f := range files {
+		f.Tags = h.tags.Get(f.WebPath)
+		if hasAllTags(h.tags, f.WebPath, wanted) {
+			r = append(r, f)
+		}
+	}
+	return r
+}
+
+func hasAllTags(store *tags.Store, webPath string, wanted []string) bool {
+	for _, t := range wanted {
+		if !store.Has(webPath, t) {
+			return false
+		}
+	}
+	return true
 }
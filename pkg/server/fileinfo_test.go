@@ -0,0 +1,90 @@
+/*
+Copyright 2020 Daniël Franke
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ainmosni/mediasync-server/pkg/fs"
+	"github.com/ainmosni/mediasync-server/pkg/tags"
+	"go.uber.org/zap"
+)
+
+func TestFileInfoTagFilter(t *testing.T) {
+	root, err := ioutil.TempDir("", "fileinfo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	for _, name := range []string{"a.mkv", "b.mkv"} {
+		if err := ioutil.WriteFile(filepath.Join(root, name), []byte(name), 0o640); err != nil {
+			t.Fatal(err)
+		}
+	}
+	store, err := tags.NewStore(filepath.Join(root, "tags.json"), zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Set("/files/a.mkv", []string{"new"}); err != nil {
+		t.Fatal(err)
+	}
+	r := fs.NewRegistry(zap.NewNop())
+	if err := r.Register("/files/", root); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		store   *tags.Store
+		query   string
+		status  int
+		want    []string
+		without []string
+	}{
+		{"no filter", nil, "", http.StatusOK, []string{"/files/a.mkv", "/files/b.mkv"}, nil},
+		{"filter without store", nil, "?tag=new", http.StatusNotImplemented, nil, nil},
+		{"filter", store, "?tag=new", http.StatusOK, []string{"/files/a.mkv"}, []string{"/files/b.mkv"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := NewFileInfoHandler(r, tt.store, zap.NewNop())
+			h.lastRescan = time.Now()
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/fileinfo"+tt.query, nil))
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.status, w.Body.String())
+			}
+			for _, p := range tt.want {
+				if !strings.Contains(w.Body.String(), p) {
+					t.Errorf("manifest misses %s: %s", p, w.Body.String())
+				}
+			}
+			for _, p := range tt.without {
+				if strings.Contains(w.Body.String(), p) {
+					t.Errorf("manifest has %s: %s", p, w.Body.String())
+				}
+			}
+		})
+	}
+}
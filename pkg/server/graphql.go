@@ -0,0 +1,179 @@
+/*
+Copyright 2020 Daniël Franke
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/ainmosni/mediasync-server/pkg/fs"
+	"github.com/ainmosni/mediasync-server/pkg/httputil"
+	graphql "github.com/graph-gophers/graphql-go"
+	"go.uber.org/zap"
+)
+
+const graphQLSchema = `
+schema {
+	query: Query
+}
+
+type Query {
+	files(pathPrefix: String, contentType: String, modifiedSince: String): [File!]!
+}
+
+type File {
+	path: String!
+	webPath: String!
+	contentType: String!
+	size: Float!
+	modTime: String!
+	etag: String!
+	id: String!
+	checksum: String
+}
+`
+
+// GraphQLHandler exposes the file index through a GraphQL schema.
+type GraphQLHandler struct {
+	logger *zap.Logger
+	query  *queryResolver
+	schema *graphql.Schema
+}
+
+// NewGraphQLHandler creates a new GraphQLHandler, it panics if the schema is invalid.
+func NewGraphQLHandler(registry *fs.Registry, logger *zap.Logger) *GraphQLHandler {
+	query := &queryResolver{registry: registry}
+	return &GraphQLHandler{
+		logger: logger,
+		query:  query,
+		schema: graphql.MustParseSchema(graphQLSchema, query),
+	}
+}
+
+// SetChecksums fills in the checksum of files from c, like /fileinfo. Files
+// that weren't hashed yet are queued and have no checksum.
+func (h *GraphQLHandler) SetChecksums(c *fs.Checksums) {
+	h.query.checksums = c
+}
+
+// ServeHTTP for the GraphQLHandler, executes a single query posted as JSON.
+func (h *GraphQLHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	logger := h.logger.With(zap.String("path", r.URL.Path), zap.String("method", r.Method))
+	logger.Info("Received HTTP request")
+	if r.Method != "POST" {
+		httputil.ErrResponse(w, errors.New("method not supported"), http.StatusMethodNotAllowed)
+		return
+	}
+
+	var params struct {
+		Query         string                 `json:"query"`
+		OperationName string                 `json:"operationName"`
+		Variables     map[string]interface{} `json:"variables"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&params)
+	if httputil.ErrResponse(w, err, http.StatusBadRequest) {
+		logger.Error("couldn't decode query", zap.Error(err))
+		return
+	}
+
+	resp := h.schema.Exec(r.Context(), params.Query, params.OperationName, params.Variables)
+	if len(resp.Errors) > 0 {
+		logger.Info("query returned errors", zap.Any("errors", resp.Errors))
+	}
+	out, err := json.Marshal(resp)
+	if httputil.ErrResponse(w, err, http.StatusInternalServerError) {
+		logger.Error("couldn't encode to JSON", zap.Error(err))
+		return
+	}
+	httputil.JSONResponse(w, out, http.StatusOK)
+}
+
+type queryResolver struct {
+	registry  *fs.Registry
+	checksums *fs.Checksums
+}
+
+type filesArgs struct {
+	PathPrefix    *string
+	ContentType   *string
+	ModifiedSince *string
+}
+
+// Files resolves the files query, all filters are optional and combined.
+func (q *queryResolver) Files(ctx context.Context, args filesArgs) ([]*fileResolver, error) {
+	var since time.Time
+	if args.ModifiedSince != nil {
+		var err error
+		since, err = time.Parse(time.RFC3339, *args.ModifiedSince)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	files, err := q.registry.GetAllFiles(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	files = scopedFiles(ctx, files)
+	r := make([]*fileResolver, 0, len(files))
+	for _, f := range files {
+		if args.PathPrefix != nil && !strings.HasPrefix(f.WebPath, *args.PathPrefix) {
+			continue
+		}
+		if args.ContentType != nil && !strings.HasPrefix(f.ContentType, *args.ContentType) {
+			continue
+		}
+		if f.ModTime.Before(since) {
+			continue
+		}
+		r = append(r, &fileResolver{wo: f, checksums: q.checksums})
+	}
+	return r, nil
+}
+
+type fileResolver struct {
+	wo        *fs.WebObject
+	checksums *fs.Checksums
+}
+
+func (f *fileResolver) Path() string        { return f.wo.Path }
+func (f *fileResolver) WebPath() string     { return f.wo.WebPath }
+func (f *fileResolver) ContentType() string { return f.wo.ContentType }
+
+// Size is a float as GraphQL integers are limited to 32 bits.
+func (f *fileResolver) Size() float64   { return float64(f.wo.Size) }
+func (f *fileResolver) ModTime() string { return f.wo.ModTime.Format(time.RFC3339) }
+func (f *fileResolver) Etag() string    { return f.wo.ETag }
+func (f *fileResolver) ID() string      { return f.wo.ID }
+
+// Checksum is the hex encoded sha256 of the file, null until it's known.
+func (f *fileResolver) Checksum() *string {
+	if f.checksums == nil {
+		return nil
+	}
+	sum, ok := f.checksums.Known(f.wo.FilesystemObject)
+	if !ok {
+		f.checksums.Queue(f.wo.FilesystemObject)
+		return nil
+	}
+	return &sum
+}
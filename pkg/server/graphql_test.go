@@ -0,0 +1,106 @@
+/*
+Copyright 2020 Daniël Franke
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/ainmosni/mediasync-server/pkg/fs"
+	"go.uber.org/zap"
+)
+
+func TestGraphQLFiles(t *testing.T) {
+	root, err := ioutil.TempDir("", "graphql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	// The content type is sniffed, not taken from the extension.
+	for name, content := range map[string]string{"a.mkv": "a", "b.html": "<html></html>"} {
+		if err := ioutil.WriteFile(filepath.Join(root, name), []byte(content), 0o640); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Only a.mkv was hashed, b.html has no checksum yet.
+	fso, err := fs.ObjFromPath(filepath.Join(root, "a.mkv"), false, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	checksums := fs.NewChecksums(zap.NewNop())
+	sum, err := checksums.Sum(context.Background(), fso)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := fs.NewRegistry(zap.NewNop())
+	if err := r.Register("/files/", root); err != nil {
+		t.Fatal(err)
+	}
+	h := NewGraphQLHandler(r, zap.NewNop())
+	h.SetChecksums(checksums)
+
+	type file struct {
+		WebPath  string  `json:"webPath"`
+		Checksum *string `json:"checksum"`
+	}
+	tests := []struct {
+		name  string
+		query string
+		want  []file
+	}{
+		{"all", `{ files { webPath checksum } }`, []file{{"/files/a.mkv", &sum}, {"/files/b.html", nil}}},
+		{"content type", `{ files(contentType: "text/html") { webPath checksum } }`, []file{{"/files/b.html", nil}}},
+		{"path prefix", `{ files(pathPrefix: "/files/a") { webPath checksum } }`, []file{{"/files/a.mkv", &sum}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body, err := json.Marshal(map[string]string{"query": tt.query})
+			if err != nil {
+				t.Fatal(err)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/graphql", strings.NewReader(string(body))))
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d: %s", w.Code, w.Body.String())
+			}
+			var resp struct {
+				Data struct {
+					Files []file `json:"files"`
+				} `json:"data"`
+				Errors []interface{} `json:"errors"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+			if len(resp.Errors) > 0 {
+				t.Fatalf("errors: %v", resp.Errors)
+			}
+			if got := resp.Data.Files; !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("files = %s, want %v", w.Body.String(), tt.want)
+			}
+		})
+	}
+}
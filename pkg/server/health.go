@@ -0,0 +1,56 @@
+/*
+Copyright 2020 Daniël Franke
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/ainmosni/mediasync-server/pkg/fs"
+	"github.com/ainmosni/mediasync-server/pkg/httputil"
+)
+
+// readiness is what the readiness endpoint answers.
+type readiness struct {
+	Ready bool `json:"ready"`
+	// Pending are the serve paths of the roots that weren't scanned yet.
+	Pending []string `json:"pending"`
+}
+
+// HealthHandler answers 200 as long as the server is running.
+func HealthHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		httputil.JSONResponse(w, []byte(`{"ok":true}`), http.StatusOK)
+	})
+}
+
+// ReadinessHandler answers 200 once every root of registry was scanned, and
+// 503 until then, so no traffic is routed to a server with an empty manifest.
+func ReadinessHandler(registry *fs.Registry) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pending := registry.Pending()
+		status := http.StatusOK
+		if len(pending) > 0 {
+			status = http.StatusServiceUnavailable
+		}
+		out, err := json.Marshal(readiness{Ready: len(pending) == 0, Pending: pending})
+		if httputil.ErrResponse(w, err, http.StatusInternalServerError) {
+			return
+		}
+		httputil.JSONResponse(w, out, status)
+	})
+}
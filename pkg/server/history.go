@@ -0,0 +1,258 @@
+/*
+Copyright 2020 Daniël Franke
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ainmosni/mediasync-server/pkg/fs"
+	"go.uber.org/zap"
+)
+
+// topClients is how many clients the scheduled reports list.
+const topClients = 10
+
+// ReportHistory generates reports about the library on a schedule and keeps
+// the last ones, in a file too when it has one, so they survive restarts.
+type ReportHistory struct {
+	reports   *ReportsHandler
+	journal   *Journal
+	checksums *fs.Checksums
+	path      string
+	keep      int
+	logger    *zap.Logger
+
+	mu sync.Mutex
+	// entries are the kept reports, oldest first.
+	entries []*ScheduledReport
+}
+
+// ScheduledReport is a report generated by the schedule.
+type ScheduledReport struct {
+	Time       time.Time         `json:"time"`
+	Growth     []RootGrowth      `json:"growth"`
+	Duplicates DuplicatesSummary `json:"duplicates"`
+	Integrity  IntegritySummary  `json:"integrity"`
+	TopClients []ClientTotal     `json:"top_clients"`
+}
+
+// RootGrowth is the size of a root, and how it changed since the last report.
+type RootGrowth struct {
+	Root       string `json:"root"`
+	Files      int    `json:"files"`
+	Bytes      int64  `json:"bytes"`
+	FilesAdded int    `json:"files_added"`
+	BytesAdded int64  `json:"bytes_added"`
+}
+
+// DuplicatesSummary sums up the duplicates report.
+type DuplicatesSummary struct {
+	Groups      int   `json:"groups"`
+	WastedBytes int64 `json:"wasted_bytes"`
+}
+
+// IntegritySummary lists the files we can't read and how many files were read
+// with another checksum than they have, since the server started.
+type IntegritySummary struct {
+	Quarantined        []fs.Quarantined `json:"quarantined"`
+	ChecksumMismatches int64            `json:"checksum_mismatches"`
+}
+
+// ClientTotal is what a client fetched, over the files in the journal.
+type ClientTotal struct {
+	Client    string `json:"client"`
+	Bytes     int64  `json:"bytes"`
+	Files     int    `json:"files"`
+	Completed int    `json:"completed"`
+}
+
+// NewReportHistory loads the reports kept in path, a missing file or an empty
+// path start with none. Only the last keep reports are kept.
+func NewReportHistory(reports *ReportsHandler, journal *Journal, checksums *fs.Checksums, path string, keep int,
+	logger *zap.Logger) (*ReportHistory, error) {
+	h := &ReportHistory{
+		reports:   reports,
+		journal:   journal,
+		checksums: checksums,
+		path:      path,
+		keep:      keep,
+		logger:    logger,
+	}
+	if path == "" {
+		return h, nil
+	}
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return h, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &h.entries); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// Run generates a report every interval, until ctx is done.
+func (h *ReportHistory) Run(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		report, err := h.generate(ctx)
+		if err != nil {
+			if ctx.Err() == nil {
+				h.logger.Error("couldn't generate scheduled report", zap.Error(err))
+			}
+			continue
+		}
+		if err := h.add(report); err != nil {
+			h.logger.Error("couldn't save scheduled report", zap.String("path", h.path), zap.Error(err))
+		}
+		h.logger.Info("generated scheduled report")
+	}
+}
+
+// Entries returns the kept reports, newest first.
+func (h *ReportHistory) Entries() []*ScheduledReport {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	out := make([]*ScheduledReport, len(h.entries))
+	for i, e := range h.entries {
+		out[len(out)-1-i] = e
+	}
+	return out
+}
+
+// generate scans all roots and puts the report together.
+func (h *ReportHistory) generate(ctx context.Context) (*ScheduledReport, error) {
+	// This scans every root, so the stats below are up to date.
+	dups, err := h.reports.duplicates(ctx, false)
+	if err != nil {
+		return nil, err
+	}
+	return &ScheduledReport{
+		Time:       time.Now(),
+		Growth:     h.growth(h.reports.registry.Stats()),
+		Duplicates: DuplicatesSummary{Groups: len(dups.Groups), WastedBytes: dups.WastedBytes},
+		Integrity: IntegritySummary{
+			Quarantined:        h.reports.registry.Quarantined(),
+			ChecksumMismatches: h.checksums.Mismatches(),
+		},
+		TopClients: clientTotals(h.journal.Snapshot(), topClients),
+	}, nil
+}
+
+// growth compares stats to the last report.
+func (h *ReportHistory) growth(stats map[string]fs.RootStats) []RootGrowth {
+	previous := make(map[string]RootGrowth)
+	h.mu.Lock()
+	if len(h.entries) > 0 {
+		for _, g := range h.entries[len(h.entries)-1].Growth {
+			previous[g.Root] = g
+		}
+	}
+	h.mu.Unlock()
+
+	growth := make([]RootGrowth, 0, len(stats))
+	for root, s := range stats {
+		g := RootGrowth{Root: root, Files: s.Files, Bytes: s.Bytes}
+		if p, ok := previous[root]; ok {
+			g.FilesAdded = g.Files - p.Files
+			g.BytesAdded = g.Bytes - p.Bytes
+		}
+		growth = append(growth, g)
+	}
+	sort.Slice(growth, func(i, j int) bool { return growth[i].Root < growth[j].Root })
+	return growth
+}
+
+// clientTotals adds up the progress per client, and returns the n clients that
+// fetched the most.
+func clientTotals(progress []FileProgress, n int) []ClientTotal {
+	byClient := make(map[string]*ClientTotal)
+	for _, fp := range progress {
+		ct, ok := byClient[fp.Client]
+		if !ok {
+			ct = &ClientTotal{Client: fp.Client}
+			byClient[fp.Client] = ct
+		}
+		ct.Bytes += fp.Fetched
+		ct.Files++
+		if fp.Completed {
+			ct.Completed++
+		}
+	}
+	totals := make([]ClientTotal, 0, len(byClient))
+	for _, ct := range byClient {
+		totals = append(totals, *ct)
+	}
+	sort.Slice(totals, func(i, j int) bool { return totals[i].Bytes > totals[j].Bytes })
+	if len(totals) > n {
+		totals = totals[:n]
+	}
+	return totals
+}
+
+// add keeps report, dropping the oldest beyond keep, and saves the history.
+func (h *ReportHistory) add(report *ScheduledReport) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.entries = append(h.entries, report)
+	if h.keep > 0 && len(h.entries) > h.keep {
+		h.entries = h.entries[len(h.entries)-h.keep:]
+	}
+	if h.path == "" {
+		return nil
+	}
+	return h.save()
+}
+
+// save writes the history to its file through a temporary file. h.mu is held.
+func (h *ReportHistory) save() error {
+	b, err := json.Marshal(h.entries)
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(h.path), ".reports-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(b)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), h.path)
+}
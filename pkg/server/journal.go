@@ -0,0 +1,197 @@
+/*
+Copyright 2020 Daniël Franke
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ainmosni/mediasync-server/pkg/fs"
+	"github.com/ainmosni/mediasync-server/pkg/httputil"
+)
+
+// journalEntries is how many client and file pairs the journal keeps, the
+// least recently seen are forgotten first.
+const journalEntries = 4096
+
+// Journal tracks how much of each file every client fetched, over all its
+// range requests, so clients that never finish or keep starting over stand out.
+type Journal struct {
+	mu      sync.Mutex
+	entries map[journalKey]*FileProgress
+}
+
+type journalKey struct {
+	client string
+	path   string
+}
+
+// FileProgress is what a client fetched of a file.
+type FileProgress struct {
+	Client string `json:"client"`
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	// Fetched is how many distinct bytes of the file were sent.
+	Fetched  int64 `json:"fetched"`
+	Requests int   `json:"requests"`
+	// Restarts counts requests starting from the beginning again, before the
+	// file was complete.
+	Restarts  int       `json:"restarts"`
+	Completed bool      `json:"completed"`
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+
+	// etag is the version of the file, a new one starts over.
+	etag string
+	// spans are the fetched ranges, sorted and merged.
+	spans []httputil.ByteRange
+}
+
+// NewJournal creates an empty Journal.
+func NewJournal() *Journal {
+	return &Journal{entries: make(map[journalKey]*FileProgress)}
+}
+
+// record adds the response to a GET of fso, with the status and bytes cw saw.
+// A nil Journal records nothing.
+func (j *Journal) record(r *http.Request, fso *fs.FilesystemObject, cw *countingWriter) {
+	if j == nil {
+		return
+	}
+	var spans []httputil.ByteRange
+	switch cw.status {
+	case http.StatusOK:
+		spans = []httputil.ByteRange{{Start: 0, Length: cw.bytes}}
+	case http.StatusPartialContent:
+		ranges, err := httputil.ParseRange(r.Header.Get("Range"), fso.Size)
+		if err != nil {
+			return
+		}
+		if len(ranges) == 1 {
+			if cw.bytes < ranges[0].Length {
+				ranges[0].Length = cw.bytes
+			}
+		} else if cw.err != nil || r.Context().Err() != nil {
+			// We can't tell which parts of an interrupted multipart response
+			// made it.
+			return
+		}
+		spans = ranges
+	default:
+		return
+	}
+
+	client, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		client = r.RemoteAddr
+	}
+	now := time.Now()
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	key := journalKey{client: client, path: r.URL.Path}
+	fp, ok := j.entries[key]
+	if !ok || fp.etag != fso.ETag {
+		if !ok && len(j.entries) >= journalEntries {
+			j.evict()
+		}
+		fp = &FileProgress{Client: client, Path: r.URL.Path, FirstSeen: now, etag: fso.ETag}
+		j.entries[key] = fp
+	}
+	if fp.Fetched > 0 && !fp.Completed && spans[0].Start == 0 {
+		fp.Restarts++
+	}
+	fp.Size = fso.Size
+	fp.Requests++
+	fp.LastSeen = now
+	for _, s := range spans {
+		fp.add(s)
+	}
+	fp.Completed = fp.Fetched >= fp.Size
+}
+
+// add merges s into the fetched spans.
+func (fp *FileProgress) add(s httputil.ByteRange) {
+	if s.Length <= 0 {
+		return
+	}
+	spans := append(fp.spans, s)
+	sort.Slice(spans, func(i, j int) bool { return spans[i].Start < spans[j].Start })
+	merged := spans[:1]
+	for _, s := range spans[1:] {
+		last := &merged[len(merged)-1]
+		if s.Start <= last.Start+last.Length {
+			if end := s.Start + s.Length; end > last.Start+last.Length {
+				last.Length = end - last.Start
+			}
+			continue
+		}
+		merged = append(merged, s)
+	}
+	fp.spans = merged
+	fp.Fetched = 0
+	for _, s := range merged {
+		fp.Fetched += s.Length
+	}
+}
+
+// evict forgets the least recently seen entry. j.mu is held.
+func (j *Journal) evict() {
+	var oldest journalKey
+	var seen time.Time
+	for k, fp := range j.entries {
+		if seen.IsZero() || fp.LastSeen.Before(seen) {
+			oldest, seen = k, fp.LastSeen
+		}
+	}
+	delete(j.entries, oldest)
+}
+
+// Snapshot returns the progress of every client and file, most recently seen
+// first.
+func (j *Journal) Snapshot() []FileProgress {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	out := make([]FileProgress, 0, len(j.entries))
+	for _, fp := range j.entries {
+		out = append(out, *fp)
+	}
+	sort.Slice(out, func(i, k int) bool { return out[i].LastSeen.After(out[k].LastSeen) })
+	return out
+}
+
+// ServeHTTP serves the progress as JSON, ?incomplete leaves out completed files.
+func (j *Journal) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	progress := j.Snapshot()
+	if _, ok := r.URL.Query()["incomplete"]; ok {
+		incomplete := progress[:0]
+		for _, fp := range progress {
+			if !fp.Completed {
+				incomplete = append(incomplete, fp)
+			}
+		}
+		progress = incomplete
+	}
+	out, err := json.Marshal(progress)
+	if httputil.ErrResponse(w, err, http.StatusInternalServerError) {
+		return
+	}
+	httputil.JSONResponse(w, out, http.StatusOK)
+}
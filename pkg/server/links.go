@@ -0,0 +1,68 @@
+/*
+Copyright 2020 Daniël Franke
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/ainmosni/mediasync-server/pkg/fs"
+	"github.com/ainmosni/mediasync-server/pkg/httputil"
+	"go.uber.org/zap"
+)
+
+// LinksHandler lists the symlinks of roots exposing them, including links to
+// directories, so clients can recreate them instead of downloading copies.
+type LinksHandler struct {
+	registry *fs.Registry
+	logger   *zap.Logger
+}
+
+// NewLinksHandler creates a new LinksHandler.
+func NewLinksHandler(registry *fs.Registry, logger *zap.Logger) *LinksHandler {
+	return &LinksHandler{
+		registry: registry,
+		logger:   logger,
+	}
+}
+
+// ServeHTTP for the LinksHandler.
+func (h *LinksHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	logger := h.logger.With(zap.String("path", r.URL.Path), zap.String("method", r.Method))
+	logger.Info("Received HTTP request")
+	if r.Method != "GET" {
+		httputil.ErrResponse(w, errors.New("method not supported"), http.StatusMethodNotAllowed)
+		return
+	}
+
+	links, err := h.registry.Links(r.Context())
+	if errors.Is(err, fs.ErrRootUnavailable) {
+		httputil.ErrResponse(w, err, http.StatusServiceUnavailable)
+		return
+	}
+	if httputil.ErrResponse(w, err, http.StatusInternalServerError) {
+		logger.Error("couldn't list links", zap.Error(err))
+		return
+	}
+	b, err := json.Marshal(scopedFiles(r.Context(), links))
+	if httputil.ErrResponse(w, err, http.StatusInternalServerError) {
+		logger.Error("couldn't encode to JSON", zap.Error(err))
+		return
+	}
+	httputil.JSONResponse(w, b, http.StatusOK)
+}
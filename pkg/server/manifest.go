@@ -0,0 +1,330 @@
+/*
+Copyright 2020 Daniël Franke
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sort"
+	"time"
+
+	"github.com/ainmosni/mediasync-server/pkg/fs"
+)
+
+// CBOR major types, see RFC 7049.
+const (
+	cborUint   = 0
+	cborNegInt = 1
+	cborBytes  = 2
+	cborText   = 3
+	cborArray  = 4
+	cborMap    = 5
+	cborTag    = 6
+	cborFalse  = 0xf4
+	cborTrue   = 0xf5
+	cborTagRFC = 0
+)
+
+// encodeManifestCBOR encodes the manifest as a CBOR array of maps, using the
+// same keys as the JSON representation. Timestamps are RFC3339 tagged strings.
+func encodeManifestCBOR(files []*fs.WebObject) []byte {
+	var b bytes.Buffer
+	cborHead(&b, cborArray, uint64(len(files)))
+	for _, f := range files {
+		fields := uint64(6)
+		if len(f.Tags) > 0 {
+			fields++
+		}
+		if f.ETag != "" {
+			fields++
+		}
+		if f.Stale {
+			fields++
+		}
+		if f.Meta != nil {
+			fields++
+		}
+		if f.Sparse {
+			fields += 2
+		}
+		if f.LinkTarget != "" {
+			fields++
+		}
+		if f.CaseCollision {
+			fields++
+		}
+		if f.ID != "" {
+			fields++
+		}
+		if f.Checksum != "" {
+			fields++
+		}
+		if f.Priority != 0 {
+			fields++
+		}
+		cborHead(&b, cborMap, fields)
+		cborString(&b, "path")
+		cborString(&b, f.Path)
+		cborString(&b, "content_type")
+		cborString(&b, f.ContentType)
+		cborString(&b, "size")
+		cborHead(&b, cborUint, uint64(f.Size))
+		cborString(&b, "mod_time")
+		cborHead(&b, cborTag, cborTagRFC)
+		cborString(&b, f.ModTime.Format(time.RFC3339Nano))
+		cborString(&b, "is_dir")
+		cborBool(&b, f.IsDir)
+		cborString(&b, "web_path")
+		cborString(&b, f.WebPath)
+		if len(f.Tags) > 0 {
+			cborString(&b, "tags")
+			cborHead(&b, cborArray, uint64(len(f.Tags)))
+			for _, t := range f.Tags {
+				cborString(&b, t)
+			}
+		}
+		if f.ETag != "" {
+			cborString(&b, "etag")
+			cborString(&b, f.ETag)
+		}
+		if f.Stale {
+			cborString(&b, "stale")
+			cborBool(&b, true)
+		}
+		if f.Meta != nil {
+			cborString(&b, "meta")
+			cborMeta(&b, f.Meta)
+		}
+		if f.Sparse {
+			cborString(&b, "sparse")
+			cborBool(&b, true)
+			cborString(&b, "allocated_size")
+			cborHead(&b, cborUint, uint64(f.AllocatedSize))
+		}
+		if f.LinkTarget != "" {
+			cborString(&b, "link_target")
+			cborString(&b, f.LinkTarget)
+		}
+		if f.CaseCollision {
+			cborString(&b, "case_collision")
+			cborBool(&b, true)
+		}
+		if f.ID != "" {
+			cborString(&b, "id")
+			cborString(&b, f.ID)
+		}
+		if f.Checksum != "" {
+			cborString(&b, "checksum")
+			cborString(&b, f.Checksum)
+		}
+		if f.Priority != 0 {
+			cborString(&b, "priority")
+			cborInt(&b, int64(f.Priority))
+		}
+	}
+	return b.Bytes()
+}
+
+func cborMeta(b *bytes.Buffer, m *fs.Metadata) {
+	fields := uint64(3)
+	if len(m.Xattrs) > 0 {
+		fields++
+	}
+	cborHead(b, cborMap, fields)
+	cborString(b, "uid")
+	cborHead(b, cborUint, uint64(m.UID))
+	cborString(b, "gid")
+	cborHead(b, cborUint, uint64(m.GID))
+	cborString(b, "mode")
+	cborHead(b, cborUint, uint64(m.Mode))
+	if len(m.Xattrs) > 0 {
+		cborString(b, "xattrs")
+		cborHead(b, cborMap, uint64(len(m.Xattrs)))
+		for _, k := range sortedKeys(m.Xattrs) {
+			cborString(b, k)
+			cborHead(b, cborBytes, uint64(len(m.Xattrs[k])))
+			b.Write(m.Xattrs[k])
+		}
+	}
+}
+
+// sortedKeys returns the keys of m in order, so encoding is reproducible.
+func sortedKeys(m map[string][]byte) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func cborHead(b *bytes.Buffer, major byte, n uint64) {
+	major <<= 5
+	switch {
+	case n < 24:
+		b.WriteByte(major | byte(n))
+	case n <= 0xff:
+		b.WriteByte(major | 24)
+		b.WriteByte(byte(n))
+	case n <= 0xffff:
+		b.WriteByte(major | 25)
+		_ = binary.Write(b, binary.BigEndian, uint16(n))
+	case n <= 0xffffffff:
+		b.WriteByte(major | 26)
+		_ = binary.Write(b, binary.BigEndian, uint32(n))
+	default:
+		b.WriteByte(major | 27)
+		_ = binary.Write(b, binary.BigEndian, n)
+	}
+}
+
+func cborInt(b *bytes.Buffer, n int64) {
+	if n < 0 {
+		cborHead(b, cborNegInt, uint64(-1-n))
+		return
+	}
+	cborHead(b, cborUint, uint64(n))
+}
+
+func cborString(b *bytes.Buffer, s string) {
+	cborHead(b, cborText, uint64(len(s)))
+	b.WriteString(s)
+}
+
+func cborBool(b *bytes.Buffer, v bool) {
+	if v {
+		b.WriteByte(cborTrue)
+		return
+	}
+	b.WriteByte(cborFalse)
+}
+
+// Protobuf wire types.
+const (
+	pbVarint = 0
+	pbBytes  = 2
+)
+
+// encodeManifestProtobuf encodes the manifest using the following schema:
+//
+//	message Manifest {
+//		repeated File files = 1;
+//	}
+//
+//	message File {
+//		string path = 1;
+//		string content_type = 2;
+//		int64 size = 3;
+//		int64 mod_time_unix_nano = 4;
+//		bool is_dir = 5;
+//		string web_path = 6;
+//		repeated string tags = 7;
+//		string etag = 8;
+//		bool stale = 9;
+//		Meta meta = 10;
+//		bool sparse = 11;
+//		int64 allocated_size = 12;
+//		string link_target = 13;
+//		bool case_collision = 14;
+//		string id = 15;
+//		string checksum = 16;
+//		int64 priority = 17;
+//	}
+//
+//	message Meta {
+//		uint32 uid = 1;
+//		uint32 gid = 2;
+//		uint32 mode = 3;
+//		map<string, bytes> xattrs = 4;
+//	}
+func encodeManifestProtobuf(files []*fs.WebObject) []byte {
+	var b, msg, meta bytes.Buffer
+	for _, f := range files {
+		msg.Reset()
+		pbString(&msg, 1, f.Path)
+		pbString(&msg, 2, f.ContentType)
+		pbVarintField(&msg, 3, uint64(f.Size))
+		pbVarintField(&msg, 4, uint64(f.ModTime.UnixNano()))
+		if f.IsDir {
+			pbVarintField(&msg, 5, 1)
+		}
+		pbString(&msg, 6, f.WebPath)
+		for _, t := range f.Tags {
+			pbString(&msg, 7, t)
+		}
+		pbString(&msg, 8, f.ETag)
+		if f.Stale {
+			pbVarintField(&msg, 9, 1)
+		}
+		if f.Meta != nil {
+			meta.Reset()
+			pbMeta(&meta, f.Meta)
+			pbBytesField(&msg, 10, meta.Bytes())
+		}
+		if f.Sparse {
+			pbVarintField(&msg, 11, 1)
+			pbVarintField(&msg, 12, uint64(f.AllocatedSize))
+		}
+		pbString(&msg, 13, f.LinkTarget)
+		if f.CaseCollision {
+			pbVarintField(&msg, 14, 1)
+		}
+		pbString(&msg, 15, f.ID)
+		pbString(&msg, 16, f.Checksum)
+		if f.Priority != 0 {
+			pbVarintField(&msg, 17, uint64(f.Priority))
+		}
+		pbBytesField(&b, 1, msg.Bytes())
+	}
+	return b.Bytes()
+}
+
+func pbMeta(b *bytes.Buffer, m *fs.Metadata) {
+	pbVarintField(b, 1, uint64(m.UID))
+	pbVarintField(b, 2, uint64(m.GID))
+	pbVarintField(b, 3, uint64(m.Mode))
+	var entry bytes.Buffer
+	for _, k := range sortedKeys(m.Xattrs) {
+		entry.Reset()
+		pbString(&entry, 1, k)
+		pbBytesField(&entry, 2, m.Xattrs[k])
+		pbBytesField(b, 4, entry.Bytes())
+	}
+}
+
+func pbUvarint(b *bytes.Buffer, v uint64) {
+	buf := make([]byte, binary.MaxVarintLen64)
+	b.Write(buf[:binary.PutUvarint(buf, v)])
+}
+
+func pbVarintField(b *bytes.Buffer, field int, v uint64) {
+	pbUvarint(b, uint64(field<<3|pbVarint))
+	pbUvarint(b, v)
+}
+
+func pbBytesField(b *bytes.Buffer, field int, v []byte) {
+	pbUvarint(b, uint64(field<<3|pbBytes))
+	pbUvarint(b, uint64(len(v)))
+	b.Write(v)
+}
+
+func pbString(b *bytes.Buffer, field int, s string) {
+	if s == "" {
+		return
+	}
+	pbBytesField(b, field, []byte(s))
+}
@@ -0,0 +1,373 @@
+/*
+Copyright 2020 Daniël Franke
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/ainmosni/mediasync-server/pkg/fs"
+)
+
+// manifestTestFiles are the manifests the encodings have to round-trip.
+func manifestTestFiles() map[string][]*fs.WebObject {
+	modTime := time.Date(2020, 5, 17, 12, 30, 45, 123456789, time.UTC)
+	return map[string][]*fs.WebObject{
+		"empty": {},
+		"minimal": {{
+			FilesystemObject: &fs.FilesystemObject{Path: "/data/a.mkv", ContentType: "video/x-matroska", Size: 3,
+				ModTime: modTime},
+			WebPath: "/files/a.mkv",
+		}},
+		"everything": {{
+			FilesystemObject: &fs.FilesystemObject{Path: "/data/b.mkv", ContentType: "video/x-matroska",
+				Size: 5 << 32, ModTime: modTime, ETag: `"abc"`, ID: "1234", Sparse: true, AllocatedSize: 4096,
+				LinkTarget: "../c.mkv"},
+			WebPath: "/files/b.mkv",
+			Tags:    []string{"new", "4k"},
+			Stale:   true,
+			Meta: &fs.Metadata{UID: 1000, GID: 100, Mode: 0o640,
+				Xattrs: map[string][]byte{"user.a": {0, 1}, "user.b": {}}},
+			Checksum:      "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855",
+			CaseCollision: true,
+			Priority:      300,
+		}},
+		"several": {
+			{
+				FilesystemObject: &fs.FilesystemObject{Path: "/data/dir", ContentType: "inode/directory", ModTime: modTime,
+					IsDir: true},
+				WebPath:  "/files/dir",
+				Priority: -2,
+			},
+			{
+				FilesystemObject: &fs.FilesystemObject{Path: "/data/dir/c.srt", ContentType: "text/plain", Size: 24,
+					ModTime: modTime.Add(time.Hour)},
+				WebPath: "/files/dir/c.srt",
+				Meta:    &fs.Metadata{Mode: 0o600},
+			},
+		},
+	}
+}
+
+func TestManifestRoundTrip(t *testing.T) {
+	encodings := map[string]struct {
+		encode func([]*fs.WebObject) []byte
+		decode func([]byte) ([]*fs.WebObject, error)
+	}{
+		"cbor":     {encodeManifestCBOR, decodeManifestCBOR},
+		"protobuf": {encodeManifestProtobuf, decodeManifestProtobuf},
+	}
+	for name, files := range manifestTestFiles() {
+		for encoding, e := range encodings {
+			t.Run(name+"/"+encoding, func(t *testing.T) {
+				got, err := e.decode(e.encode(files))
+				if err != nil {
+					t.Fatalf("decoding failed: %v", err)
+				}
+				if len(got) != len(files) {
+					t.Fatalf("decoded %d files, want %d", len(got), len(files))
+				}
+				for i := range files {
+					if !got[i].ModTime.Equal(files[i].ModTime) {
+						t.Errorf("file %d mod time = %s, want %s", i, got[i].ModTime, files[i].ModTime)
+					}
+					got[i].ModTime = files[i].ModTime
+					if !reflect.DeepEqual(got[i], files[i]) {
+						t.Errorf("file %d = %+v %+v %+v, want %+v %+v %+v", i, got[i].FilesystemObject, got[i], got[i].Meta,
+							files[i].FilesystemObject, files[i], files[i].Meta)
+					}
+				}
+			})
+		}
+	}
+}
+
+// cborDecoder decodes the subset of CBOR the manifest uses.
+type cborDecoder struct {
+	b []byte
+}
+
+func (d *cborDecoder) head() (byte, uint64, error) {
+	if len(d.b) == 0 {
+		return 0, 0, errors.New("unexpected end")
+	}
+	major, info := d.b[0]>>5, d.b[0]&0x1f
+	d.b = d.b[1:]
+	size := map[byte]int{24: 1, 25: 2, 26: 4, 27: 8}[info]
+	switch {
+	case info < 24:
+		return major, uint64(info), nil
+	case size == 0:
+		return major, uint64(info), nil
+	case len(d.b) < size:
+		return 0, 0, errors.New("unexpected end")
+	}
+	var n uint64
+	for _, c := range d.b[:size] {
+		n = n<<8 | uint64(c)
+	}
+	d.b = d.b[size:]
+	return major, n, nil
+}
+
+func (d *cborDecoder) value() (interface{}, error) {
+	major, n, err := d.head()
+	if err != nil {
+		return nil, err
+	}
+	switch major {
+	case cborUint:
+		return int64(n), nil
+	case cborNegInt:
+		return -1 - int64(n), nil
+	case cborBytes, cborText:
+		if uint64(len(d.b)) < n {
+			return nil, errors.New("unexpected end")
+		}
+		v := d.b[:n]
+		d.b = d.b[n:]
+		if major == cborText {
+			return string(v), nil
+		}
+		return append([]byte{}, v...), nil
+	case cborArray:
+		a := make([]interface{}, n)
+		for i := range a {
+			if a[i], err = d.value(); err != nil {
+				return nil, err
+			}
+		}
+		return a, nil
+	case cborMap:
+		m := make(map[string]interface{}, n)
+		for i := uint64(0); i < n; i++ {
+			k, err := d.value()
+			if err != nil {
+				return nil, err
+			}
+			if m[fmt.Sprint(k)], err = d.value(); err != nil {
+				return nil, err
+			}
+		}
+		return m, nil
+	case cborTag:
+		s, err := d.value()
+		if err != nil {
+			return nil, err
+		}
+		return time.Parse(time.RFC3339Nano, fmt.Sprint(s))
+	default:
+		switch n {
+		case cborTrue & 0x1f:
+			return true, nil
+		case cborFalse & 0x1f:
+			return false, nil
+		}
+		return nil, fmt.Errorf("unsupported simple value %d", n)
+	}
+}
+
+func decodeManifestCBOR(b []byte) ([]*fs.WebObject, error) {
+	d := &cborDecoder{b: b}
+	v, err := d.value()
+	if err != nil {
+		return nil, err
+	}
+	if len(d.b) != 0 {
+		return nil, errors.New("trailing data")
+	}
+	entries, ok := v.([]interface{})
+	if !ok {
+		return nil, errors.New("manifest isn't an array")
+	}
+	files := make([]*fs.WebObject, 0, len(entries))
+	for _, e := range entries {
+		m, _ := e.(map[string]interface{})
+		f := &fs.WebObject{FilesystemObject: &fs.FilesystemObject{}}
+		f.Path, _ = m["path"].(string)
+		f.ContentType, _ = m["content_type"].(string)
+		f.Size, _ = m["size"].(int64)
+		f.ModTime, _ = m["mod_time"].(time.Time)
+		f.IsDir, _ = m["is_dir"].(bool)
+		f.WebPath, _ = m["web_path"].(string)
+		if tags, ok := m["tags"].([]interface{}); ok {
+			for _, t := range tags {
+				f.Tags = append(f.Tags, t.(string))
+			}
+		}
+		f.ETag, _ = m["etag"].(string)
+		f.Stale, _ = m["stale"].(bool)
+		if meta, ok := m["meta"].(map[string]interface{}); ok {
+			uid, _ := meta["uid"].(int64)
+			gid, _ := meta["gid"].(int64)
+			mode, _ := meta["mode"].(int64)
+			f.Meta = &fs.Metadata{UID: uint32(uid), GID: uint32(gid), Mode: uint32(mode)}
+			if xattrs, ok := meta["xattrs"].(map[string]interface{}); ok {
+				f.Meta.Xattrs = make(map[string][]byte)
+				for k, v := range xattrs {
+					f.Meta.Xattrs[k] = v.([]byte)
+				}
+			}
+		}
+		f.Sparse, _ = m["sparse"].(bool)
+		f.AllocatedSize, _ = m["allocated_size"].(int64)
+		f.LinkTarget, _ = m["link_target"].(string)
+		f.CaseCollision, _ = m["case_collision"].(bool)
+		f.ID, _ = m["id"].(string)
+		f.Checksum, _ = m["checksum"].(string)
+		priority, _ := m["priority"].(int64)
+		f.Priority = int(priority)
+		files = append(files, f)
+	}
+	return files, nil
+}
+
+// pbField is a decoded protobuf field, varint or length delimited.
+type pbField struct {
+	num    int
+	varint uint64
+	bytes  []byte
+}
+
+func decodeProtobuf(b []byte) ([]pbField, error) {
+	var fields []pbField
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		if n <= 0 {
+			return nil, errors.New("invalid key")
+		}
+		b = b[n:]
+		f := pbField{num: int(key >> 3)}
+		v, n := binary.Uvarint(b)
+		if n <= 0 {
+			return nil, errors.New("invalid varint")
+		}
+		b = b[n:]
+		switch key & 7 {
+		case pbVarint:
+			f.varint = v
+		case pbBytes:
+			if uint64(len(b)) < v {
+				return nil, errors.New("unexpected end")
+			}
+			f.bytes, b = b[:v], b[v:]
+		default:
+			return nil, fmt.Errorf("unsupported wire type %d", key&7)
+		}
+		fields = append(fields, f)
+	}
+	return fields, nil
+}
+
+func decodeManifestProtobuf(b []byte) ([]*fs.WebObject, error) {
+	manifest, err := decodeProtobuf(b)
+	if err != nil {
+		return nil, err
+	}
+	files := make([]*fs.WebObject, 0, len(manifest))
+	for _, entry := range manifest {
+		msg, err := decodeProtobuf(entry.bytes)
+		if err != nil {
+			return nil, err
+		}
+		f := &fs.WebObject{FilesystemObject: &fs.FilesystemObject{}}
+		for _, field := range msg {
+			s := string(field.bytes)
+			switch field.num {
+			case 1:
+				f.Path = s
+			case 2:
+				f.ContentType = s
+			case 3:
+				f.Size = int64(field.varint)
+			case 4:
+				f.ModTime = time.Unix(0, int64(field.varint)).UTC()
+			case 5:
+				f.IsDir = field.varint != 0
+			case 6:
+				f.WebPath = s
+			case 7:
+				f.Tags = append(f.Tags, s)
+			case 8:
+				f.ETag = s
+			case 9:
+				f.Stale = field.varint != 0
+			case 10:
+				if f.Meta, err = decodeProtobufMeta(field.bytes); err != nil {
+					return nil, err
+				}
+			case 11:
+				f.Sparse = field.varint != 0
+			case 12:
+				f.AllocatedSize = int64(field.varint)
+			case 13:
+				f.LinkTarget = s
+			case 14:
+				f.CaseCollision = field.varint != 0
+			case 15:
+				f.ID = s
+			case 16:
+				f.Checksum = s
+			case 17:
+				f.Priority = int(int64(field.varint))
+			}
+		}
+		files = append(files, f)
+	}
+	return files, nil
+}
+
+func decodeProtobufMeta(b []byte) (*fs.Metadata, error) {
+	fields, err := decodeProtobuf(b)
+	if err != nil {
+		return nil, err
+	}
+	m := &fs.Metadata{}
+	for _, field := range fields {
+		switch field.num {
+		case 1:
+			m.UID = uint32(field.varint)
+		case 2:
+			m.GID = uint32(field.varint)
+		case 3:
+			m.Mode = uint32(field.varint)
+		case 4:
+			entry, err := decodeProtobuf(field.bytes)
+			if err != nil {
+				return nil, err
+			}
+			if m.Xattrs == nil {
+				m.Xattrs = make(map[string][]byte)
+			}
+			var k string
+			var v []byte
+			for _, e := range entry {
+				if e.num == 1 {
+					k = string(e.bytes)
+				} else {
+					v = e.bytes
+				}
+			}
+			m.Xattrs[k] = v
+		}
+	}
+	return m, nil
+}
@@ -0,0 +1,151 @@
+/*
+Copyright 2020 Daniël Franke
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	"github.com/ainmosni/mediasync-server/pkg/fs"
+)
+
+// metricsContentType is the Prometheus text exposition format.
+const metricsContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// Metrics serves what the server did and what it holds in the Prometheus text
+// format, gathered from the transfer accounting, the registry and checksums.
+type Metrics struct {
+	transfers *Transfers
+	registry  *fs.Registry
+	checksums *fs.Checksums
+	downloads int64 // atomic
+	deletes   int64 // atomic
+}
+
+// NewMetrics creates metrics over transfers, registry and checksums.
+func NewMetrics(transfers *Transfers, registry *fs.Registry, checksums *fs.Checksums) *Metrics {
+	return &Metrics{transfers: transfers, registry: registry, checksums: checksums}
+}
+
+// downloaded counts a download, a nil Metrics counts nothing.
+func (m *Metrics) downloaded() {
+	if m != nil {
+		atomic.AddInt64(&m.downloads, 1)
+	}
+}
+
+// deleted counts a deleted file, a nil Metrics counts nothing.
+func (m *Metrics) deleted() {
+	if m != nil {
+		atomic.AddInt64(&m.deletes, 1)
+	}
+}
+
+// ServeHTTP writes all metrics.
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var b bytes.Buffer
+	routes := m.transfers.Snapshot()
+	names := make([]string, 0, len(routes))
+	for route := range routes {
+		names = append(names, route)
+	}
+	sort.Strings(names)
+
+	for _, c := range routeCounters {
+		family(&b, c.name, "counter", c.help)
+		for _, route := range names {
+			sample(&b, c.name, "route", route, c.value(routes[route]))
+		}
+	}
+
+	statuses := m.transfers.Statuses()
+	codes := make([]int, 0, len(statuses))
+	for code := range statuses {
+		codes = append(codes, code)
+	}
+	sort.Ints(codes)
+	family(&b, "mediasync_http_responses_total", "counter", "Responses sent, by status code.")
+	for _, code := range codes {
+		sample(&b, "mediasync_http_responses_total", "code", fmt.Sprint(code), statuses[code])
+	}
+
+	family(&b, "mediasync_downloads_total", "counter", "Files downloaded.")
+	sample(&b, "mediasync_downloads_total", "", "", atomic.LoadInt64(&m.downloads))
+	family(&b, "mediasync_deletes_total", "counter", "Files deleted by clients.")
+	sample(&b, "mediasync_deletes_total", "", "", atomic.LoadInt64(&m.deletes))
+
+	stats := m.registry.Stats()
+	roots := make([]string, 0, len(stats))
+	for root := range stats {
+		roots = append(roots, root)
+	}
+	sort.Strings(roots)
+	family(&b, "mediasync_root_files", "gauge", "Files found by the last scan, by root.")
+	for _, root := range roots {
+		sample(&b, "mediasync_root_files", "root", root, stats[root].Files)
+	}
+	family(&b, "mediasync_root_scan_duration_seconds", "gauge", "How long the last scan took, by root.")
+	for _, root := range roots {
+		sample(&b, "mediasync_root_scan_duration_seconds", "root", root, stats[root].ScanDuration.Seconds())
+	}
+
+	family(&b, "mediasync_checksum_cache_entries", "gauge", "Checksums cached in memory.")
+	sample(&b, "mediasync_checksum_cache_entries", "", "", m.checksums.Cached())
+	family(&b, "mediasync_checksum_mismatches_total", "counter",
+		"Files read with another checksum than they have.")
+	sample(&b, "mediasync_checksum_mismatches_total", "", "", m.checksums.Mismatches())
+
+	w.Header().Set("Content-Type", metricsContentType)
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(b.Bytes())
+}
+
+// routeCounters are the metrics taken from the totals of every route.
+var routeCounters = []struct {
+	name, help string
+	value      func(RouteTransfers) int64
+}{
+	{"mediasync_bytes_served_total", "Bytes of response bodies sent, by route.",
+		func(rt RouteTransfers) int64 { return rt.Bytes }},
+	{"mediasync_requests_total", "Requests served, by route.",
+		func(rt RouteTransfers) int64 { return rt.Requests }},
+	{"mediasync_requests_aborted_total", "Responses that didn't fully reach the client, by route.",
+		func(rt RouteTransfers) int64 { return rt.Aborted }},
+	{"mediasync_panics_total", "Requests whose handler panicked, by route.",
+		func(rt RouteTransfers) int64 { return rt.Panics }},
+}
+
+// family writes the help and type lines of a metric.
+func family(b *bytes.Buffer, name, kind, help string) {
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// sample writes a value of a metric, with a single label unless label is empty.
+func sample(b *bytes.Buffer, name, label, value string, v interface{}) {
+	if label == "" {
+		fmt.Fprintf(b, "%s %v\n", name, v)
+		return
+	}
+	fmt.Fprintf(b, "%s{%s=\"%s\"} %v\n", name, label, labelEscaper.Replace(value), v)
+}
+
+// labelEscaper escapes label values as the text format wants them.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
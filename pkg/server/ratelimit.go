@@ -0,0 +1,103 @@
+/*
+Copyright 2020 Daniël Franke
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"errors"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ainmosni/mediasync-server/pkg/httputil"
+	"go.uber.org/zap"
+)
+
+// RateLimiter wraps handlers to limit the number of requests per client in
+// fixed windows. Every response carries the RateLimit-Limit, RateLimit-Remaining
+// and RateLimit-Reset headers, so clients can throttle themselves.
+type RateLimiter struct {
+	limit  int
+	window time.Duration
+	logger *zap.Logger
+
+	mu sync.Mutex
+	// start is when the current window started, counts are reset with it.
+	start  time.Time
+	counts map[string]int
+}
+
+// NewRateLimiter creates a new RateLimiter allowing limit requests per window.
+func NewRateLimiter(limit int, window time.Duration, logger *zap.Logger) *RateLimiter {
+	logger.Info("rate limiting requests", zap.Int("limit", limit), zap.Duration("window", window))
+	return &RateLimiter{
+		limit:  limit,
+		window: window,
+		logger: logger,
+		counts: make(map[string]int),
+	}
+}
+
+// Wrap returns h with rate limiting, a nil RateLimiter returns h as is.
+func (rl *RateLimiter) Wrap(h http.Handler) http.Handler {
+	if rl == nil {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		client := clientAddr(r)
+		remaining, reset := rl.take(client)
+
+		w.Header().Set("RateLimit-Limit", strconv.Itoa(rl.limit))
+		w.Header().Set("RateLimit-Remaining", strconv.Itoa(remaining))
+		w.Header().Set("RateLimit-Reset", strconv.Itoa(reset))
+		if remaining < 0 {
+			w.Header().Set("RateLimit-Remaining", "0")
+			w.Header().Set("Retry-After", strconv.Itoa(reset))
+			rl.logger.Info("rate limit exceeded", zap.String("client", client), zap.String("path", r.URL.Path))
+			httputil.ErrResponse(w, errors.New("rate limit exceeded"), http.StatusTooManyRequests)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// take counts a request of client, and returns the requests it has left, which
+// is negative when over the limit, and the seconds until the window resets.
+func (rl *RateLimiter) take(client string) (int, int) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(rl.start) >= rl.window {
+		rl.start = now
+		rl.counts = make(map[string]int)
+	}
+	rl.counts[client]++
+	reset := int(math.Ceil(rl.start.Add(rl.window).Sub(now).Seconds()))
+	return rl.limit - rl.counts[client], reset
+}
+
+// clientAddr returns the IP address of the client of r.
+func clientAddr(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,210 @@
+/*
+Copyright 2020 Daniël Franke
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/ainmosni/mediasync-server/pkg/httputil"
+	"go.uber.org/zap"
+)
+
+// recording is the metadata stored next to a recorded response body.
+type recording struct {
+	Method     string      `json:"method"`
+	RequestURI string      `json:"request_uri"`
+	StatusCode int         `json:"status_code"`
+	Header     http.Header `json:"header"`
+}
+
+// maxRecordedBody is the largest response body that gets recorded, larger
+// responses (mostly downloads) are served but not recorded.
+const maxRecordedBody = 1 << 20
+
+var errRecordingTooLarge = errors.New("response body too large to record")
+
+// recordedHeaders are the request headers that change the response, so they
+// are part of the recording key.
+var recordedHeaders = []string{"Range", "Accept", "Accept-Encoding", httputil.ChecksumAlgoHeader}
+
+// recordingKey maps a request to the file name its recording is stored under,
+// a new recording of the same request replaces the old one.
+func recordingKey(r *http.Request) string {
+	var b strings.Builder
+	b.WriteString(r.Method + " " + r.URL.RequestURI())
+	for _, h := range recordedHeaders {
+		b.WriteString("\n" + h + ": " + strings.Join(r.Header.Values(h), ", "))
+	}
+	sum := sha256.Sum256([]byte(b.String()))
+	return hex.EncodeToString(sum[:])
+}
+
+// Recorder wraps handlers to store all request/response pairs on disk, so they
+// can be served later by a ReplayHandler.
+type Recorder struct {
+	dir    string
+	logger *zap.Logger
+}
+
+// NewRecorder creates a new Recorder storing recordings in dir.
+func NewRecorder(dir string, logger *zap.Logger) (*Recorder, error) {
+	err := os.MkdirAll(dir, 0o750)
+	if err != nil {
+		return nil, err
+	}
+	logger.Info("recording requests", zap.String("dir", dir))
+	return &Recorder{
+		dir:    dir,
+		logger: logger,
+	}, nil
+}
+
+// Wrap returns h with recording, a nil Recorder returns h as is.
+func (rec *Recorder) Wrap(h http.Handler) http.Handler {
+	if rec == nil {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		logger := rec.logger.With(zap.String("path", r.URL.Path), zap.String("method", r.Method))
+		body, err := ioutil.TempFile(rec.dir, "body-")
+		if err != nil {
+			logger.Error("couldn't create recording, serving unrecorded", zap.Error(err))
+			h.ServeHTTP(w, r)
+			return
+		}
+		defer os.Remove(body.Name())
+		defer body.Close()
+
+		rw := &recordingWriter{ResponseWriter: w, body: body, status: http.StatusOK}
+		h.ServeHTTP(rw, r)
+
+		err = rec.store(r, rw, body.Name())
+		switch {
+		case errors.Is(err, errRecordingTooLarge):
+			logger.Debug("not recording response", zap.Error(err))
+		case err != nil:
+			logger.Error("couldn't store recording", zap.Error(err))
+		}
+	})
+}
+
+func (rec *Recorder) store(r *http.Request, rw *recordingWriter, bodyPath string) error {
+	if rw.err != nil {
+		return rw.err
+	}
+	meta, err := json.Marshal(recording{
+		Method:     r.Method,
+		RequestURI: r.URL.RequestURI(),
+		StatusCode: rw.status,
+		Header:     rw.Header(),
+	})
+	if err != nil {
+		return err
+	}
+
+	key := filepath.Join(rec.dir, recordingKey(r))
+	err = os.Rename(bodyPath, key+".body")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(key+".json", meta, 0o640)
+}
+
+// recordingWriter tees the response body to a file.
+type recordingWriter struct {
+	http.ResponseWriter
+	body    *os.File
+	status  int
+	written int64
+	err     error
+}
+
+func (rw *recordingWriter) WriteHeader(statusCode int) {
+	rw.status = statusCode
+	rw.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (rw *recordingWriter) Write(p []byte) (int, error) {
+	if rw.err == nil {
+		rw.written += int64(len(p))
+		if rw.written > maxRecordedBody {
+			rw.err = errRecordingTooLarge
+		} else {
+			_, rw.err = rw.body.Write(p)
+		}
+	}
+	return rw.ResponseWriter.Write(p)
+}
+
+// ReplayHandler serves previously recorded responses as a stub server.
+type ReplayHandler struct {
+	dir    string
+	logger *zap.Logger
+}
+
+// NewReplayHandler creates a new ReplayHandler serving recordings from dir.
+func NewReplayHandler(dir string, logger *zap.Logger) *ReplayHandler {
+	logger.Info("replaying recorded requests", zap.String("dir", dir))
+	return &ReplayHandler{
+		dir:    dir,
+		logger: logger,
+	}
+}
+
+// ServeHTTP for the ReplayHandler, serves the recording matching method and URL.
+func (h *ReplayHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	logger := h.logger.With(zap.String("path", r.URL.Path), zap.String("method", r.Method))
+	logger.Info("Received HTTP request")
+
+	key := filepath.Join(h.dir, recordingKey(r))
+	meta, err := ioutil.ReadFile(key + ".json")
+	if err != nil {
+		logger.Info("no recording found", zap.Error(err))
+		httputil.ErrResponse(w, errors.New("no recording for request"), http.StatusNotFound)
+		return
+	}
+	var rec recording
+	err = json.Unmarshal(meta, &rec)
+	if httputil.ErrResponse(w, err, http.StatusInternalServerError) {
+		logger.Error("couldn't decode recording", zap.Error(err))
+		return
+	}
+	body, err := os.Open(key + ".body")
+	if httputil.ErrResponse(w, err, http.StatusInternalServerError) {
+		logger.Error("couldn't open recorded body", zap.Error(err))
+		return
+	}
+	defer body.Close()
+
+	for k, v := range rec.Header {
+		w.Header()[k] = v
+	}
+	w.WriteHeader(rec.StatusCode)
+	_, err = io.Copy(w, body)
+	if err != nil {
+		logger.Error("couldn't write recorded body", zap.Error(err))
+	}
+}
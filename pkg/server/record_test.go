@@ -0,0 +1,116 @@
+/*
+Copyright 2020 Daniël Franke
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ainmosni/mediasync-server/pkg/httputil"
+	"go.uber.org/zap"
+)
+
+func TestRecordingKey(t *testing.T) {
+	base := httptest.NewRequest(http.MethodGet, "/files/a.mkv", nil)
+	tests := []struct {
+		name   string
+		method string
+		target string
+		header http.Header
+		same   bool
+	}{
+		{"identical", http.MethodGet, "/files/a.mkv", nil, true},
+		{"unrelated header", http.MethodGet, "/files/a.mkv", http.Header{"User-Agent": {"test"}}, true},
+		{"method", http.MethodHead, "/files/a.mkv", nil, false},
+		{"query", http.MethodGet, "/files/a.mkv?x=1", nil, false},
+		{"range", http.MethodGet, "/files/a.mkv", http.Header{"Range": {"bytes=0-9"}}, false},
+		{"accept", http.MethodGet, "/files/a.mkv", http.Header{"Accept": {"application/cbor"}}, false},
+		{"accept encoding", http.MethodGet, "/files/a.mkv", http.Header{"Accept-Encoding": {"gzip"}}, false},
+		{"checksum algo", http.MethodGet, "/files/a.mkv", http.Header{httputil.ChecksumAlgoHeader: {"sha256"}}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, tt.target, nil)
+			for k, v := range tt.header {
+				r.Header.Set(k, v[0])
+			}
+			if got := recordingKey(r) == recordingKey(base); got != tt.same {
+				t.Errorf("recordingKey() same = %v, want %v", got, tt.same)
+			}
+		})
+	}
+}
+
+func TestRecorderBodyCap(t *testing.T) {
+	tests := []struct {
+		name     string
+		size     int
+		recorded bool
+	}{
+		{"small", 10, true},
+		{"at cap", maxRecordedBody, true},
+		{"over cap", maxRecordedBody + 1, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "recordings")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			rec, err := NewRecorder(dir, zap.NewNop())
+			if err != nil {
+				t.Fatal(err)
+			}
+			body := bytes.Repeat([]byte("x"), tt.size)
+			h := rec.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				// Write in chunks, like io.Copy does for downloads.
+				for p := body; len(p) > 0; {
+					n := 32 << 10
+					if n > len(p) {
+						n = len(p)
+					}
+					_, _ = w.Write(p[:n])
+					p = p[n:]
+				}
+			}))
+			r := httptest.NewRequest(http.MethodGet, "/files/a.mkv", nil)
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if w.Body.Len() != tt.size {
+				t.Errorf("served %d bytes, want %d", w.Body.Len(), tt.size)
+			}
+
+			got, err := ioutil.ReadFile(filepath.Join(dir, recordingKey(r)+".body"))
+			if recorded := err == nil; recorded != tt.recorded {
+				t.Fatalf("recorded = %v, want %v", recorded, tt.recorded)
+			}
+			if tt.recorded && !bytes.Equal(got, body) {
+				t.Errorf("recorded %d bytes, want %d", len(got), len(body))
+			}
+			files, _ := ioutil.ReadDir(dir)
+			if !tt.recorded && len(files) != 0 {
+				t.Errorf("left %d files behind", len(files))
+			}
+		})
+	}
+}
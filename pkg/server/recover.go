@@ -0,0 +1,73 @@
+/*
+Copyright 2020 Daniël Franke
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+
+	"github.com/ainmosni/mediasync-server/pkg/httputil"
+	"go.uber.org/zap"
+)
+
+// errorIDBytes is the length of the IDs tying error responses to the log.
+const errorIDBytes = 8
+
+// recoverPanics wraps h so a panicking handler fails only its own request. The
+// client gets a 500 with an error ID, the panic is logged with its stack under
+// the same ID and counted for the route. Responses that already started are
+// aborted instead, and http.ErrAbortHandler, which aborts on purpose, is
+// passed on.
+func (s Server) recoverPanics(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			v := recover()
+			if v == nil {
+				return
+			}
+			if v == http.ErrAbortHandler {
+				panic(v)
+			}
+			id := errorID()
+			s.transfers.panicked(s.router.Route(r))
+			s.logger.Error("handler panicked",
+				zap.String("error_id", id),
+				zap.String("method", r.Method),
+				zap.String("path", r.URL.Path),
+				zap.Any("panic", v),
+				zap.Stack("stack"))
+			if cw, ok := w.(*countingWriter); ok && cw.wrote {
+				panic(http.ErrAbortHandler)
+			}
+			b, _ := json.Marshal(struct {
+				Error   string `json:"error"`
+				ErrorID string `json:"error_id"`
+			}{"internal error", id})
+			httputil.JSONResponse(w, b, http.StatusInternalServerError)
+		}()
+		h.ServeHTTP(w, r)
+	})
+}
+
+// errorID returns a random ID for an error.
+func errorID() string {
+	b := make([]byte, errorIDBytes)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
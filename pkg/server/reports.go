@@ -0,0 +1,262 @@
+/*
+Copyright 2020 Daniël Franke
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"sort"
+
+	"github.com/ainmosni/mediasync-server/pkg/fs"
+	"github.com/ainmosni/mediasync-server/pkg/httputil"
+	"go.uber.org/zap"
+)
+
+// ReportsHandler serves reports about the library, under /reports/{name}.
+type ReportsHandler struct {
+	registry   *fs.Registry
+	allowDedup bool
+	history    *ReportHistory
+	checksums  *fs.Checksums
+	cleanLock  *fs.FileLock
+	logger     *zap.Logger
+}
+
+// NewReportsHandler creates a new ReportsHandler, allowDedup enables replacing
+// duplicate files with hardlinks.
+func NewReportsHandler(registry *fs.Registry, allowDedup bool, logger *zap.Logger) *ReportsHandler {
+	return &ReportsHandler{
+		registry:   registry,
+		allowDedup: allowDedup,
+		checksums:  fs.NewChecksums(logger),
+		logger:     logger,
+	}
+}
+
+// SetChecksums hashes the candidate duplicates with c, so known checksums are
+// used and new ones cached.
+func (h *ReportsHandler) SetChecksums(c *fs.Checksums) {
+	h.checksums = c
+}
+
+// SetCleanLock makes deduplicating hold lock, shared with other instances.
+func (h *ReportsHandler) SetCleanLock(lock *fs.FileLock) {
+	h.cleanLock = lock
+}
+
+// SetHistory serves the scheduled reports of history as the history report.
+func (h *ReportsHandler) SetHistory(history *ReportHistory) {
+	h.history = history
+}
+
+// ServeHTTP for the ReportsHandler, routes to the report named in the path.
+func (h *ReportsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	logger := h.logger.With(zap.String("path", r.URL.Path), zap.String("method", r.Method))
+	logger.Info("Received HTTP request")
+	// Reports cover, and deduplication links, files of every root.
+	if claims := claimsFrom(r.Context()); claims != nil && len(claims.Paths) > 0 {
+		httputil.ErrResponse(w, errors.New("reports need a token valid for all paths"), http.StatusForbidden)
+		return
+	}
+
+	var report interface{}
+	var err error
+	switch name := PathParam(r, "name"); {
+	case name == "duplicates" && r.Method == "GET":
+		report, err = h.duplicates(r.Context(), false)
+	case name == "duplicates" && r.Method == "POST":
+		if !h.allowDedup {
+			httputil.ErrResponse(w, errors.New("deduplication is disabled"), http.StatusForbidden)
+			return
+		}
+		report, err = h.duplicates(r.Context(), true)
+	case name == "top" && r.Method == "GET":
+		n, less, perr := topParams(r)
+		if httputil.ErrResponse(w, perr, http.StatusBadRequest) {
+			return
+		}
+		report, err = h.top(r.Context(), n, less)
+	case name == "orphans" && r.Method == "GET":
+		report = h.registry.Orphans()
+	case name == "quarantine" && r.Method == "GET":
+		report = h.registry.Quarantined()
+	case name == "history" && h.history != nil && r.Method == "GET":
+		report = h.history.Entries()
+	case name == "duplicates", name == "top", name == "orphans", name == "quarantine",
+		name == "history" && h.history != nil:
+		httputil.ErrResponse(w, errors.New("method not supported"), http.StatusMethodNotAllowed)
+		return
+	default:
+		httputil.ErrResponse(w, errors.New("unknown report"), http.StatusNotFound)
+		return
+	}
+	if httputil.ErrResponse(w, err, http.StatusInternalServerError) {
+		logger.Error("couldn't generate report", zap.Error(err))
+		return
+	}
+
+	b, err := json.Marshal(report)
+	if httputil.ErrResponse(w, err, http.StatusInternalServerError) {
+		logger.Error("couldn't encode to JSON", zap.Error(err))
+		return
+	}
+	httputil.JSONResponse(w, b, http.StatusOK)
+}
+
+const defaultTopN = 100
+
+// topParams parses n and by for the top report into a count and an ordering.
+func topParams(r *http.Request) (int, func(a, b *fs.WebObject) bool, error) {
+	n, err := intParam(r.URL.Query().Get("n"), defaultTopN)
+	if err != nil {
+		return 0, nil, err
+	}
+	switch by := r.URL.Query().Get("by"); by {
+	case "", "size":
+		return n, func(a, b *fs.WebObject) bool { return a.Size > b.Size }, nil
+	case "age":
+		return n, func(a, b *fs.WebObject) bool { return a.ModTime.Before(b.ModTime) }, nil
+	default:
+		return 0, nil, errors.New("unknown sort: " + by)
+	}
+}
+
+// top returns the first n files according to less, from the last scan.
+func (h *ReportsHandler) top(ctx context.Context, n int, less func(a, b *fs.WebObject) bool) ([]*fs.WebObject, error) {
+	files, err := h.registry.IndexedFiles(ctx)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(files, func(i, j int) bool { return less(files[i], files[j]) })
+	if len(files) > n {
+		files = files[:n]
+	}
+	return files, nil
+}
+
+type duplicateGroup struct {
+	Checksum    string   `json:"checksum"`
+	Size        int64    `json:"size"`
+	Files       []string `json:"files"`
+	WastedBytes int64    `json:"wasted_bytes"`
+	Linked      int      `json:"linked,omitempty"`
+}
+
+type duplicatesReport struct {
+	Groups      []*duplicateGroup `json:"groups"`
+	WastedBytes int64             `json:"wasted_bytes"`
+}
+
+// duplicates groups identical files across all roots. Only files sharing their
+// size with another file get hashed. With dedup, all but the first file of a
+// group are replaced by hardlinks to it.
+func (h *ReportsHandler) duplicates(ctx context.Context, dedup bool) (*duplicatesReport, error) {
+	files, err := h.registry.ScanAllFiles(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	bySize := make(map[int64][]*fs.WebObject)
+	for _, f := range files {
+		if f.Size > 0 {
+			bySize[f.Size] = append(bySize[f.Size], f)
+		}
+	}
+
+	report := &duplicatesReport{Groups: []*duplicateGroup{}}
+	for size, candidates := range bySize {
+		if len(candidates) < 2 {
+			continue
+		}
+		byChecksum := make(map[string][]*fs.WebObject)
+		for _, f := range candidates {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+			sum, err := h.checksums.Sum(ctx, f.FilesystemObject)
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			if err != nil {
+				h.logger.Info("skipping file", zap.String(fs.PathKey, f.Path), zap.Error(err))
+				continue
+			}
+			if !isLinked(byChecksum[sum], f) {
+				byChecksum[sum] = append(byChecksum[sum], f)
+			}
+		}
+
+		for sum, same := range byChecksum {
+			if len(same) < 2 {
+				continue
+			}
+			g := &duplicateGroup{Checksum: sum, Size: size, WastedBytes: size * int64(len(same)-1)}
+			for _, f := range same {
+				g.Files = append(g.Files, f.WebPath)
+			}
+			if dedup {
+				g.Linked = h.hardlink(ctx, same, sum)
+			}
+			report.Groups = append(report.Groups, g)
+			report.WastedBytes += g.WastedBytes
+		}
+	}
+
+	sort.Slice(report.Groups, func(i, j int) bool { return report.Groups[i].WastedBytes > report.Groups[j].WastedBytes })
+	return report, nil
+}
+
+// hardlink replaces all files with links to the first one, and returns how many
+// were replaced. Files that changed since they were hashed, that differ in
+// owner or mode, or that are on other filesystems are left alone.
+func (h *ReportsHandler) hardlink(ctx context.Context, files []*fs.WebObject, sum string) int {
+	linked := 0
+	_ = h.cleanLock.Do(func() error {
+		for _, f := range files[1:] {
+			err := fs.LinkDuplicate(ctx, files[0].FilesystemObject, f.FilesystemObject, sum)
+			if err != nil {
+				h.logger.Info("couldn't hardlink duplicate", zap.String(fs.PathKey, f.Path), zap.Error(err))
+				continue
+			}
+			linked++
+		}
+		return nil
+	})
+	return linked
+}
+
+// isLinked reports whether f is a hardlink to one of files, which doesn't waste space.
+func isLinked(files []*fs.WebObject, f *fs.WebObject) bool {
+	info := fileInfo(f.Path)
+	for _, o := range files {
+		if info != nil && os.SameFile(info, fileInfo(o.Path)) {
+			return true
+		}
+	}
+	return false
+}
+
+func fileInfo(p string) os.FileInfo {
+	info, err := os.Stat(p)
+	if err != nil {
+		return nil
+	}
+	return info
+}
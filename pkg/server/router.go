@@ -0,0 +1,216 @@
+/*
+Copyright 2020 Daniël Franke
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/ainmosni/mediasync-server/pkg/httputil"
+)
+
+// paramsKey is the context key of the path parameters of a request.
+type paramsKey struct{}
+
+// PathParam returns the value of the {name} segment of the route r matched.
+func PathParam(r *http.Request, name string) string {
+	params, _ := r.Context().Value(paramsKey{}).(map[string]string)
+	return params[name]
+}
+
+// Router routes requests by path and method. Patterns work like those of
+// http.ServeMux, a trailing slash matches the whole subtree, and {name}
+// segments match any single segment, see PathParam. Exact patterns win over
+// subtrees, then the pattern with most literal segments wins.
+type Router struct {
+	mu     sync.RWMutex
+	routes map[string]*route
+}
+
+type route struct {
+	pattern  string
+	segments []string
+	subtree  bool
+	// handlers are by method, "" handles all methods.
+	handlers map[string]http.Handler
+	methods  []string
+}
+
+// NewRouter returns a new, empty Router.
+func NewRouter() *Router {
+	return &Router{routes: make(map[string]*route)}
+}
+
+// Handle registers h for pattern and methods, without methods h handles all
+// of them. A pattern can be registered again for other methods.
+func (rt *Router) Handle(pattern string, h http.Handler, methods ...string) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	rr, ok := rt.routes[pattern]
+	if !ok {
+		rr = &route{
+			pattern:  pattern,
+			segments: splitPath(pattern),
+			subtree:  strings.HasSuffix(pattern, "/"),
+			handlers: make(map[string]http.Handler),
+		}
+		rt.routes[pattern] = rr
+	}
+	if len(methods) == 0 {
+		rr.handlers[""] = h
+		return
+	}
+	for _, m := range methods {
+		rr.handlers[m] = h
+		rr.methods = append(rr.methods, m)
+	}
+	sort.Strings(rr.methods)
+}
+
+// Route returns the pattern r is routed to, empty when there's none.
+func (rt *Router) Route(r *http.Request) string {
+	rr, _ := rt.match(r.URL.Path)
+	if rr == nil {
+		return ""
+	}
+	return rr.pattern
+}
+
+// ServeHTTP dispatches r to the handler for its path and method. OPTIONS is
+// answered with the allowed methods, other methods get a 405.
+func (rt *Router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if p := cleanPath(r.URL.Path); p != r.URL.Path {
+		u := *r.URL
+		u.Path = p
+		http.Redirect(w, r, u.String(), http.StatusMovedPermanently)
+		return
+	}
+	rr, params := rt.match(r.URL.Path)
+	if rr == nil {
+		if sub, _ := rt.match(r.URL.Path + "/"); sub != nil && sub.pattern == r.URL.Path+"/" {
+			u := *r.URL
+			u.Path += "/"
+			http.Redirect(w, r, u.String(), http.StatusMovedPermanently)
+			return
+		}
+		httputil.ErrResponse(w, errors.New("not found"), http.StatusNotFound)
+		return
+	}
+	if len(params) > 0 {
+		r = r.WithContext(context.WithValue(r.Context(), paramsKey{}, params))
+	}
+
+	h, ok := rr.handlers[r.Method]
+	if !ok {
+		h, ok = rr.handlers[""]
+	}
+	if ok {
+		h.ServeHTTP(w, r)
+		return
+	}
+	allow := strings.Join(append(append([]string{}, rr.methods...), "OPTIONS"), ", ")
+	w.Header().Set("Allow", allow)
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	httputil.ErrResponse(w, errors.New("method not supported"), http.StatusMethodNotAllowed)
+}
+
+// match finds the best route for p, and the values of its parameters.
+func (rt *Router) match(p string) (*route, map[string]string) {
+	rt.mu.RLock()
+	defer rt.mu.RUnlock()
+	segments := splitPath(p)
+	var best *route
+	var bestParams map[string]string
+	bestLiterals := -1
+	for _, rr := range rt.routes {
+		params, literals, ok := rr.matches(p, segments)
+		if !ok {
+			continue
+		}
+		if best == nil || better(rr, literals, best, bestLiterals) {
+			best, bestParams, bestLiterals = rr, params, literals
+		}
+	}
+	return best, bestParams
+}
+
+// better reports whether route a with literals literal segments beats b.
+func better(a *route, literals int, b *route, bLiterals int) bool {
+	if a.subtree != b.subtree {
+		return !a.subtree
+	}
+	if literals != bLiterals {
+		return literals > bLiterals
+	}
+	return len(a.segments) > len(b.segments)
+}
+
+// matches reports whether the path p, split into segments, matches the route.
+func (rr *route) matches(p string, segments []string) (map[string]string, int, bool) {
+	if rr.subtree {
+		if len(segments) < len(rr.segments) || !strings.HasSuffix(p, "/") && len(segments) == len(rr.segments) {
+			return nil, 0, false
+		}
+	} else if len(segments) != len(rr.segments) {
+		return nil, 0, false
+	}
+	var params map[string]string
+	literals := 0
+	for i, s := range rr.segments {
+		if strings.HasPrefix(s, "{") && strings.HasSuffix(s, "}") {
+			if params == nil {
+				params = make(map[string]string)
+			}
+			params[s[1:len(s)-1]] = segments[i]
+			continue
+		}
+		if s != segments[i] {
+			return nil, 0, false
+		}
+		literals++
+	}
+	return params, literals, true
+}
+
+// splitPath splits p into its non-empty segments.
+func splitPath(p string) []string {
+	return strings.FieldsFunc(p, func(r rune) bool { return r == '/' })
+}
+
+// cleanPath returns the canonical form of p like http.ServeMux does, keeping a
+// trailing slash.
+func cleanPath(p string) string {
+	if p == "" {
+		return "/"
+	}
+	if p[0] != '/' {
+		p = "/" + p
+	}
+	np := path.Clean(p)
+	if strings.HasSuffix(p, "/") && np != "/" {
+		np += "/"
+	}
+	return np
+}
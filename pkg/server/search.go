@@ -0,0 +1,215 @@
+/*
+Copyright 2020 Daniël Franke
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/ainmosni/mediasync-server/pkg/fs"
+	"github.com/ainmosni/mediasync-server/pkg/httputil"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultSearchLimit = 100
+	maxSearchLimit     = 1000
+)
+
+type searchResults struct {
+	Total   int           `json:"total"`
+	Offset  int           `json:"offset"`
+	Limit   int           `json:"limit"`
+	Results []interface{} `json:"results"`
+}
+
+// SearchHandler finds files by web path, so clients don't need the full manifest.
+type SearchHandler struct {
+	registry  *fs.Registry
+	textIndex *fs.TextIndex
+	logger    *zap.Logger
+}
+
+// NewSearchHandler creates a new SearchHandler, content search is only
+// available when textIndex isn't nil.
+func NewSearchHandler(registry *fs.Registry, textIndex *fs.TextIndex, logger *zap.Logger) *SearchHandler {
+	return &SearchHandler{
+		registry:  registry,
+		textIndex: textIndex,
+		logger:    logger,
+	}
+}
+
+// ServeHTTP for the SearchHandler. It takes q, mode (substring, glob, fuzzy or
+// content), offset and limit query parameters.
+func (h *SearchHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	logger := h.logger.With(zap.String("path", r.URL.Path), zap.String("method", r.Method))
+	logger.Info("Received HTTP request")
+	if r.Method != "GET" {
+		httputil.ErrResponse(w, errors.New("method not supported"), http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	q := query.Get("q")
+	if q == "" {
+		httputil.ErrResponse(w, errors.New("q is required"), http.StatusBadRequest)
+		return
+	}
+	offset, err := intParam(query.Get("offset"), 0)
+	if httputil.ErrResponse(w, err, http.StatusBadRequest) {
+		return
+	}
+	limit, err := intParam(query.Get("limit"), defaultSearchLimit)
+	if httputil.ErrResponse(w, err, http.StatusBadRequest) {
+		return
+	}
+	if limit > maxSearchLimit {
+		limit = maxSearchLimit
+	}
+
+	mode := query.Get("mode")
+	if mode == "content" && h.textIndex == nil {
+		httputil.ErrResponse(w, errors.New("content search is disabled"), http.StatusBadRequest)
+		return
+	}
+
+	var match func(string) (bool, int)
+	switch mode {
+	case "", "substring":
+		lq := strings.ToLower(q)
+		match = func(p string) (bool, int) { return strings.Contains(strings.ToLower(p), lq), 0 }
+	case "glob":
+		if _, err := path.Match(q, ""); err != nil {
+			httputil.ErrResponse(w, err, http.StatusBadRequest)
+			return
+		}
+		match = func(p string) (bool, int) { return globMatch(q, p), 0 }
+	case "fuzzy":
+		lq := strings.ToLower(q)
+		match = func(p string) (bool, int) { return fuzzyMatch(lq, strings.ToLower(p)) }
+	case "content":
+		// Content is matched by the text index, not on the path.
+	default:
+		httputil.ErrResponse(w, errors.New("unknown mode: "+mode), http.StatusBadRequest)
+		return
+	}
+
+	files, err := h.registry.IndexedFiles(r.Context())
+	if httputil.ErrResponse(w, err, http.StatusInternalServerError) {
+		logger.Error("Couldn't list files.", zap.Error(err))
+		return
+	}
+
+	files = scopedFiles(r.Context(), files)
+
+	var hits []interface{}
+	if mode == "content" {
+		matches, err := h.textIndex.Search(r.Context(), files, q)
+		if httputil.ErrResponse(w, err, http.StatusInternalServerError) {
+			logger.Error("Couldn't search file contents.", zap.Error(err))
+			return
+		}
+		for _, m := range matches {
+			hits = append(hits, m)
+		}
+	} else {
+		hits = matchPaths(files, match)
+	}
+
+	res := searchResults{Total: len(hits), Offset: offset, Limit: limit, Results: []interface{}{}}
+	for i := offset; i < len(hits) && i < offset+limit; i++ {
+		res.Results = append(res.Results, hits[i])
+	}
+	b, err := json.Marshal(res)
+	if httputil.ErrResponse(w, err, http.StatusInternalServerError) {
+		logger.Error("couldn't encode to JSON", zap.Error(err))
+		return
+	}
+	httputil.JSONResponse(w, b, http.StatusOK)
+}
+
+// matchPaths returns the files whose web path matches, best scores first and
+// by web path within a score, so pages are stable between requests.
+func matchPaths(files []*fs.WebObject, match func(string) (bool, int)) []interface{} {
+	type hit struct {
+		f     *fs.WebObject
+		score int
+	}
+	hits := make([]hit, 0)
+	for _, f := range files {
+		if ok, score := match(f.WebPath); ok {
+			hits = append(hits, hit{f, score})
+		}
+	}
+	sort.Slice(hits, func(i, j int) bool {
+		if hits[i].score != hits[j].score {
+			return hits[i].score < hits[j].score
+		}
+		return hits[i].f.WebPath < hits[j].f.WebPath
+	})
+
+	r := make([]interface{}, 0, len(hits))
+	for _, h := range hits {
+		r = append(r, h.f)
+	}
+	return r
+}
+
+func intParam(v string, def int) (int, error) {
+	if v == "" {
+		return def, nil
+	}
+	i, err := strconv.Atoi(v)
+	if err != nil || i < 0 {
+		return 0, errors.New("invalid number: " + v)
+	}
+	return i, nil
+}
+
+// globMatch matches patterns without a slash against the file name only.
+func globMatch(pattern, webPath string) bool {
+	if !strings.Contains(pattern, "/") {
+		webPath = path.Base(webPath)
+	}
+	ok, _ := path.Match(pattern, webPath)
+	return ok
+}
+
+// fuzzyMatch checks if all characters of q appear in order in p, the score is
+// the number of characters skipped in between, so tighter matches sort first.
+func fuzzyMatch(q, p string) (bool, int) {
+	score := 0
+	start := -1
+	qi := 0
+	for pi := 0; pi < len(p) && qi < len(q); pi++ {
+		if p[pi] != q[qi] {
+			continue
+		}
+		if start >= 0 {
+			score += pi - start - 1
+		}
+		start = pi
+		qi++
+	}
+	return qi == len(q), score
+}
@@ -0,0 +1,64 @@
+/*
+Copyright 2020 Daniël Franke
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/ainmosni/mediasync-server/pkg/fs"
+)
+
+func TestMatchPaths(t *testing.T) {
+	files := []*fs.WebObject{
+		{WebPath: "/files/b/show.mkv"},
+		{WebPath: "/files/show.mkv"},
+		{WebPath: "/files/a/show.mkv"},
+		{WebPath: "/files/s.h.o.w.mkv"},
+		{WebPath: "/files/other.mkv"},
+	}
+	tests := []struct {
+		name  string
+		query string
+		fuzzy bool
+		want  []string
+	}{
+		{"substring ties by path", "show", false, []string{"/files/a/show.mkv", "/files/b/show.mkv", "/files/show.mkv"}},
+		{"fuzzy by score then path", "show", true, []string{"/files/show.mkv", "/files/a/show.mkv", "/files/b/show.mkv", "/files/s.h.o.w.mkv"}},
+		{"no match", "nothing", false, []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			match := func(p string) (bool, int) { return strings.Contains(p, tt.query), 0 }
+			if tt.fuzzy {
+				match = func(p string) (bool, int) { return fuzzyMatch(tt.query, p) }
+			}
+			// The order of the index mustn't matter.
+			for i := 0; i < len(files); i++ {
+				rotated := append(append([]*fs.WebObject{}, files[i:]...), files[:i]...)
+				got := make([]string, 0)
+				for _, h := range matchPaths(rotated, match) {
+					got = append(got, h.(*fs.WebObject).WebPath)
+				}
+				if !reflect.DeepEqual(got, tt.want) {
+					t.Errorf("matchPaths() = %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
@@ -18,34 +18,260 @@ limitations under the License.
 package server
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
 	"net"
 	"net/http"
 	"strconv"
+	"time"
 
+	"github.com/ainmosni/mediasync-server/pkg/httputil"
 	"go.uber.org/zap"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 )
 
+const defaultNetwork = "tcp"
+
 type Server struct {
-	host   string
-	port   int
-	logger *zap.Logger
+	listeners []Listener
+	h2c       bool
+	// tlsCert and tlsKey are the files of the certificate served, empty when
+	// we serve plain HTTP.
+	tlsCert string
+	tlsKey  string
+	// clientCAs verify client certificates, nil when they aren't required.
+	clientCAs      *x509.CertPool
+	maxHeaderBytes int
+	maxBodyBytes   int64
+	// bodyLimits replace maxBodyBytes for some routes, by method and pattern.
+	bodyLimits map[string]int64
+	transfers  *Transfers
+	// keepAlive is the TCP keepalive period of client connections.
+	keepAlive       time.Duration
+	stallAfter      time.Duration
+	stallAbortAfter time.Duration
+	// shutdownTimeout is how long requests in flight get to finish.
+	shutdownTimeout time.Duration
+	middleware      []Middleware
+	router          *Router
+	logger          *zap.Logger
+}
+
+// Middleware wraps a handler with behaviour common to all routes.
+type Middleware func(http.Handler) http.Handler
+
+// Listener describes an address the server binds to.
+type Listener struct {
+	Network string `json:"network"`
+	Host    string `json:"host"`
+	Port    int    `json:"port"`
+}
+
+// Address returns the host:port combination, with IPv6 literals bracketed.
+func (l Listener) Address() string {
+	return net.JoinHostPort(l.Host, strconv.Itoa(l.Port))
 }
 
 // New returns a new server.
 func New(host string, port int, logger *zap.Logger) *Server {
 	return &Server{
-		host:   host,
-		port:   port,
-		logger: logger,
+		listeners:  []Listener{{Network: defaultNetwork, Host: host, Port: port}},
+		transfers:  NewTransfers(),
+		bodyLimits: make(map[string]int64),
+		router:     NewRouter(),
+		logger:     logger,
+	}
+}
+
+// Listen adds an extra address to bind to, network defaults to tcp.
+func (s *Server) Listen(network, host string, port int) {
+	if network == "" {
+		network = defaultNetwork
+	}
+	s.listeners = append(s.listeners, Listener{Network: network, Host: host, Port: port})
+}
+
+// EnableH2C makes the server accept cleartext HTTP/2 next to HTTP/1.x.
+func (s *Server) EnableH2C() {
+	s.h2c = true
+}
+
+// EnableTLS makes the server serve HTTPS, with the PEM encoded certificate and
+// key in the given files. Clients need TLS 1.2 or newer.
+func (s *Server) EnableTLS(certFile, keyFile string) {
+	s.tlsCert = certFile
+	s.tlsKey = keyFile
+}
+
+// RequireClientCerts makes TLS connections require a client certificate signed
+// by one of the PEM encoded CAs in caFile, see EnableTLS.
+func (s *Server) RequireClientCerts(caFile string) error {
+	b, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return fmt.Errorf("no certificates in %s", caFile)
+	}
+	s.clientCAs = pool
+	return nil
+}
+
+// SetLimits sets the maximum size of request headers and bodies, zero keeps
+// the defaults of net/http, which doesn't limit bodies.
+func (s *Server) SetLimits(maxHeaderBytes int, maxBodyBytes int64) {
+	s.maxHeaderBytes = maxHeaderBytes
+	s.maxBodyBytes = maxBodyBytes
+}
+
+// SetBodyLimit replaces the body limit of SetLimits for requests with method
+// routed to pattern, zero doesn't limit them.
+func (s *Server) SetBodyLimit(method, pattern string, maxBodyBytes int64) {
+	s.bodyLimits[method+" "+pattern] = maxBodyBytes
+}
+
+// SetKeepAlive sets the TCP keepalive period of client connections, so dead
+// peers are noticed. Zero keeps the default of net, negative disables it.
+func (s *Server) SetKeepAlive(period time.Duration) {
+	s.keepAlive = period
+}
+
+// SetShutdownTimeout sets how long requests in flight get to finish when the
+// server is stopped, after that their connections are closed.
+func (s *Server) SetShutdownTimeout(timeout time.Duration) {
+	s.shutdownTimeout = timeout
+}
+
+// Transfers returns the accounting of the bytes sent per route.
+func (s *Server) Transfers() *Transfers {
+	return s.transfers
+}
+
+// Listeners returns all addresses the server binds to.
+func (s *Server) Listeners() []Listener {
+	return s.listeners
+}
+
+// Use adds middleware applied to every request, in the order given. The first
+// middleware added sees requests first.
+func (s *Server) Use(mw ...Middleware) {
+	s.middleware = append(s.middleware, mw...)
+}
+
+// chain wraps h with all middleware.
+func (s Server) chain(h http.Handler) http.Handler {
+	for i := len(s.middleware) - 1; i >= 0; i-- {
+		h = s.middleware[i](h)
 	}
+	return h
 }
 
-// Handle is just a simple wrapper around http.Handle for now, will add more here later.
-func (s Server) Handle(path string, handler http.Handler) {
-	http.Handle(path, handler)
+// Handle registers handler for the path pattern and the given methods, without
+// methods it gets all of them. See Router for the patterns.
+func (s Server) Handle(pattern string, handler http.Handler, methods ...string) {
+	s.router.Handle(pattern, handler, methods...)
 }
 
-// Serve creates a new server.
-func (s Server) Serve() error {
-	return http.ListenAndServe(net.JoinHostPort(s.host, strconv.Itoa(s.port)), nil)
+// Handler returns the handler of all registered routes, with the middleware
+// and access log, so the server can be run by something else, like tests.
+func (s Server) Handler() http.Handler {
+	return s.accessLog(s.recoverPanics(s.limitBody(s.chain(s.router))))
+}
+
+// Serve binds to all listeners and serves until one of them fails, or until
+// ctx is done. Then it stops accepting connections and waits for requests in
+// flight, up to the shutdown timeout, and returns nil.
+func (s Server) Serve(ctx context.Context) error {
+	listeners := make([]net.Listener, 0, len(s.listeners))
+	for _, l := range s.listeners {
+		lc := net.ListenConfig{KeepAlive: s.keepAlive}
+		nl, err := lc.Listen(context.Background(), l.Network, l.Address())
+		if err != nil {
+			for _, open := range listeners {
+				open.Close()
+			}
+			return fmt.Errorf("couldn't listen on %s: %w", l.Address(), err)
+		}
+		s.logger.Info("listening", zap.String("network", l.Network), zap.String("address", l.Address()))
+		listeners = append(listeners, nl)
+	}
+
+	// Oversized headers are answered with 431 by net/http itself.
+	srv := &http.Server{
+		Handler:        s.Handler(),
+		MaxHeaderBytes: s.maxHeaderBytes,
+		ConnContext:    withConn,
+	}
+	switch {
+	case s.tlsCert != "":
+		// HTTP/2 is negotiated over TLS, h2c isn't needed.
+		s.logger.Info("enabling TLS", zap.String("cert", s.tlsCert))
+		srv.TLSConfig = tlsConfig()
+		if s.clientCAs != nil {
+			s.logger.Info("requiring client certificates")
+			srv.TLSConfig.ClientCAs = s.clientCAs
+			srv.TLSConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	case s.h2c:
+		s.logger.Info("enabling h2c")
+		srv.Handler = h2c.NewHandler(srv.Handler, &http2.Server{})
+	}
+	errCh := make(chan error, len(listeners))
+	for _, nl := range listeners {
+		go func(nl net.Listener) {
+			if s.tlsCert != "" {
+				errCh <- srv.ServeTLS(nl, s.tlsCert, s.tlsKey)
+				return
+			}
+			errCh <- srv.Serve(nl)
+		}(nl)
+	}
+	stop := make(chan struct{})
+	if s.stallAfter > 0 {
+		go s.watchStalls(stop)
+	}
+	var err error
+	select {
+	case err = <-errCh:
+	case <-ctx.Done():
+		s.logger.Info("shutting down", zap.Duration("timeout", s.shutdownTimeout))
+		sctx, cancel := context.WithTimeout(context.Background(), s.shutdownTimeout)
+		if serr := srv.Shutdown(sctx); serr != nil {
+			s.logger.Warn("requests didn't finish in time", zap.Error(serr))
+		}
+		cancel()
+	}
+	close(stop)
+	srv.Close()
+	return err
+}
+
+// limitBody rejects requests announcing a body over the limit with 413, and
+// makes reading past the limit fail for the rest.
+func (s Server) limitBody(h http.Handler) http.Handler {
+	if s.maxBodyBytes <= 0 && len(s.bodyLimits) == 0 {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		limit, ok := s.bodyLimits[r.Method+" "+s.router.Route(r)]
+		if !ok {
+			limit = s.maxBodyBytes
+		}
+		if limit <= 0 {
+			h.ServeHTTP(w, r)
+			return
+		}
+		if r.ContentLength > limit {
+			s.logger.Info("rejected oversized request", zap.String("path", r.URL.Path), zap.Int64("content_length", r.ContentLength))
+			httputil.ErrResponse(w, fmt.Errorf("request body too large, the limit is %d bytes", limit), http.StatusRequestEntityTooLarge)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, limit)
+		h.ServeHTTP(w, r)
+	})
 }
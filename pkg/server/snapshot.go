@@ -0,0 +1,274 @@
+/*
+Copyright 2020 Daniël Franke
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/ainmosni/mediasync-server/pkg/fs"
+	"github.com/ainmosni/mediasync-server/pkg/httputil"
+	"github.com/ainmosni/mediasync-server/pkg/tokens"
+	"go.uber.org/zap"
+)
+
+const (
+	// maxSnapshots limits how many representations of the manifest are kept.
+	maxSnapshots = 4 * maxGenerations
+	// rescanInterval is how often requests for snapshots rescan the roots, at
+	// most, so they notice changes.
+	rescanInterval = 30 * time.Second
+)
+
+// snapshotKey identifies a representation of the manifest.
+type snapshotKey struct {
+	query string
+	ct    string
+	// algo is the checksum algorithm of the manifest and its files.
+	algo string
+}
+
+// snapshotSource is what the snapshots of a query are built from, besides the
+// files: the scope of the token, the tags and the checksum algorithm asked for.
+type snapshotSource struct {
+	claims *tokens.Claims
+	tags   []string
+	algo   string
+}
+
+// snapshot is a gzip compressed manifest, kept while its generation is current
+// so unchanged manifests aren't encoded and compressed over and over.
+type snapshot struct {
+	hash string
+	body []byte
+	// checksum is of the uncompressed JSON, empty for other formats.
+	checksum string
+}
+
+// serveSnapshot serves the manifest of files as a gzip compressed snapshot,
+// building it if generation hash doesn't have one yet.
+func (h *FileInfoHandler) serveSnapshot(w http.ResponseWriter, key snapshotKey, hash string, files []*fs.WebObject,
+	logger *zap.Logger) {
+	s, err := h.snapshot(key, hash, files)
+	if httputil.ErrResponse(w, err, http.StatusInternalServerError) {
+		logger.Error("couldn't build manifest snapshot", zap.Error(err))
+		return
+	}
+	w.Header().Set("Content-Type", key.ct)
+	w.Header().Set("Content-Encoding", "gzip")
+	w.Header().Set(httputil.ChecksumAlgoHeader, key.algo)
+	// The checksum is in a trailer like with streamed manifests.
+	if s.checksum != "" {
+		w.Header().Add("Trailer", httputil.ChecksumHeader)
+	}
+	w.WriteHeader(http.StatusOK)
+	if _, err := w.Write(s.body); err != nil {
+		return
+	}
+	if s.checksum != "" {
+		w.Header().Set(httputil.ChecksumHeader, s.checksum)
+	}
+}
+
+// snapshot returns the snapshot of key for generation hash. A new one is built
+// from files when the generation changed, and the other representations of the
+// same query are rebuilt in the background, so they're warm when asked for.
+func (h *FileInfoHandler) snapshot(key snapshotKey, hash string, files []*fs.WebObject) (*snapshot, error) {
+	h.mu.Lock()
+	s, ok := h.snapshots[key]
+	h.mu.Unlock()
+	if ok && s.hash == hash {
+		return s, nil
+	}
+	s, err := buildSnapshot(key, hash, files)
+	if err != nil {
+		return nil, err
+	}
+
+	h.mu.Lock()
+	if len(h.snapshots) >= maxSnapshots {
+		h.snapshots = make(map[snapshotKey]*snapshot)
+	}
+	h.snapshots[key] = s
+	stale := false
+	for other, cur := range h.snapshots {
+		stale = stale || other.query == key.query && cur.hash != hash
+	}
+	h.mu.Unlock()
+	if stale {
+		h.scheduleRebuild()
+	}
+	return s, nil
+}
+
+// setSource records what the snapshots of query are built from.
+func (h *FileInfoHandler) setSource(query string, src snapshotSource) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.sources[query]; !ok && len(h.sources) >= maxGenerations {
+		h.sources = make(map[string]snapshotSource)
+	}
+	h.sources[query] = src
+}
+
+// scheduleRebuild rebuilds the snapshots that are out of date in the
+// background. Only one rebuild runs at a time, changes during it make it run
+// once more.
+func (h *FileInfoHandler) scheduleRebuild() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.rebuilding {
+		h.rebuildAgain = true
+		return
+	}
+	h.rebuilding = true
+	go func() {
+		for {
+			h.rebuild()
+			h.mu.Lock()
+			if !h.rebuildAgain {
+				h.rebuilding = false
+				h.mu.Unlock()
+				return
+			}
+			h.rebuildAgain = false
+			h.mu.Unlock()
+		}
+	}()
+}
+
+// rebuild brings the snapshots of every query up to date with the index.
+func (h *FileInfoHandler) rebuild() {
+	h.mu.Lock()
+	keys := make(map[string][]snapshotKey)
+	for key := range h.snapshots {
+		if _, ok := h.sources[key.query]; ok {
+			keys[key.query] = append(keys[key.query], key)
+		}
+	}
+	sources := make(map[string]snapshotSource, len(keys))
+	for query := range keys {
+		sources[query] = h.sources[query]
+	}
+	h.mu.Unlock()
+	if len(keys) == 0 {
+		return
+	}
+
+	indexed, err := h.indexed(context.Background())
+	if err != nil {
+		h.logger.Warn("couldn't list files to rebuild manifest snapshots", zap.Error(err))
+		return
+	}
+	for query, src := range sources {
+		ctx := context.Background()
+		if src.claims != nil {
+			ctx = context.WithValue(ctx, claimsKey{}, src.claims)
+		}
+		files := h.manifest(ctx, indexed, src.tags, src.algo)
+		hash, _ := h.generation(query, files)
+		for _, key := range keys[query] {
+			h.prewarm(key, hash, files)
+		}
+	}
+}
+
+// prewarm builds the snapshot of key for generation hash, unless it's there.
+func (h *FileInfoHandler) prewarm(key snapshotKey, hash string, files []*fs.WebObject) {
+	h.mu.Lock()
+	old, ok := h.snapshots[key]
+	h.mu.Unlock()
+	if !ok || old.hash == hash {
+		return
+	}
+	s, err := buildSnapshot(key, hash, files)
+	if err != nil {
+		h.logger.Warn("couldn't prewarm manifest snapshot", zap.Error(err))
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if old, ok := h.snapshots[key]; ok && old.hash != hash {
+		h.snapshots[key] = s
+	}
+}
+
+// scheduleRescan reads the disk in the background, at most every
+// rescanInterval, as snapshots are served from the index. Changes it finds
+// rebuild the snapshots.
+func (h *FileInfoHandler) scheduleRescan() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.rescanning || time.Since(h.lastRescan) < rescanInterval {
+		return
+	}
+	h.rescanning = true
+	h.lastRescan = time.Now()
+	go func() {
+		if _, err := h.files(context.Background()); err != nil {
+			h.logger.Warn("couldn't rescan files for manifest snapshots", zap.Error(err))
+		}
+		// A standby's files don't come from the registry, which tells us about
+		// changes otherwise.
+		if h.mirrored {
+			h.scheduleRebuild()
+		}
+		h.mu.Lock()
+		h.rescanning = false
+		h.mu.Unlock()
+	}()
+}
+
+// buildSnapshot encodes and compresses files as the representation of key.
+func buildSnapshot(key snapshotKey, hash string, files []*fs.WebObject) (*snapshot, error) {
+	s := &snapshot{hash: hash}
+	var body []byte
+	switch key.ct {
+	case httputil.CBORContentType:
+		body = encodeManifestCBOR(files)
+	case httputil.ProtobufContentType:
+		body = encodeManifestProtobuf(files)
+	default:
+		var buf bytes.Buffer
+		if err := json.NewEncoder(&buf).Encode(files); err != nil {
+			return nil, err
+		}
+		body = buf.Bytes()
+		sum, err := httputil.NewChecksum(key.algo)
+		if err != nil {
+			return nil, err
+		}
+		sum.Write(body)
+		s.checksum = hex.EncodeToString(sum.Sum(nil))
+	}
+
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	if _, err := zw.Write(body); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	s.body = gz.Bytes()
+	return s, nil
+}
@@ -0,0 +1,114 @@
+/*
+Copyright 2020 Daniël Franke
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"compress/gzip"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ainmosni/mediasync-server/pkg/fs"
+	"go.uber.org/zap"
+)
+
+// gzipManifest requests the compressed JSON manifest.
+func gzipManifest(t *testing.T, h *FileInfoHandler) string {
+	t.Helper()
+	r := httptest.NewRequest(http.MethodGet, "/fileinfo", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusOK || w.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("manifest status = %d, encoding %q", w.Code, w.Header().Get("Content-Encoding"))
+	}
+	zr, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestSnapshotRebuiltOnChange(t *testing.T) {
+	root, err := ioutil.TempDir("", "snapshots")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	if err := ioutil.WriteFile(filepath.Join(root, "a.mkv"), []byte("a"), 0o640); err != nil {
+		t.Fatal(err)
+	}
+	r := fs.NewRegistry(zap.NewNop())
+	if err := r.Register("/files", root); err != nil {
+		t.Fatal(err)
+	}
+	h := NewFileInfoHandler(r, nil, zap.NewNop())
+	// No background rescans, the test decides when the disk is read.
+	h.lastRescan = time.Now()
+
+	if m := gzipManifest(t, h); !strings.Contains(m, "/files/a.mkv") {
+		t.Fatalf("manifest misses a.mkv: %s", m)
+	}
+	if err := ioutil.WriteFile(filepath.Join(root, "b.mkv"), []byte("b"), 0o640); err != nil {
+		t.Fatal(err)
+	}
+	// Snapshots are served from the index, without reading the disk.
+	if m := gzipManifest(t, h); strings.Contains(m, "/files/b.mkv") {
+		t.Fatalf("manifest has b.mkv before a scan: %s", m)
+	}
+
+	if _, err := r.ScanAllFiles(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		h.mu.Lock()
+		var body []byte
+		for _, s := range h.snapshots {
+			body = s.body
+		}
+		h.mu.Unlock()
+		zr, err := gzip.NewReader(strings.NewReader(string(body)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadAll(zr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(string(b), "/files/b.mkv") {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("snapshot wasn't rebuilt after the scan: %s", b)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if m := gzipManifest(t, h); !strings.Contains(m, "/files/b.mkv") {
+		t.Errorf("manifest misses b.mkv after a scan: %s", m)
+	}
+}
@@ -0,0 +1,136 @@
+/*
+Copyright 2020 Daniël Franke
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/ainmosni/mediasync-server/pkg/httputil"
+	"go.uber.org/zap"
+)
+
+// connKey is the context key of the connection a request came in on.
+type connKey struct{}
+
+// withConn stores the connection in the context of its requests, so stalled
+// transfers can be aborted.
+func withConn(ctx context.Context, c net.Conn) context.Context {
+	return context.WithValue(ctx, connKey{}, c)
+}
+
+// stalledTransfer describes a transfer that didn't make progress for a while.
+type stalledTransfer struct {
+	Method string        `json:"method"`
+	Path   string        `json:"path"`
+	Remote string        `json:"remote"`
+	Bytes  int64         `json:"bytes"`
+	Idle   time.Duration `json:"idle_ns"`
+}
+
+// SetStallDetection makes transfers count as stalled when no bytes were sent
+// for after, and aborts them when that lasts abortAfter. Zero disables either.
+func (s *Server) SetStallDetection(after, abortAfter time.Duration) {
+	s.stallAfter = after
+	s.stallAbortAfter = abortAfter
+}
+
+// watchStalls checks the active transfers for stalls until stop is closed.
+func (s Server) watchStalls(stop <-chan struct{}) {
+	t := time.NewTicker(s.stallAfter / 2) //nolint:gomnd
+	defer t.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-t.C:
+			s.checkStalls(now)
+		}
+	}
+}
+
+func (s Server) checkStalls(now time.Time) {
+	stalled := s.transfers.stalledSince(now, s.stallAfter)
+	atomic.StoreInt64(&s.transfers.stalled, int64(len(stalled)))
+	for _, cw := range stalled {
+		idle := cw.idle(now)
+		if s.stallAbortAfter <= 0 || idle < s.stallAbortAfter {
+			continue
+		}
+		logger := s.logger.With(
+			zap.String("method", cw.r.Method),
+			zap.String("path", cw.r.URL.Path),
+			zap.String("remote", cw.r.RemoteAddr),
+			zap.Int64("bytes", atomic.LoadInt64(&cw.bytes)),
+			zap.Duration("idle", idle),
+			zap.Duration("duration", now.Sub(cw.started)))
+		// Closing an HTTP/2 connection would abort all of its streams.
+		conn, ok := cw.r.Context().Value(connKey{}).(net.Conn)
+		if !ok || cw.r.ProtoMajor != 1 {
+			logger.Warn("transfer stalled, can't abort it")
+			continue
+		}
+		logger.Warn("aborting stalled transfer")
+		conn.Close()
+	}
+}
+
+// stalledSince returns the active transfers without progress for longer than after.
+func (t *Transfers) stalledSince(now time.Time, after time.Duration) []*countingWriter {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var stalled []*countingWriter
+	for cw := range t.active {
+		if cw.idle(now) > after {
+			stalled = append(stalled, cw)
+		}
+	}
+	return stalled
+}
+
+// StalledHandler serves the number of stalled transfers, and what they are.
+func (s *Server) StalledHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		now := time.Now()
+		var report struct {
+			Stalled   int64             `json:"stalled"`
+			Transfers []stalledTransfer `json:"transfers"`
+		}
+		report.Stalled = atomic.LoadInt64(&s.transfers.stalled)
+		report.Transfers = []stalledTransfer{}
+		if s.stallAfter > 0 {
+			for _, cw := range s.transfers.stalledSince(now, s.stallAfter) {
+				report.Transfers = append(report.Transfers, stalledTransfer{
+					Method: cw.r.Method,
+					Path:   cw.r.URL.Path,
+					Remote: cw.r.RemoteAddr,
+					Bytes:  atomic.LoadInt64(&cw.bytes),
+					Idle:   cw.idle(now),
+				})
+			}
+		}
+		out, err := json.Marshal(report)
+		if httputil.ErrResponse(w, err, http.StatusInternalServerError) {
+			return
+		}
+		httputil.JSONResponse(w, out, http.StatusOK)
+	})
+}
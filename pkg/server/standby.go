@@ -0,0 +1,123 @@
+/*
+Copyright 2020 Daniël Franke
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ainmosni/mediasync-server/pkg/fs"
+	"github.com/ainmosni/mediasync-server/pkg/httputil"
+	"go.uber.org/zap"
+)
+
+// Standby mirrors the manifest of a primary instance serving the same storage,
+// so it can take over with a correct manifest right away. Files are still
+// served from the shared storage directly.
+type Standby struct {
+	primary string
+	token   string
+	client  *http.Client
+	logger  *zap.Logger
+
+	mu       sync.RWMutex
+	files    []*fs.WebObject
+	mirrored time.Time
+}
+
+// NewStandby creates a new Standby mirroring primary, token is sent as bearer
+// token when set.
+func NewStandby(primary, token string, timeout time.Duration, logger *zap.Logger) *Standby {
+	logger = logger.With(zap.String("primary", primary))
+	logger.Info("running as standby")
+	return &Standby{
+		primary: strings.TrimRight(primary, "/"),
+		token:   token,
+		client:  &http.Client{Timeout: timeout},
+		logger:  logger,
+	}
+}
+
+// Run mirrors the manifest every interval until ctx is cancelled. When the
+// primary can't be reached the last mirrored manifest is kept.
+func (sb *Standby) Run(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		if err := sb.mirror(ctx); err != nil {
+			sb.logger.Error("couldn't mirror manifest", zap.Error(err))
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+func (sb *Standby) mirror(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", sb.primary+"/fileinfo", nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", httputil.JSONContentType)
+	// We mirror the file checksums too.
+	req.Header.Set(httputil.ChecksumAlgoHeader, fs.ChecksumAlgo)
+	if sb.token != "" {
+		req.Header.Set("Authorization", "Bearer "+sb.token)
+	}
+	resp, err := sb.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status from primary: %s", resp.Status)
+	}
+	var files []*fs.WebObject
+	if err := json.NewDecoder(resp.Body).Decode(&files); err != nil {
+		return err
+	}
+
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	sb.files = files
+	sb.mirrored = time.Now()
+	sb.logger.Debug("mirrored manifest", zap.Int("files", len(files)))
+	return nil
+}
+
+// Files returns the mirrored manifest, it fails until the first mirror is done.
+func (sb *Standby) Files(_ context.Context) ([]*fs.WebObject, error) {
+	sb.mu.RLock()
+	defer sb.mu.RUnlock()
+	if sb.mirrored.IsZero() {
+		return nil, fmt.Errorf("no manifest mirrored from %s yet", sb.primary)
+	}
+	// Callers fill in tags, so they get their own copies.
+	files := make([]*fs.WebObject, len(sb.files))
+	for i, f := range sb.files {
+		c := *f
+		files[i] = &c
+	}
+	return files, nil
+}
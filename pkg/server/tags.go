@@ -0,0 +1,104 @@
+/*
+Copyright 2020 Daniël Franke
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/ainmosni/mediasync-server/pkg/httputil"
+	"github.com/ainmosni/mediasync-server/pkg/tags"
+	"go.uber.org/zap"
+)
+
+type tagsBody struct {
+	Path string   `json:"path"`
+	Tags []string `json:"tags"`
+}
+
+// TagsHandler lets clients read and set the tags of files.
+type TagsHandler struct {
+	store  *tags.Store
+	logger *zap.Logger
+}
+
+// NewTagsHandler creates a new TagsHandler.
+func NewTagsHandler(store *tags.Store, logger *zap.Logger) *TagsHandler {
+	return &TagsHandler{
+		store:  store,
+		logger: logger,
+	}
+}
+
+// ServeHTTP for the TagsHandler, GET returns tags for ?path= or all tags,
+// PUT replaces the tags of a single path. Scoped tokens only see and set the
+// tags of paths they allow.
+func (h *TagsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	logger := h.logger.With(zap.String("path", r.URL.Path), zap.String("method", r.Method))
+	logger.Info("Received HTTP request")
+	switch r.Method {
+	case "GET":
+		var out interface{} = h.scopedTags(r.Context())
+		if p := r.URL.Query().Get("path"); p != "" {
+			if !allowsPath(r.Context(), p) {
+				httputil.ErrResponse(w, errors.New("token not valid for this path"), http.StatusForbidden)
+				return
+			}
+			out = tagsBody{Path: p, Tags: h.store.Get(p)}
+		}
+		b, err := json.Marshal(out)
+		if httputil.ErrResponse(w, err, http.StatusInternalServerError) {
+			logger.Error("couldn't encode to JSON", zap.Error(err))
+			return
+		}
+		httputil.JSONResponse(w, b, http.StatusOK)
+	case "PUT":
+		var body tagsBody
+		err := json.NewDecoder(r.Body).Decode(&body)
+		if err == nil && body.Path == "" {
+			err = errors.New("path is required")
+		}
+		if httputil.ErrResponse(w, err, http.StatusBadRequest) {
+			return
+		}
+		if !allowsPath(r.Context(), body.Path) {
+			httputil.ErrResponse(w, errors.New("token not valid for this path"), http.StatusForbidden)
+			return
+		}
+		err = h.store.Set(body.Path, body.Tags)
+		if httputil.ErrResponse(w, err, http.StatusInternalServerError) {
+			logger.Error("couldn't store tags", zap.Error(err))
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		httputil.ErrResponse(w, errors.New("method not supported"), http.StatusMethodNotAllowed)
+	}
+}
+
+// scopedTags returns all tags of the paths the token of the request allows.
+func (h *TagsHandler) scopedTags(ctx context.Context) map[string][]string {
+	all := h.store.All()
+	for p := range all {
+		if !allowsPath(ctx, p) {
+			delete(all, p)
+		}
+	}
+	return all
+}
@@ -0,0 +1,243 @@
+/*
+Copyright 2020 Daniël Franke
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ainmosni/mediasync-server/pkg/httputil"
+	"go.uber.org/zap"
+)
+
+// Transfers accounts the exact number of bytes sent, per registered route, so
+// egress can be reconciled with sync activity.
+type Transfers struct {
+	mu     sync.Mutex
+	routes map[string]*RouteTransfers
+	// active are the responses currently being written.
+	active map[*countingWriter]struct{}
+	// stalled is the number of stalled transfers at the last check, atomic.
+	stalled int64
+	// statuses counts the responses by status code.
+	statuses map[int]int64
+}
+
+// RouteTransfers are the totals of a single route.
+type RouteTransfers struct {
+	Requests int64 `json:"requests"`
+	Bytes    int64 `json:"bytes"`
+	// Aborted counts the requests whose response didn't fully reach the client.
+	Aborted int64 `json:"aborted"`
+	// Panics counts the requests whose handler panicked.
+	Panics int64 `json:"panics"`
+}
+
+// NewTransfers creates empty transfer accounting.
+func NewTransfers() *Transfers {
+	return &Transfers{
+		routes:   make(map[string]*RouteTransfers),
+		active:   make(map[*countingWriter]struct{}),
+		statuses: make(map[int]int64),
+	}
+}
+
+func (t *Transfers) start(cw *countingWriter) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.active[cw] = struct{}{}
+}
+
+func (t *Transfers) finish(cw *countingWriter) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.active, cw)
+}
+
+func (t *Transfers) add(route string, status int, bytes int64, aborted bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.statuses[status]++
+	rt := t.route(route)
+	rt.Requests++
+	rt.Bytes += bytes
+	if aborted {
+		rt.Aborted++
+	}
+}
+
+func (t *Transfers) panicked(route string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.route(route).Panics++
+}
+
+// route returns the totals of route, creating them if needed. t.mu is held.
+func (t *Transfers) route(route string) *RouteTransfers {
+	rt, ok := t.routes[route]
+	if !ok {
+		rt = &RouteTransfers{}
+		t.routes[route] = rt
+	}
+	return rt
+}
+
+// Snapshot returns a copy of the totals, by route.
+func (t *Transfers) Snapshot() map[string]RouteTransfers {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s := make(map[string]RouteTransfers, len(t.routes))
+	for r, rt := range t.routes {
+		s[r] = *rt
+	}
+	return s
+}
+
+// Statuses returns how many responses were sent, by status code.
+func (t *Transfers) Statuses() map[int]int64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s := make(map[int]int64, len(t.statuses))
+	for code, n := range t.statuses {
+		s[code] = n
+	}
+	return s
+}
+
+// ServeHTTP serves the totals as JSON.
+func (t *Transfers) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	out, err := json.Marshal(t.Snapshot())
+	if httputil.ErrResponse(w, err, http.StatusInternalServerError) {
+		return
+	}
+	httputil.JSONResponse(w, out, http.StatusOK)
+}
+
+// countingWriter counts the bytes of the body that were actually written, and
+// when the last write made progress.
+type countingWriter struct {
+	http.ResponseWriter
+	r       *http.Request
+	started time.Time
+	status  int
+	// wrote is set once the response started, headers can't change anymore.
+	wrote    bool
+	err      error
+	bytes    int64 // atomic
+	progress int64 // atomic, unix nanoseconds
+}
+
+func newCountingWriter(w http.ResponseWriter, r *http.Request) *countingWriter {
+	now := time.Now()
+	return &countingWriter{
+		ResponseWriter: w,
+		r:              r,
+		started:        now,
+		status:         http.StatusOK,
+		progress:       now.UnixNano(),
+	}
+}
+
+func (cw *countingWriter) WriteHeader(statusCode int) {
+	cw.status = statusCode
+	cw.wrote = true
+	cw.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	cw.wrote = true
+	n, err := cw.ResponseWriter.Write(p)
+	cw.count(int64(n), err)
+	return n, err
+}
+
+// readFromChunk is how much ReadFrom sends at once, so progress is tracked
+// during large downloads.
+const readFromChunk = 1 << 20
+
+// ReadFrom keeps sendfile working for downloads.
+func (cw *countingWriter) ReadFrom(src io.Reader) (int64, error) {
+	cw.wrote = true
+	rf, ok := cw.ResponseWriter.(io.ReaderFrom)
+	if !ok {
+		return io.Copy(struct{ io.Writer }{cw}, src)
+	}
+	var total int64
+	for {
+		n, err := rf.ReadFrom(io.LimitReader(src, readFromChunk))
+		total += n
+		cw.count(n, err)
+		if err != nil || n < readFromChunk {
+			return total, err
+		}
+	}
+}
+
+func (cw *countingWriter) count(n int64, err error) {
+	atomic.AddInt64(&cw.bytes, n)
+	if n > 0 {
+		atomic.StoreInt64(&cw.progress, time.Now().UnixNano())
+	}
+	if err != nil && cw.err == nil {
+		cw.err = err
+	}
+}
+
+// idle returns how long ago the last write made progress.
+func (cw *countingWriter) idle(now time.Time) time.Duration {
+	return now.Sub(time.Unix(0, atomic.LoadInt64(&cw.progress)))
+}
+
+func (cw *countingWriter) Flush() {
+	if f, ok := cw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// accessLog wraps h to log every request with the bytes sent, and adds them to
+// the transfer accounting of the route that serves it.
+func (s Server) accessLog(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cw := newCountingWriter(w, r)
+		route := s.router.Route(r)
+		s.transfers.start(cw)
+
+		// Deferred, as aborted handlers panic.
+		completed := false
+		defer func() {
+			aborted := !completed || cw.err != nil || r.Context().Err() != nil
+			s.transfers.finish(cw)
+			s.transfers.add(route, cw.status, cw.bytes, aborted)
+			s.logger.Info("access",
+				zap.String("method", r.Method),
+				zap.String("path", r.URL.Path),
+				zap.String("route", route),
+				zap.String("remote", r.RemoteAddr),
+				zap.String("client", clientName(r)),
+				zap.Int("status", cw.status),
+				zap.Int64("bytes", cw.bytes),
+				zap.Duration("duration", time.Since(cw.started)),
+				zap.Bool("aborted", aborted))
+		}()
+		h.ServeHTTP(cw, r)
+		completed = true
+	})
+}
@@ -0,0 +1,471 @@
+/*
+Copyright 2020 Daniël Franke
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ainmosni/mediasync-server/pkg/fs"
+	"github.com/ainmosni/mediasync-server/pkg/httputil"
+	"go.uber.org/zap"
+)
+
+const (
+	// uploadsPrefix is where upload sessions live, /uploads/{id}.
+	uploadsPrefix = "/uploads/"
+	// uploadIDBytes is the length of the random session IDs, knowing one is
+	// what allows appending to it.
+	uploadIDBytes = 16
+)
+
+// uploadSession is an upload in progress, it's stored next to its data so it
+// survives restarts.
+type uploadSession struct {
+	ID string `json:"id"`
+	// Path is the serve path of the file being uploaded.
+	Path   string `json:"path"`
+	Length int64  `json:"length"`
+	// Offset is how many bytes arrived, it isn't stored but taken from the data.
+	Offset  int64     `json:"offset"`
+	Expires time.Time `json:"expires"`
+
+	// mu serialises appending, only one chunk is written at a time.
+	mu sync.Mutex
+}
+
+// UploadHandler implements resumable uploads. POST /uploads starts a session
+// for a path and length, and returns its URL. Chunks are appended with PATCH
+// at the offset in Upload-Offset, HEAD tells the offset to resume at after an
+// interruption, and DELETE cancels. The complete file is fsynced and moved
+// into place, existing files are never replaced.
+type UploadHandler struct {
+	dir string
+	// ttl is how long a session lives after its last chunk.
+	ttl     time.Duration
+	maxSize int64
+	// roots maps serve paths to disk paths.
+	roots map[string]string
+	rules *fs.Rules
+
+	mu       sync.Mutex
+	sessions map[string]*uploadSession
+	logger   *zap.Logger
+}
+
+// NewUploadHandler creates a new UploadHandler keeping sessions and their data
+// in dir. Sessions left there by an earlier run are picked up again, until
+// they expire.
+func NewUploadHandler(dir string, ttl time.Duration, maxSize int64, logger *zap.Logger) (*UploadHandler, error) {
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return nil, err
+	}
+	logger.Info("accepting uploads", zap.String("dir", dir))
+	h := &UploadHandler{
+		dir:      dir,
+		ttl:      ttl,
+		maxSize:  maxSize,
+		roots:    make(map[string]string),
+		sessions: make(map[string]*uploadSession),
+		logger:   logger,
+	}
+	return h, h.load()
+}
+
+// SetRules rejects uploads of files the rules would hide, nil rules are the
+// defaults.
+func (h *UploadHandler) SetRules(rules *fs.Rules) {
+	h.rules = rules
+}
+
+// AddRoot allows uploading to the root at servePath.
+func (h *UploadHandler) AddRoot(servePath, diskPath string) {
+	h.roots[servePath] = diskPath
+}
+
+// load reads the sessions stored in the upload directory.
+func (h *UploadHandler) load() error {
+	metas, err := filepath.Glob(filepath.Join(h.dir, "*.json"))
+	if err != nil {
+		return err
+	}
+	for _, m := range metas {
+		b, err := ioutil.ReadFile(m)
+		if err != nil {
+			return err
+		}
+		var us uploadSession
+		if err := json.Unmarshal(b, &us); err != nil {
+			h.logger.Warn("ignoring invalid upload session", zap.String("file", m), zap.Error(err))
+			continue
+		}
+		info, err := os.Stat(h.dataPath(us.ID))
+		if err != nil {
+			h.logger.Warn("ignoring upload session without data", zap.String("file", m), zap.Error(err))
+			continue
+		}
+		us.Offset = info.Size()
+		h.sessions[us.ID] = &us
+	}
+	return nil
+}
+
+// resolve returns the disk path of the serve path p, if it's in a root, and
+// the disk path of the root.
+func (h *UploadHandler) resolve(p string) (string, string, error) {
+	p, err := httputil.SanitizePath(p)
+	if err != nil {
+		return "", "", err
+	}
+	for servePath, diskPath := range h.roots {
+		if strings.HasPrefix(p, servePath) && len(p) > len(servePath) {
+			return path.Join(diskPath, strings.TrimPrefix(p, servePath)), path.Clean(diskPath), nil
+		}
+	}
+	return "", "", fmt.Errorf("%s isn't in a root", p)
+}
+
+// Create starts a session for the path and length in the JSON body.
+func (h *UploadHandler) Create(w http.ResponseWriter, r *http.Request) {
+	logger := h.logger.With(zap.String("path", r.URL.Path), zap.String("method", r.Method))
+	logger.Info("Received HTTP request")
+	h.expire()
+
+	var us uploadSession
+	if err := json.NewDecoder(r.Body).Decode(&us); httputil.ErrResponse(w, err, http.StatusBadRequest) {
+		return
+	}
+	p, err := httputil.SanitizePath(us.Path)
+	if httputil.ErrResponse(w, err, http.StatusBadRequest) {
+		return
+	}
+	us.Path = p
+	// The token was checked against /uploads, not the file it writes.
+	if claims := claimsFrom(r.Context()); claims != nil && !claims.Allows(r.Method, us.Path) {
+		logger.Info("token not valid for upload", zap.String("file", us.Path))
+		httputil.ErrResponse(w, errors.New("token not valid for this path"), http.StatusForbidden)
+		return
+	}
+	diskPath, root, err := h.resolve(us.Path)
+	if httputil.ErrResponse(w, err, http.StatusBadRequest) {
+		return
+	}
+	// Hidden files would be invisible once uploaded.
+	if h.rules.ExcludesPath(root, &fs.FilesystemObject{Path: diskPath}) {
+		httputil.ErrResponse(w, errors.New("path is excluded"), http.StatusBadRequest)
+		return
+	}
+	switch {
+	case us.Length < 0:
+		httputil.ErrResponse(w, errors.New("invalid length"), http.StatusBadRequest)
+		return
+	case h.maxSize > 0 && us.Length > h.maxSize:
+		httputil.ErrResponse(w, fmt.Errorf("upload too large, the limit is %d bytes", h.maxSize), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if _, err := os.Lstat(diskPath); !os.IsNotExist(err) {
+		httputil.ErrResponse(w, errors.New("file exists"), http.StatusConflict)
+		return
+	}
+
+	id := make([]byte, uploadIDBytes)
+	if _, err := rand.Read(id); httputil.ErrResponse(w, err, http.StatusInternalServerError) {
+		return
+	}
+	us.ID = hex.EncodeToString(id)
+	us.Offset = 0
+	us.Expires = time.Now().Add(h.ttl)
+	if err := ioutil.WriteFile(h.dataPath(us.ID), nil, 0o640); httputil.ErrResponse(w, err, http.StatusInternalServerError) {
+		logger.Error("couldn't create upload", zap.Error(err))
+		return
+	}
+	if err := h.store(&us); httputil.ErrResponse(w, err, http.StatusInternalServerError) {
+		logger.Error("couldn't store upload session", zap.Error(err))
+		return
+	}
+	h.mu.Lock()
+	h.sessions[us.ID] = &us
+	h.mu.Unlock()
+	logger.Info("started upload", zap.String("id", us.ID), zap.String("file", us.Path), zap.Int64("length", us.Length))
+
+	w.Header().Set("Location", uploadsPrefix+us.ID)
+	h.respond(w, &us, http.StatusCreated)
+}
+
+// Status tells the offset of the session in Upload-Offset, for resuming.
+func (h *UploadHandler) Status(w http.ResponseWriter, r *http.Request) {
+	us, ok := h.session(w, r)
+	if !ok {
+		return
+	}
+	defer us.mu.Unlock()
+	w.Header().Set("Cache-Control", "no-store")
+	h.respond(w, us, http.StatusOK)
+}
+
+// Append writes the body at the offset in Upload-Offset, which has to be the
+// offset of the session. The file is moved into place once it's complete.
+func (h *UploadHandler) Append(w http.ResponseWriter, r *http.Request) {
+	logger := h.logger.With(zap.String("path", r.URL.Path), zap.String("method", r.Method))
+	us, ok := h.session(w, r)
+	if !ok {
+		return
+	}
+	defer us.mu.Unlock()
+	offset, err := strconv.ParseInt(r.Header.Get(httputil.UploadOffsetHeader), 10, 64)
+	if httputil.ErrResponse(w, err, http.StatusBadRequest) {
+		return
+	}
+	if offset != us.Offset {
+		w.Header().Set(httputil.UploadOffsetHeader, strconv.FormatInt(us.Offset, 10))
+		httputil.ErrResponse(w, fmt.Errorf("offset is %d", us.Offset), http.StatusConflict)
+		return
+	}
+
+	n, err := h.write(us, r.Body)
+	us.Offset += n
+	us.Expires = time.Now().Add(h.ttl)
+	// The new expiry has to survive restarts, or resumed uploads expire early.
+	if serr := h.store(us); serr != nil {
+		logger.Warn("couldn't store upload session", zap.String("id", us.ID), zap.Error(serr))
+	}
+	if err != nil {
+		logger.Info("upload interrupted", zap.String("id", us.ID), zap.Int64("offset", us.Offset), zap.Error(err))
+		w.Header().Set(httputil.UploadOffsetHeader, strconv.FormatInt(us.Offset, 10))
+		httputil.ErrResponse(w, err, http.StatusBadRequest)
+		return
+	}
+	if us.Offset < us.Length {
+		h.respond(w, us, http.StatusOK)
+		return
+	}
+
+	if err := h.complete(us); err != nil {
+		logger.Error("couldn't complete upload", zap.String("id", us.ID), zap.Error(err))
+		status := http.StatusInternalServerError
+		if os.IsExist(err) {
+			status = http.StatusConflict
+		}
+		httputil.ErrResponse(w, err, status)
+		return
+	}
+	logger.Info("completed upload", zap.String("id", us.ID), zap.String("file", us.Path), zap.Int64("length", us.Length))
+	h.respond(w, us, http.StatusOK)
+}
+
+// Cancel removes the session and its data.
+func (h *UploadHandler) Cancel(w http.ResponseWriter, r *http.Request) {
+	us, ok := h.session(w, r)
+	if !ok {
+		return
+	}
+	defer us.mu.Unlock()
+	h.logger.Info("cancelled upload", zap.String("id", us.ID), zap.String("file", us.Path))
+	h.remove(us)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// session returns the session of the request locked, or writes a 404, or a
+// 410 when it expired without being removed yet.
+func (h *UploadHandler) session(w http.ResponseWriter, r *http.Request) (*uploadSession, bool) {
+	id := PathParam(r, "id")
+	h.mu.Lock()
+	us, ok := h.sessions[id]
+	h.mu.Unlock()
+	if !ok {
+		httputil.ErrResponse(w, errors.New("no such upload"), http.StatusNotFound)
+		return nil, false
+	}
+	us.mu.Lock()
+	// It may have been completed or removed while we waited for the lock.
+	h.mu.Lock()
+	current := h.sessions[id] == us
+	h.mu.Unlock()
+	if !current {
+		us.mu.Unlock()
+		httputil.ErrResponse(w, errors.New("no such upload"), http.StatusNotFound)
+		return nil, false
+	}
+	if time.Now().After(us.Expires) {
+		h.logger.Info("expired upload", zap.String("id", us.ID), zap.String("file", us.Path))
+		h.remove(us)
+		us.mu.Unlock()
+		httputil.ErrResponse(w, errors.New("upload expired"), http.StatusGone)
+		return nil, false
+	}
+	return us, true
+}
+
+// write appends body to the data of us, up to its length, and fsyncs it so
+// the offset we report survives a crash.
+func (h *UploadHandler) write(us *uploadSession, body io.Reader) (int64, error) {
+	f, err := os.OpenFile(h.dataPath(us.ID), os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	n, err := io.Copy(f, io.LimitReader(body, us.Length-us.Offset))
+	if serr := f.Sync(); err == nil {
+		err = serr
+	}
+	if err == nil {
+		// Anything past the length means the client is confused.
+		var extra [1]byte
+		if m, _ := body.Read(extra[:]); m > 0 {
+			err = fmt.Errorf("body goes past the length of %d bytes", us.Length)
+		}
+	}
+	return n, err
+}
+
+// complete moves the data of us to its destination, without replacing what's
+// there, and removes the session.
+func (h *UploadHandler) complete(us *uploadSession) error {
+	diskPath, _, err := h.resolve(us.Path)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(diskPath), 0o750); err != nil {
+		return err
+	}
+	if err := moveFile(h.dataPath(us.ID), diskPath); err != nil {
+		return err
+	}
+	h.remove(us)
+	return syncDir(filepath.Dir(diskPath))
+}
+
+// moveFile moves src to dst, failing if dst exists. It copies when they're on
+// different filesystems.
+func moveFile(src, dst string) error {
+	err := os.Link(src, dst)
+	if err == nil {
+		return os.Remove(src)
+	}
+	if os.IsExist(err) {
+		return err
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o640)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if serr := out.Sync(); err == nil {
+		err = serr
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(dst)
+		return err
+	}
+	return os.Remove(src)
+}
+
+// syncDir fsyncs a directory, so entries created in it are durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// expire removes sessions that saw no chunk for the TTL.
+func (h *UploadHandler) expire() {
+	now := time.Now()
+	h.mu.Lock()
+	var expired []*uploadSession
+	for _, us := range h.sessions {
+		if now.After(us.Expires) {
+			expired = append(expired, us)
+		}
+	}
+	h.mu.Unlock()
+	for _, us := range expired {
+		us.mu.Lock()
+		// A chunk may have arrived while we waited for the lock.
+		if !now.After(us.Expires) {
+			us.mu.Unlock()
+			continue
+		}
+		h.logger.Info("expired upload", zap.String("id", us.ID), zap.String("file", us.Path))
+		h.remove(us)
+		us.mu.Unlock()
+	}
+}
+
+// remove forgets the session us and removes its files.
+func (h *UploadHandler) remove(us *uploadSession) {
+	h.mu.Lock()
+	delete(h.sessions, us.ID)
+	h.mu.Unlock()
+	for _, p := range []string{h.dataPath(us.ID), h.metaPath(us.ID)} {
+		if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+			h.logger.Warn("couldn't remove upload file", zap.String("file", p), zap.Error(err))
+		}
+	}
+}
+
+// store writes the session next to its data.
+func (h *UploadHandler) store(us *uploadSession) error {
+	b, err := json.Marshal(us)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(h.metaPath(us.ID), b, 0o640)
+}
+
+// respond writes the session as JSON, with the offset and length headers.
+func (h *UploadHandler) respond(w http.ResponseWriter, us *uploadSession, status int) {
+	w.Header().Set(httputil.UploadOffsetHeader, strconv.FormatInt(us.Offset, 10))
+	w.Header().Set(httputil.UploadLengthHeader, strconv.FormatInt(us.Length, 10))
+	b, err := json.Marshal(us)
+	if httputil.ErrResponse(w, err, http.StatusInternalServerError) {
+		return
+	}
+	httputil.JSONResponse(w, b, status)
+}
+
+func (h *UploadHandler) dataPath(id string) string {
+	return filepath.Join(h.dir, id+".part")
+}
+
+func (h *UploadHandler) metaPath(id string) string {
+	return filepath.Join(h.dir, id+".json")
+}
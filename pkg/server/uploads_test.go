@@ -0,0 +1,253 @@
+/*
+Copyright 2020 Daniël Franke
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ainmosni/mediasync-server/pkg/httputil"
+	"github.com/ainmosni/mediasync-server/pkg/tokens"
+	"go.uber.org/zap"
+)
+
+func newTestUploads(t *testing.T) (*UploadHandler, func()) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "uploads")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := NewUploadHandler(dir+"/sessions", time.Hour, 0, zap.NewNop())
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(dir+"/root", 0o750); err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	h.AddRoot("/files", dir+"/root")
+	return h, func() { os.RemoveAll(dir) }
+}
+
+func TestUploadCreate(t *testing.T) {
+	scoped := &tokens.Claims{Paths: []string{"/files/a"}}
+	tests := []struct {
+		name   string
+		body   string
+		claims *tokens.Claims
+		want   int
+	}{
+		{"no token", `{"path":"/files/a/x.mkv","length":3}`, nil, http.StatusCreated},
+		{"in scope", `{"path":"/files/a/x.mkv","length":3}`, scoped, http.StatusCreated},
+		{"out of scope", `{"path":"/files/b/x.mkv","length":3}`, scoped, http.StatusForbidden},
+		{"wrong method", `{"path":"/files/a/x.mkv","length":3}`, &tokens.Claims{Methods: []string{"GET"}}, http.StatusForbidden},
+		{"parent directory", `{"path":"/files/a/../b/x.mkv","length":3}`, scoped, http.StatusBadRequest},
+		{"dotfile", `{"path":"/files/a/.x.mkv","length":3}`, nil, http.StatusBadRequest},
+		{"hidden directory", `{"path":"/files/.a/x.mkv","length":3}`, nil, http.StatusBadRequest},
+		{"backup", `{"path":"/files/a/x.mkv~","length":3}`, nil, http.StatusBadRequest},
+		{"outside roots", `{"path":"/other/x.mkv","length":3}`, nil, http.StatusBadRequest},
+		{"negative length", `{"path":"/files/a/x.mkv","length":-1}`, nil, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, cleanup := newTestUploads(t)
+			defer cleanup()
+			r := httptest.NewRequest(http.MethodPost, "/uploads", strings.NewReader(tt.body))
+			if tt.claims != nil {
+				r = r.WithContext(context.WithValue(r.Context(), claimsKey{}, tt.claims))
+			}
+			w := httptest.NewRecorder()
+			h.Create(w, r)
+			if w.Code != tt.want {
+				t.Errorf("Create() status = %d, want %d: %s", w.Code, tt.want, w.Body.String())
+			}
+		})
+	}
+}
+
+// createUpload starts uploading length bytes to p, and returns the session ID.
+func createUpload(t *testing.T, h *UploadHandler, p string, length int) string {
+	t.Helper()
+	w := httptest.NewRecorder()
+	body := fmt.Sprintf(`{"path":%q,"length":%d}`, p, length)
+	h.Create(w, httptest.NewRequest(http.MethodPost, "/uploads", strings.NewReader(body)))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Create() status = %d: %s", w.Code, w.Body.String())
+	}
+	return strings.TrimPrefix(w.Header().Get("Location"), uploadsPrefix)
+}
+
+// uploadRequest calls handle for the session id, as routed by the server.
+func uploadRequest(h http.HandlerFunc, method, id string, offset int, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, uploadsPrefix+id, strings.NewReader(body))
+	r.Header.Set(httputil.UploadOffsetHeader, strconv.Itoa(offset))
+	r = r.WithContext(context.WithValue(r.Context(), paramsKey{}, map[string]string{"id": id}))
+	w := httptest.NewRecorder()
+	h(w, r)
+	return w
+}
+
+func TestUploadAppend(t *testing.T) {
+	type chunk struct {
+		offset int
+		data   string
+		want   int
+	}
+	tests := []struct {
+		name     string
+		existing string
+		chunks   []chunk
+		// want is the uploaded file, none if empty.
+		want string
+	}{
+		{"single chunk", "", []chunk{{0, "abcdef", http.StatusOK}}, "abcdef"},
+		{"resumed", "", []chunk{{0, "abc", http.StatusOK}, {3, "def", http.StatusOK}}, "abcdef"},
+		{"wrong offset", "", []chunk{{0, "abc", http.StatusOK}, {2, "cdef", http.StatusConflict}}, ""},
+		{"past the length", "", []chunk{{0, "abcdefg", http.StatusBadRequest}}, ""},
+		{"retry after conflict", "", []chunk{{1, "abc", http.StatusConflict}, {0, "abcdef", http.StatusOK}}, "abcdef"},
+		{"file appeared", "other", []chunk{{0, "abcdef", http.StatusConflict}}, "other"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, cleanup := newTestUploads(t)
+			defer cleanup()
+			id := createUpload(t, h, "/files/d/x.mkv", 6)
+			dst := filepath.Join(h.roots["/files"], "d", "x.mkv")
+			if tt.existing != "" {
+				if err := os.MkdirAll(filepath.Dir(dst), 0o750); err != nil {
+					t.Fatal(err)
+				}
+				if err := ioutil.WriteFile(dst, []byte(tt.existing), 0o640); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for i, c := range tt.chunks {
+				if w := uploadRequest(h.Append, http.MethodPatch, id, c.offset, c.data); w.Code != c.want {
+					t.Errorf("Append() #%d status = %d, want %d: %s", i, w.Code, c.want, w.Body.String())
+				}
+			}
+			got, err := ioutil.ReadFile(dst)
+			if tt.want == "" && !os.IsNotExist(err) || tt.want != "" && string(got) != tt.want {
+				t.Errorf("uploaded file = %q, %v, want %q", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestUploadCancel(t *testing.T) {
+	h, cleanup := newTestUploads(t)
+	defer cleanup()
+	id := createUpload(t, h, "/files/x.mkv", 6)
+	if w := uploadRequest(h.Append, http.MethodPatch, id, 0, "abc"); w.Code != http.StatusOK {
+		t.Fatalf("Append() status = %d: %s", w.Code, w.Body.String())
+	}
+	if w := uploadRequest(h.Cancel, http.MethodDelete, id, 0, ""); w.Code != http.StatusNoContent {
+		t.Errorf("Cancel() status = %d, want %d", w.Code, http.StatusNoContent)
+	}
+	if w := uploadRequest(h.Status, http.MethodHead, id, 0, ""); w.Code != http.StatusNotFound {
+		t.Errorf("Status() after Cancel() = %d, want %d", w.Code, http.StatusNotFound)
+	}
+	left, err := filepath.Glob(filepath.Join(h.dir, "*"))
+	if err != nil || len(left) != 0 {
+		t.Errorf("files left after Cancel(): %v, %v", left, err)
+	}
+}
+
+func TestUploadAppendStoresExpiry(t *testing.T) {
+	h, cleanup := newTestUploads(t)
+	defer cleanup()
+	id := createUpload(t, h, "/files/x.mkv", 6)
+
+	// Chunks arriving later have to push the stored expiry out too.
+	h.ttl = 3 * time.Hour
+	if w := uploadRequest(h.Append, http.MethodPatch, id, 0, "abc"); w.Code != http.StatusOK {
+		t.Fatalf("Append() status = %d: %s", w.Code, w.Body.String())
+	}
+
+	restarted, err := NewUploadHandler(h.dir, time.Hour, 0, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	us, ok := restarted.sessions[id]
+	if !ok {
+		t.Fatal("session wasn't picked up after a restart")
+	}
+	if us.Offset != 3 {
+		t.Errorf("Offset = %d, want 3", us.Offset)
+	}
+	if until := time.Until(us.Expires); until < 2*time.Hour {
+		t.Errorf("session expires in %s, want the expiry of the last chunk", until)
+	}
+}
+
+func TestUploadAppendExpired(t *testing.T) {
+	h, cleanup := newTestUploads(t)
+	defer cleanup()
+	id := createUpload(t, h, "/files/x.mkv", 6)
+	h.sessions[id].Expires = time.Now().Add(-time.Minute)
+
+	if w := uploadRequest(h.Append, http.MethodPatch, id, 0, "abc"); w.Code != http.StatusGone {
+		t.Errorf("Append() status = %d, want %d: %s", w.Code, http.StatusGone, w.Body.String())
+	}
+	if w := uploadRequest(h.Status, http.MethodHead, id, 0, ""); w.Code != http.StatusNotFound {
+		t.Errorf("Status() after expiry = %d, want %d", w.Code, http.StatusNotFound)
+	}
+	if _, err := os.Stat(h.dataPath(id)); !os.IsNotExist(err) {
+		t.Errorf("data of the expired upload wasn't removed: %v", err)
+	}
+}
+
+func TestUploadChunkLimit(t *testing.T) {
+	const chunkLimit = 2 << 20
+	tests := []struct {
+		name string
+		size int
+		want int
+	}{
+		{"over the body limit", 3 << 19, http.StatusOK},
+		{"over the chunk limit", chunkLimit + 1, http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, cleanup := newTestUploads(t)
+			defer cleanup()
+			s := New("localhost", 0, zap.NewNop())
+			s.SetLimits(0, 1<<20)
+			s.Handle("/uploads/{id}", http.HandlerFunc(h.Append), "PATCH")
+			s.SetBodyLimit("PATCH", "/uploads/{id}", chunkLimit)
+			id := createUpload(t, h, "/files/x.mkv", tt.size)
+
+			r := httptest.NewRequest(http.MethodPatch, uploadsPrefix+id, strings.NewReader(strings.Repeat("x", tt.size)))
+			r.Header.Set(httputil.UploadOffsetHeader, "0")
+			w := httptest.NewRecorder()
+			s.Handler().ServeHTTP(w, r)
+			if w.Code != tt.want {
+				t.Errorf("PATCH status = %d, want %d: %s", w.Code, tt.want, w.Body.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,124 @@
+/*
+Copyright 2020 Daniël Franke
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"hash"
+	"net/http"
+
+	"github.com/ainmosni/mediasync-server/pkg/fs"
+	"github.com/ainmosni/mediasync-server/pkg/httputil"
+	"go.uber.org/zap"
+)
+
+// verifyingWriter hashes a file while it's served, and compares it to its
+// checksum once the last byte is in. Clients accepting trailers get the result
+// in one, the response of others is aborted before its last write when the
+// file doesn't match, so they can't mistake it for a good one.
+type verifyingWriter struct {
+	http.ResponseWriter
+	fso      *fs.FilesystemObject
+	want     string
+	h        hash.Hash
+	written  int64
+	trailers bool
+	// active is false for responses that aren't the whole file.
+	active    bool
+	checksums *fs.Checksums
+	logger    *zap.Logger
+}
+
+// verifying returns w verifying the download of fso, when verification is on
+// and the checksum is known. Only complete files are verified.
+func (dh DownloadHandler) verifying(w http.ResponseWriter, r *http.Request, fso *fs.FilesystemObject, logger *zap.Logger) http.ResponseWriter {
+	if !dh.verify || r.Method != "GET" || r.Header.Get("Range") != "" || fso.Size == 0 {
+		return w
+	}
+	want, ok := dh.checksums.Known(fso)
+	if !ok {
+		return w
+	}
+	return &verifyingWriter{
+		ResponseWriter: w,
+		fso:            fso,
+		want:           want,
+		h:              sha256.New(),
+		trailers:       httputil.AcceptsTrailers(r),
+		active:         true,
+		checksums:      dh.checksums,
+		logger:         logger,
+	}
+}
+
+func (vw *verifyingWriter) WriteHeader(statusCode int) {
+	if statusCode != http.StatusOK {
+		vw.active = false
+	}
+	if vw.active && vw.trailers {
+		vw.Header().Set("Trailer", httputil.VerifiedTrailer)
+		// HTTP/1.1 only has trailers in chunked responses.
+		vw.Header().Del("Content-Length")
+	}
+	vw.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (vw *verifyingWriter) Write(p []byte) (int, error) {
+	if !vw.active {
+		return vw.ResponseWriter.Write(p)
+	}
+	vw.h.Write(p)
+	vw.written += int64(len(p))
+	if vw.written < vw.fso.Size {
+		return vw.ResponseWriter.Write(p)
+	}
+
+	vw.active = false
+	ok := hex.EncodeToString(vw.h.Sum(nil)) == vw.want
+	if !ok {
+		vw.logger.Error("served file doesn't match its checksum", zap.String("checksum", vw.want))
+		vw.checksums.Suspect(vw.fso)
+		if !vw.trailers {
+			panic(http.ErrAbortHandler)
+		}
+	}
+	n, err := vw.ResponseWriter.Write(p)
+	if vw.trailers {
+		result := "ok"
+		if !ok {
+			result = "failed"
+		}
+		vw.Header().Set(httputil.VerifiedTrailer, result)
+	}
+	return n, err
+}
+
+// ChecksumStatsHandler serves how many times served files didn't match their
+// checksum.
+func ChecksumStatsHandler(c *fs.Checksums) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		out, err := json.Marshal(struct {
+			Mismatches int64 `json:"mismatches"`
+		}{c.Mismatches()})
+		if httputil.ErrResponse(w, err, http.StatusInternalServerError) {
+			return
+		}
+		httputil.JSONResponse(w, out, http.StatusOK)
+	})
+}
@@ -0,0 +1,166 @@
+/*
+Copyright 2020 Daniël Franke
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package servertest runs the full set of HTTP handlers against a temporary
+// directory tree, for endpoint tests with golden responses.
+package servertest
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ainmosni/mediasync-server/pkg/fs"
+	"github.com/ainmosni/mediasync-server/pkg/server"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest"
+)
+
+// ServePath is where the temporary tree is served.
+const ServePath = "/files/"
+
+// RootPlaceholder replaces the temporary root in golden files.
+const RootPlaceholder = "$ROOT"
+
+// ModTime is the modification time every file in the tree gets, so responses
+// are reproducible.
+var ModTime = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// UpdateEnv is the environment variable that makes AssertGolden write the
+// golden files, a flag would be registered in every test importing us.
+const UpdateEnv = "MEDIASYNC_UPDATE_GOLDEN"
+
+// Server is a running server backed by a temporary directory tree.
+type Server struct {
+	*httptest.Server
+	// Root is the directory the tree was created in.
+	Root string
+
+	t testing.TB
+}
+
+// New creates the files in tree, keyed by slash separated path relative to the
+// root, and starts a server for them. Everything is cleaned up when the test ends.
+func New(t testing.TB, tree map[string]string) *Server {
+	t.Helper()
+	root, err := ioutil.TempDir("", "servertest")
+	if err != nil {
+		t.Fatalf("couldn't create root: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(root) })
+
+	for p, content := range tree {
+		diskPath := filepath.Join(root, filepath.FromSlash(p))
+		if err := os.MkdirAll(filepath.Dir(diskPath), 0o750); err != nil {
+			t.Fatalf("couldn't create directory for %s: %v", p, err)
+		}
+		if err := ioutil.WriteFile(diskPath, []byte(content), 0o640); err != nil {
+			t.Fatalf("couldn't create %s: %v", p, err)
+		}
+		if err := os.Chtimes(diskPath, ModTime, ModTime); err != nil {
+			t.Fatalf("couldn't set times of %s: %v", p, err)
+		}
+	}
+
+	logger := zaptest.NewLogger(t)
+	r := fs.NewRegistry(logger)
+	if err := r.Register(ServePath, root); err != nil {
+		t.Fatalf("couldn't register root: %v", err)
+	}
+
+	s := &Server{
+		Server: httptest.NewServer(newServer(r, root, logger).Handler()),
+		Root:   root,
+		t:      t,
+	}
+	t.Cleanup(s.Close)
+	return s
+}
+
+// newServer registers the handlers the same way main does, on a server of its
+// own so tests don't share any state.
+func newServer(r *fs.Registry, root string, logger *zap.Logger) *server.Server {
+	s := server.New("", 0, logger)
+	s.Handle("/fileinfo", server.NewFileInfoHandler(r, nil, logger), "GET")
+	s.Handle("/graphql", server.NewGraphQLHandler(r, logger), "POST")
+	s.Handle("/browse", server.NewBrowseHandler(r, logger), "GET")
+	s.Handle("/links", server.NewLinksHandler(r, logger), "GET")
+	s.Handle("/reports/{name}", server.NewReportsHandler(r, false, logger), "GET", "POST")
+	s.Handle("/search", server.NewSearchHandler(r, nil, logger), "GET")
+	s.Handle(ServePath, server.NewDownloadHandler(root, ServePath, nil, logger), "GET", "HEAD", "DELETE")
+	return s
+}
+
+// Do sends a request to the server and returns the response and its body.
+func (s *Server) Do(req *http.Request) (*http.Response, []byte) {
+	s.t.Helper()
+	resp, err := s.Client().Do(req)
+	if err != nil {
+		s.t.Fatalf("request %s %s failed: %v", req.Method, req.URL, err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		s.t.Fatalf("couldn't read body of %s %s: %v", req.Method, req.URL, err)
+	}
+	return resp, body
+}
+
+// Get requests path and returns the response and its body.
+func (s *Server) Get(path string) (*http.Response, []byte) {
+	s.t.Helper()
+	req, err := http.NewRequest("GET", s.URL+path, nil)
+	if err != nil {
+		s.t.Fatalf("couldn't create request: %v", err)
+	}
+	return s.Do(req)
+}
+
+// AssertGolden compares a JSON body with the golden file, after replacing the
+// temporary root with RootPlaceholder and indenting it. Run the tests with
+// UpdateEnv set to write the golden files instead.
+func (s *Server) AssertGolden(body []byte, golden string) {
+	s.t.Helper()
+	body = bytes.ReplaceAll(body, []byte(s.Root), []byte(RootPlaceholder))
+	var out bytes.Buffer
+	if err := json.Indent(&out, body, "", "  "); err != nil {
+		s.t.Fatalf("response is not JSON: %v\n%s", err, body)
+	}
+	out.WriteString("\n")
+
+	if os.Getenv(UpdateEnv) != "" {
+		if err := ioutil.WriteFile(golden, out.Bytes(), 0o640); err != nil {
+			s.t.Fatalf("couldn't update golden file: %v", err)
+		}
+		return
+	}
+
+	want, err := ioutil.ReadFile(golden)
+	if err != nil {
+		s.t.Fatalf("couldn't read golden file, run with %s=1 to create it: %v", UpdateEnv, err)
+	}
+	if !bytes.Equal(out.Bytes(), want) {
+		s.t.Errorf("response doesn't match %s:\n got: %s\nwant: %s", golden,
+			strings.TrimSpace(out.String()), strings.TrimSpace(string(want)))
+	}
+}
@@ -0,0 +1,137 @@
+/*
+Copyright 2020 Daniël Franke
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package tags keeps track of labels attached to served files.
+package tags
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"go.uber.org/zap"
+)
+
+// Store maps web paths to tags, persisted as a JSON file.
+type Store struct {
+	path   string
+	tags   map[string][]string
+	logger *zap.Logger
+	sync.RWMutex
+}
+
+// NewStore loads the store from path, a missing file gives an empty store.
+func NewStore(path string, logger *zap.Logger) (*Store, error) {
+	s := &Store{
+		path:   path,
+		tags:   make(map[string][]string),
+		logger: logger,
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			logger.Info("starting with empty tag store", zap.String("path", path))
+			return s, nil
+		}
+		return nil, err
+	}
+	err = json.Unmarshal(b, &s.tags)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Get returns the tags of the file at webPath.
+func (s *Store) Get(webPath string) []string {
+	s.RLock()
+	defer s.RUnlock()
+	return s.tags[webPath]
+}
+
+// All returns a copy of all tagged paths and their tags.
+func (s *Store) All() map[string][]string {
+	s.RLock()
+	defer s.RUnlock()
+	all := make(map[string][]string, len(s.tags))
+	for p, t := range s.tags {
+		all[p] = t
+	}
+	return all
+}
+
+// Has reports whether the file at webPath carries tag.
+func (s *Store) Has(webPath, tag string) bool {
+	for _, t := range s.Get(webPath) {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// Set replaces the tags of the file at webPath and persists the store, no
+// tags removes the file from the store.
+func (s *Store) Set(webPath string, tags []string) error {
+	s.Lock()
+	defer s.Unlock()
+	// The change only takes effect once it's persisted, so a failed save
+	// doesn't serve tags that are gone after a restart.
+	next := make(map[string][]string, len(s.tags)+1)
+	for p, t := range s.tags {
+		next[p] = t
+	}
+	if len(tags) == 0 {
+		delete(next, webPath)
+	} else {
+		t := append([]string{}, tags...)
+		sort.Strings(t)
+		next[webPath] = t
+	}
+	s.logger.Info("setting tags", zap.String("path", webPath), zap.Strings("tags", tags))
+	if err := s.save(next); err != nil {
+		return err
+	}
+	s.tags = next
+	return nil
+}
+
+// save writes tags to a temporary file first, so a crash never leaves a
+// truncated store behind.
+func (s *Store) save(tags map[string][]string) error {
+	b, err := json.Marshal(tags)
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(s.path), ".tags-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(b)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), s.path)
+}
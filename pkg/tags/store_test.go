@@ -0,0 +1,57 @@
+/*
+Copyright 2020 Daniël Franke
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tags
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+func TestStoreSetFailedSave(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tags")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s, err := NewStore(filepath.Join(dir, "tags.json"), zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Set("/files/a.mkv", []string{"old"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Saving fails once the directory of the store is gone.
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Set("/files/a.mkv", []string{"new"}); err == nil {
+		t.Fatal("Set() succeeded without a directory to save in")
+	}
+	if err := s.Set("/files/b.mkv", []string{"new"}); err == nil {
+		t.Fatal("Set() succeeded without a directory to save in")
+	}
+	want := map[string][]string{"/files/a.mkv": {"old"}}
+	if got := s.All(); !reflect.DeepEqual(got, want) {
+		t.Errorf("All() after failed saves = %v, want %v", got, want)
+	}
+}
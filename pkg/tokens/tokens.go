@@ -0,0 +1,119 @@
+/*
+Copyright 2020 Daniël Franke
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package tokens issues and verifies scoped access tokens. A token is a set of
+// claims, restricting it to path prefixes, methods and an expiry, signed with
+// HMAC-SHA256 using a secret only the server and the operator know.
+package tokens
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrInvalid communicates that a token is malformed or wrongly signed.
+	ErrInvalid = errors.New("invalid token")
+
+	// ErrExpired communicates that a token was valid, but isn't anymore.
+	ErrExpired = errors.New("token expired")
+)
+
+// Claims are what a token grants access to.
+type Claims struct {
+	// Paths are the path prefixes the token is valid for, all paths if empty.
+	Paths []string `json:"paths,omitempty"`
+	// Methods are the HTTP methods the token is valid for, all methods if empty.
+	Methods []string `json:"methods,omitempty"`
+	// Expires is a unix timestamp, the token never expires if zero.
+	Expires int64 `json:"exp,omitempty"`
+}
+
+// Allows reports whether the claims grant method on path.
+func (c *Claims) Allows(method, path string) bool {
+	return c.allowsMethod(method) && c.AllowsPath(path)
+}
+
+func (c *Claims) allowsMethod(method string) bool {
+	if len(c.Methods) == 0 {
+		return true
+	}
+	for _, m := range c.Methods {
+		if strings.EqualFold(m, method) {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowsPath reports whether path is under one of the prefixes of the claims,
+// whole segments only: /movies doesn't allow /movies-private.
+func (c *Claims) AllowsPath(path string) bool {
+	if len(c.Paths) == 0 {
+		return true
+	}
+	for _, p := range c.Paths {
+		if path == p || strings.HasPrefix(path, strings.TrimSuffix(p, "/")+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// Sign creates a token for the claims.
+func Sign(secret []byte, c Claims) (string, error) {
+	payload, err := json.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+	p := base64.RawURLEncoding.EncodeToString(payload)
+	return p + "." + base64.RawURLEncoding.EncodeToString(signature(secret, p)), nil
+}
+
+// Verify checks the signature and expiry of token, and returns its claims.
+func Verify(secret []byte, token string, now time.Time) (*Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 {
+		return nil, ErrInvalid
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || !hmac.Equal(sig, signature(secret, parts[0])) {
+		return nil, ErrInvalid
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, ErrInvalid
+	}
+	var c Claims
+	if err := json.Unmarshal(payload, &c); err != nil {
+		return nil, ErrInvalid
+	}
+	if c.Expires != 0 && now.Unix() >= c.Expires {
+		return nil, ErrExpired
+	}
+	return &c, nil
+}
+
+func signature(secret []byte, payload string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(payload))
+	return mac.Sum(nil)
+}
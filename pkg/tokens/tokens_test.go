@@ -0,0 +1,103 @@
+/*
+Copyright 2020 Daniël Franke
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tokens
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestVerify(t *testing.T) {
+	secret := []byte("secret")
+	now := time.Unix(1600000000, 0)
+	claims := Claims{Paths: []string{"/movies"}, Methods: []string{"GET"}, Expires: now.Add(time.Hour).Unix()}
+	valid, err := Sign(secret, claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired, err := Sign(secret, Claims{Expires: now.Unix()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherSecret, err := Sign([]byte("other"), claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload := strings.Split(valid, ".")[0]
+	widened, err := Sign(secret, Claims{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		token   string
+		want    *Claims
+		wantErr error
+	}{
+		{"valid", valid, &claims, nil},
+		{"expired", expired, nil, ErrExpired},
+		{"other secret", otherSecret, nil, ErrInvalid},
+		{"swapped payload", strings.Split(widened, ".")[0] + "." + strings.Split(valid, ".")[1], nil, ErrInvalid},
+		{"no signature", payload, nil, ErrInvalid},
+		{"empty signature", payload + ".", nil, ErrInvalid},
+		{"too many parts", valid + ".x", nil, ErrInvalid},
+		{"bad encoding", "!!!." + strings.Split(valid, ".")[1], nil, ErrInvalid},
+		{"empty", "", nil, ErrInvalid},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Verify(secret, tt.token, now)
+			if !errors.Is(err, tt.wantErr) || !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Verify() = %+v, %v, want %+v, %v", got, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestAllows(t *testing.T) {
+	tests := []struct {
+		name   string
+		claims Claims
+		method string
+		path   string
+		want   bool
+	}{
+		{"no restrictions", Claims{}, "DELETE", "/movies/a.mkv", true},
+		{"under prefix", Claims{Paths: []string{"/movies"}}, "GET", "/movies/a.mkv", true},
+		{"prefix itself", Claims{Paths: []string{"/movies"}}, "GET", "/movies", true},
+		{"prefix with slash", Claims{Paths: []string{"/movies/"}}, "GET", "/movies/a.mkv", true},
+		{"sibling sharing prefix", Claims{Paths: []string{"/movies"}}, "GET", "/movies-private/a.mkv", false},
+		{"sibling file", Claims{Paths: []string{"/movies"}}, "GET", "/movies.txt", false},
+		{"other prefix", Claims{Paths: []string{"/tv", "/movies"}}, "GET", "/movies/a.mkv", true},
+		{"outside prefixes", Claims{Paths: []string{"/tv"}}, "GET", "/movies/a.mkv", false},
+		{"root allows all", Claims{Paths: []string{"/"}}, "GET", "/movies/a.mkv", true},
+		{"method allowed", Claims{Methods: []string{"GET", "HEAD"}}, "head", "/movies/a.mkv", true},
+		{"method not allowed", Claims{Methods: []string{"GET"}}, "DELETE", "/movies/a.mkv", false},
+		{"both must allow", Claims{Paths: []string{"/movies"}, Methods: []string{"GET"}}, "GET", "/tv/a.mkv", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.claims.Allows(tt.method, tt.path); got != tt.want {
+				t.Errorf("Allows(%q, %q) = %v, want %v", tt.method, tt.path, got, tt.want)
+			}
+		})
+	}
+}